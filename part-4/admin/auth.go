@@ -0,0 +1,78 @@
+package admin
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// auth modes
+const (
+	AuthNone   = ""
+	AuthAPIKey = "api_key" // a key created through the admin api, sent in APIKeyHeader
+	AuthJWT    = "jwt"     // a bearer token signed by a key of the JWKS
+)
+
+// header the api key is read from when the policy doesn't name one
+const DefaultAPIKeyHeader = "X-Api-Key"
+
+// AuthPolicy decides who may call a service, the gateway checks it before a request
+// reaches a container. the verified identity is passed on to the container as headers
+type AuthPolicy struct {
+	Mode         string `json:"mode"`
+	APIKeyHeader string `json:"api_key_header,omitempty"`
+	// where the keys that sign tokens come from, exactly one of them in jwt mode
+	JWKSURL  string `json:"jwks_url,omitempty"`
+	JWKSFile string `json:"jwks_file,omitempty"`
+	Issuer   string `json:"issuer,omitempty"`   // iss a token must have, not checked if empty
+	Audience string `json:"audience,omitempty"` // aud a token must contain, not checked if empty
+	// claims a token must carry with the given value, e.g. {"scope": "reports:read"}.
+	// a valid token without them is refused with 403
+	RequiredClaims datatypes.JSONType[map[string]string] `json:"required_claims"`
+}
+
+func (ap *AuthPolicy) isValid() bool {
+	switch ap.Mode {
+	case AuthNone, AuthAPIKey:
+		return true
+	case AuthJWT:
+		if (ap.JWKSURL == "") == (ap.JWKSFile == "") {
+			return false
+		}
+		if ap.JWKSURL != "" {
+			u, err := url.Parse(ap.JWKSURL)
+			return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+		}
+		return true
+	}
+	return false
+}
+
+// APIKey lets a client call a service, only the hash of the key is stored
+type APIKey struct {
+	gorm.Model
+	ServiceDefinitionID uint   `json:"service_definition_id" gorm:"index,references:ID"`
+	Name                string `json:"name"` // who the key was given to, passed on to the service
+	Hash                string `json:"-" gorm:"index"`
+}
+
+// HashAPIKey returns the hex encoded sha256 of key. keys are random so a fast hash is enough
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAPIKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "cless_" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,112 @@
+package admin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrCertificateNotFound = errors.New("certificate not found")
+
+// Certificate is a TLS certificate served for Host, which may be a wildcard like *.cless.cloud
+type Certificate struct {
+	gorm.Model
+	Host     string    `json:"host" gorm:"unique"`
+	CertPEM  string    `json:"cert_pem"`
+	KeyPEM   string    `json:"key_pem,omitempty"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+type CertificateRepository interface {
+	GetAll() ([]Certificate, error)
+	// Put creates the certificate for its host or replaces the existing one
+	Put(cert *Certificate) error
+	Delete(host string) error
+}
+
+// CertificateManager validates uploaded certificates and tells listeners when they change
+type CertificateManager struct {
+	repo     CertificateRepository
+	mutex    sync.Mutex
+	onChange []func()
+}
+
+func NewCertificateManager(repo CertificateRepository) *CertificateManager {
+	return &CertificateManager{repo: repo}
+}
+
+// OnChange registers fn to be called after a certificate was added, replaced or deleted
+func (m *CertificateManager) OnChange(fn func()) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.onChange = append(m.onChange, fn)
+}
+
+// PutCertificate stores the certificate for host, replacing any previous one
+func (m *CertificateManager) PutCertificate(host string, certPEM, keyPEM string) error {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if host == "" {
+		return errors.New("host is required")
+	}
+	pair, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return fmt.Errorf("invalid certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("invalid certificate: %w", err)
+	}
+	// any name under a wildcard host has to be covered by the certificate
+	name := host
+	if strings.HasPrefix(host, "*.") {
+		name = "cless" + host[1:]
+	}
+	if err := leaf.VerifyHostname(name); err != nil {
+		return fmt.Errorf("invalid certificate: %w", err)
+	}
+
+	m.mutex.Lock()
+	err = m.repo.Put(&Certificate{
+		Host:     host,
+		CertPEM:  certPEM,
+		KeyPEM:   keyPEM,
+		NotAfter: leaf.NotAfter,
+	})
+	m.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	m.notify()
+	return nil
+}
+
+func (m *CertificateManager) DeleteCertificate(host string) error {
+	m.mutex.Lock()
+	err := m.repo.Delete(strings.ToLower(host))
+	m.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	m.notify()
+	return nil
+}
+
+// ListCertificates returns all stored certificates including their private keys
+func (m *CertificateManager) ListCertificates() ([]Certificate, error) {
+	return m.repo.GetAll()
+}
+
+func (m *CertificateManager) notify() {
+	m.mutex.Lock()
+	listeners := m.onChange
+	m.mutex.Unlock()
+	for _, fn := range listeners {
+		fn()
+	}
+}
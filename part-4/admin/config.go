@@ -0,0 +1,44 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Config holds the settings of the admin server and the service definition manager
+type Config struct {
+	Host string `yaml:"host" toml:"host"` // requests for this host go to the admin server
+	Port int    `yaml:"port" toml:"port"` // port the admin server listens on
+	// host names given to services registered without one, %d is replaced by 0 to 100
+	HostNameTemplate string `yaml:"host_name_template" toml:"host_name_template"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Host:             "admin.cless.cloud",
+		Port:             1323,
+		HostNameTemplate: "app-%d.cless.cloud",
+	}
+}
+
+// Addr is where the admin server can be reached from this machine
+func (cfg Config) Addr() string {
+	return fmt.Sprintf("localhost:%d", cfg.Port)
+}
+
+func (cfg Config) Validate() error {
+	var errs []error
+	if cfg.Host == "" {
+		errs = append(errs, errors.New("host must not be empty"))
+	}
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port must be between 1 and 65535, got %d", cfg.Port))
+	}
+	if strings.Count(cfg.HostNameTemplate, "%") != 1 || !strings.Contains(cfg.HostNameTemplate, "%d") {
+		errs = append(errs, fmt.Errorf("host name template must contain %%d once, got %q", cfg.HostNameTemplate))
+	} else if fmt.Sprintf(cfg.HostNameTemplate, 0) == cfg.Host {
+		errs = append(errs, errors.New("host name template must not produce the admin host"))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,200 @@
+package admin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrSubscriptionNotFound = errors.New("subscription not found")
+
+// ErrEventExists is returned when an event with the same id was published before.
+// publishers retry with the same ce-id, so the first event stands and nothing is delivered twice
+var ErrEventExists = errors.New("event already published")
+
+// largest event data the bus accepts
+const MaxEventBytes = 1 << 20
+
+// topic names are used in urls, keep them simple
+var topicPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,127}$`)
+
+// Event is a message published to a topic, delivered to subscribers as a CloudEvent
+type Event struct {
+	gorm.Model
+	EventID     string    `json:"event_id" gorm:"uniqueIndex"` // CloudEvents id
+	Topic       string    `json:"topic" gorm:"index"`
+	Type        string    `json:"type"`
+	Source      string    `json:"source"`
+	Subject     string    `json:"subject,omitempty"`
+	ContentType string    `json:"content_type"`
+	Data        []byte    `json:"data"`
+	Time        time.Time `json:"time"`
+}
+
+// Subscription sends the events of a topic to a path of a service
+type Subscription struct {
+	gorm.Model
+	Topic   string `json:"topic" gorm:"index"`
+	Service string `json:"service"` // name of the service definition
+	Path    string `json:"path"`
+}
+
+// event delivery states
+const (
+	DeliveryPending    = "pending"
+	DeliveryRunning    = "running"
+	DeliveryDelivered  = "delivered"
+	DeliveryDeadLetter = "dead_letter" // every attempt failed, kept until redriven
+)
+
+// EventDelivery is one event on its way to one subscription
+type EventDelivery struct {
+	gorm.Model
+	EventID        uint         `json:"event_id" gorm:"index"`
+	Event          Event        `json:"event"`
+	SubscriptionID uint         `json:"subscription_id" gorm:"index"`
+	Subscription   Subscription `json:"-"`
+	Status         string       `json:"status" gorm:"index"`
+	Attempts       int          `json:"attempts"`
+	NextAttemptAt  time.Time    `json:"next_attempt_at" gorm:"index"`
+	LastError      string       `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time   `json:"delivered_at,omitempty"`
+}
+
+type EventRepository interface {
+	// Publish stores event with a pending delivery for every subscription of its topic.
+	// if its id is taken event is replaced by the stored one and ErrEventExists is returned
+	Publish(event *Event) error
+	CreateSubscription(sub *Subscription) error
+	DeleteSubscription(id uint) error
+	GetSubscriptions(topic string) ([]Subscription, error)
+	// ClaimDue marks up to limit pending deliveries whose next attempt is due as running
+	// and returns them with their event and subscription
+	ClaimDue(now time.Time, limit int) ([]EventDelivery, error)
+	UpdateDelivery(delivery *EventDelivery) error
+	// RequeueRunning puts deliveries a previous process was working on back to pending
+	RequeueRunning() error
+	// DeadLetters returns the dead lettered deliveries of a subscription, oldest first
+	DeadLetters(subscriptionID uint) ([]EventDelivery, error)
+	// Redrive puts the dead lettered deliveries of a subscription back to pending
+	Redrive(subscriptionID uint) (int64, error)
+	// DeleteDelivered removes deliveries made before, and events published before
+	// that have no delivery left. pending and dead lettered deliveries keep their event
+	DeleteDelivered(before time.Time) (int64, error)
+}
+
+// EventBus accepts published events and manages the subscriptions of topics.
+// delivery is up to whoever registered with OnPublish
+type EventBus struct {
+	repo      EventRepository
+	manager   *ServiceDefinitionManager
+	mutex     sync.Mutex
+	onPublish []func()
+}
+
+func NewEventBus(repo EventRepository, manager *ServiceDefinitionManager) *EventBus {
+	return &EventBus{repo: repo, manager: manager}
+}
+
+// Repository is used by the dispatcher that delivers the events
+func (b *EventBus) Repository() EventRepository {
+	return b.repo
+}
+
+// OnPublish registers fn to be called after an event was stored
+func (b *EventBus) OnPublish(fn func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.onPublish = append(b.onPublish, fn)
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Publish stores event for delivery to the current subscribers of its topic.
+// an event whose id was published before is not stored again, see ErrEventExists
+func (b *EventBus) Publish(event *Event) error {
+	if !topicPattern.MatchString(event.Topic) {
+		return fmt.Errorf("invalid topic %q", event.Topic)
+	}
+	if event.EventID == "" {
+		event.EventID = newEventID()
+	}
+	if event.Type == "" {
+		event.Type = "cloud.cless.event"
+	}
+	if event.Source == "" {
+		event.Source = "/topics/" + event.Topic
+	}
+	if event.ContentType == "" {
+		event.ContentType = "application/json"
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if err := b.repo.Publish(event); err != nil {
+		return err
+	}
+	b.notify()
+	return nil
+}
+
+// Subscribe sends future events of sub.Topic to sub.Path of sub.Service
+func (b *EventBus) Subscribe(sub *Subscription) error {
+	if !topicPattern.MatchString(sub.Topic) {
+		return fmt.Errorf("invalid topic %q", sub.Topic)
+	}
+	if sub.Path == "" {
+		sub.Path = "/"
+	}
+	if !strings.HasPrefix(sub.Path, "/") {
+		return errors.New("path must start with /")
+	}
+	if _, err := b.manager.GetServiceDefinitionByName(sub.Service); err != nil {
+		return err
+	}
+	return b.repo.CreateSubscription(sub)
+}
+
+func (b *EventBus) Unsubscribe(id uint) error {
+	return b.repo.DeleteSubscription(id)
+}
+
+func (b *EventBus) Subscriptions(topic string) ([]Subscription, error) {
+	return b.repo.GetSubscriptions(topic)
+}
+
+func (b *EventBus) DeadLetters(subscriptionID uint) ([]EventDelivery, error) {
+	return b.repo.DeadLetters(subscriptionID)
+}
+
+// Redrive gives the dead lettered deliveries of a subscription a fresh set of attempts
+func (b *EventBus) Redrive(subscriptionID uint) (int64, error) {
+	n, err := b.repo.Redrive(subscriptionID)
+	if err != nil || n == 0 {
+		return n, err
+	}
+	b.notify()
+	return n, nil
+}
+
+func (b *EventBus) notify() {
+	b.mutex.Lock()
+	listeners := b.onPublish
+	b.mutex.Unlock()
+	for _, fn := range listeners {
+		fn()
+	}
+}
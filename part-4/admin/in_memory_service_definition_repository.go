@@ -4,6 +4,7 @@ import "sync"
 
 type InMemoryServiceDefinitionRepository struct {
 	services map[string]ServiceDefinition
+	lastID   uint
 	mutex    *sync.Mutex
 }
 
@@ -52,14 +53,27 @@ func (r *InMemoryServiceDefinitionRepository) Create(service ServiceDefinition)
 	if ok {
 		return ErrServiceAlreadyExists
 	}
+	service.ID = r.nextID()
 	r.services[service.Name] = service
 	return nil
 }
 
+func (r *InMemoryServiceDefinitionRepository) Update(service *ServiceDefinition) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, ok := r.services[service.Name]
+	if !ok {
+		return ErrServiceNotFound
+	}
+	r.services[service.Name] = *service
+	return nil
+}
+
 func (r *InMemoryServiceDefinitionRepository) AddVersion(service *ServiceDefinition, version *ServiceVersion) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	version.ServiceDefinitionID = service.ID
+	version.ID = r.nextID()
 	service.Versions = append(service.Versions, *version)
 	_, ok := r.services[service.Name]
 	if !ok {
@@ -74,6 +88,7 @@ func (r *InMemoryServiceDefinitionRepository) AddTrafficWeight(service *ServiceD
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	weight.ServiceDefinitionID = service.ID
+	weight.ID = r.nextID()
 	service.TrafficWeights = append(service.TrafficWeights, *weight)
 	_, ok := r.services[service.Name]
 	if !ok {
@@ -82,3 +97,154 @@ func (r *InMemoryServiceDefinitionRepository) AddTrafficWeight(service *ServiceD
 	r.services[service.Name] = *service
 	return nil
 }
+
+func (r *InMemoryServiceDefinitionRepository) AddRoutingRule(service *ServiceDefinition, rule *RoutingRule) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, ok := r.services[service.Name]
+	if !ok {
+		return ErrServiceNotFound
+	}
+	rule.ServiceDefinitionID = service.ID
+	rule.ID = r.nextID()
+	service.RoutingRules = append(service.RoutingRules, *rule)
+	r.services[service.Name] = *service
+	return nil
+}
+
+func (r *InMemoryServiceDefinitionRepository) DeleteRoutingRule(service *ServiceDefinition, ruleID uint) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	stored, ok := r.services[service.Name]
+	if !ok {
+		return ErrServiceNotFound
+	}
+	rules := make([]RoutingRule, 0, len(stored.RoutingRules))
+	for _, rule := range stored.RoutingRules {
+		if rule.ID != ruleID {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == len(stored.RoutingRules) {
+		return ErrRoutingRuleNotFound
+	}
+	stored.RoutingRules = rules
+	service.RoutingRules = rules
+	r.services[service.Name] = stored
+	return nil
+}
+
+func (r *InMemoryServiceDefinitionRepository) AddVersionRule(service *ServiceDefinition, rule *VersionRule) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, ok := r.services[service.Name]
+	if !ok {
+		return ErrServiceNotFound
+	}
+	rule.ServiceDefinitionID = service.ID
+	rule.ID = r.nextID()
+	service.VersionRules = append(service.VersionRules, *rule)
+	r.services[service.Name] = *service
+	return nil
+}
+
+func (r *InMemoryServiceDefinitionRepository) DeleteVersionRule(service *ServiceDefinition, ruleID uint) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	stored, ok := r.services[service.Name]
+	if !ok {
+		return ErrServiceNotFound
+	}
+	rules := make([]VersionRule, 0, len(stored.VersionRules))
+	for _, rule := range stored.VersionRules {
+		if rule.ID != ruleID {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == len(stored.VersionRules) {
+		return ErrVersionRuleNotFound
+	}
+	stored.VersionRules = rules
+	service.VersionRules = rules
+	r.services[service.Name] = stored
+	return nil
+}
+
+func (r *InMemoryServiceDefinitionRepository) AddSchedule(service *ServiceDefinition, schedule *Schedule) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, ok := r.services[service.Name]
+	if !ok {
+		return ErrServiceNotFound
+	}
+	schedule.ServiceDefinitionID = service.ID
+	schedule.ID = r.nextID()
+	service.Schedules = append(service.Schedules, *schedule)
+	r.services[service.Name] = *service
+	return nil
+}
+
+func (r *InMemoryServiceDefinitionRepository) DeleteSchedule(service *ServiceDefinition, scheduleID uint) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	stored, ok := r.services[service.Name]
+	if !ok {
+		return ErrServiceNotFound
+	}
+	schedules := make([]Schedule, 0, len(stored.Schedules))
+	for _, schedule := range stored.Schedules {
+		if schedule.ID != scheduleID {
+			schedules = append(schedules, schedule)
+		}
+	}
+	if len(schedules) == len(stored.Schedules) {
+		return ErrScheduleNotFound
+	}
+	stored.Schedules = schedules
+	service.Schedules = schedules
+	r.services[service.Name] = stored
+	return nil
+}
+
+func (r *InMemoryServiceDefinitionRepository) AddAPIKey(service *ServiceDefinition, key *APIKey) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, ok := r.services[service.Name]
+	if !ok {
+		return ErrServiceNotFound
+	}
+	key.ServiceDefinitionID = service.ID
+	key.ID = r.nextID()
+	service.APIKeys = append(service.APIKeys, *key)
+	r.services[service.Name] = *service
+	return nil
+}
+
+func (r *InMemoryServiceDefinitionRepository) DeleteAPIKey(service *ServiceDefinition, keyID uint) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	stored, ok := r.services[service.Name]
+	if !ok {
+		return ErrServiceNotFound
+	}
+	keys := make([]APIKey, 0, len(stored.APIKeys))
+	for _, key := range stored.APIKeys {
+		if key.ID != keyID {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == len(stored.APIKeys) {
+		return ErrAPIKeyNotFound
+	}
+	stored.APIKeys = keys
+	service.APIKeys = keys
+	r.services[service.Name] = stored
+	return nil
+}
+
+// nextID hands out unique ids the same way the sqlite auto increment would,
+// so keys built from ids don't collide. caller must hold the mutex
+func (r *InMemoryServiceDefinitionRepository) nextID() uint {
+	r.lastID++
+	return r.lastID
+}
@@ -0,0 +1,57 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+var ErrInvocationNotFound = errors.New("invocation not found")
+
+// invocation states
+const (
+	InvocationQueued     = "queued"      // waiting for its next attempt
+	InvocationRunning    = "running"     // a worker is delivering it
+	InvocationCompleted  = "completed"   // the container answered, see ResponseStatus
+	InvocationDeadLetter = "dead_letter" // every attempt failed, it won't be tried again
+)
+
+// Invocation is a request accepted for asynchronous delivery to a service.
+// the request is stored as it was routed without its credentials, the response once a container answered it
+type Invocation struct {
+	gorm.Model
+	InvocationID string                          `json:"invocation_id" gorm:"uniqueIndex"`
+	Service      string                          `json:"service"`
+	Host         string                          `json:"-"` // host of the service, used to find the container
+	Version      uint                            `json:"version"`
+	Method       string                          `json:"method"`
+	Path         string                          `json:"path"` // path and query as the container gets them
+	Header       datatypes.JSONType[http.Header] `json:"-"`
+	Body         []byte                          `json:"-"`
+
+	Status        string    `json:"status" gorm:"index"`
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at" gorm:"index"`
+	LastError     string    `json:"last_error,omitempty"`
+
+	ResponseStatus int                             `json:"response_status,omitempty"`
+	ResponseHeader datatypes.JSONType[http.Header] `json:"response_header"`
+	ResponseBody   []byte                          `json:"response_body,omitempty"` // base64 in JSON
+	CompletedAt    *time.Time                      `json:"completed_at,omitempty"`
+}
+
+type InvocationRepository interface {
+	Create(inv *Invocation) error
+	Get(invocationID string) (*Invocation, error)
+	// ClaimDue marks up to limit queued invocations whose next attempt is due as running
+	// and returns them, oldest first
+	ClaimDue(now time.Time, limit int) ([]Invocation, error)
+	Update(inv *Invocation) error
+	// RequeueRunning puts invocations a previous process was delivering back in the queue
+	RequeueRunning() error
+	// DeleteFinished removes completed and dead lettered invocations that finished before
+	DeleteFinished(before time.Time) (int64, error)
+}
@@ -0,0 +1,39 @@
+package admin
+
+import (
+	"time"
+
+	"codereliant.io/cless/tracecontext"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// requestContext gives admin requests what the gateway gives proxied ones: the request id
+// is taken from the request or generated and returned to the client, the trace continues
+// in a new span, and both end up in every log line about the request
+func requestContext() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			tc := tracecontext.FromHeader(req.Header)
+			tc.Inject(req.Header)
+			c.Response().Header().Set(tracecontext.RequestIDHeader, tc.RequestID)
+			logger := tc.Logger(log.Logger)
+			c.SetRequest(req.WithContext(logger.WithContext(req.Context())))
+
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				// write the error now so the status below is the one the client gets
+				c.Error(err)
+			}
+			logger.Info().
+				Str("method", req.Method).
+				Str("path", req.URL.Path).
+				Int("status", c.Response().Status).
+				Dur("duration", time.Since(start)).
+				Msg("admin request")
+			return err
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package admin
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"codereliant.io/cless/tracecontext"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRequestContextMiddleware tests that admin requests keep the client's request id,
+// get it back and have it in their log lines together with the trace id
+func TestRequestContextMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+	defaultLogger := log.Logger
+	log.Logger = zerolog.New(&logs)
+	defer func() { log.Logger = defaultLogger }()
+
+	e := echo.New()
+	e.Use(requestContext())
+	e.GET("/", func(c echo.Context) error {
+		zerolog.Ctx(c.Request().Context()).Info().Msg("handler")
+		return c.String(http.StatusOK, c.Request().Header.Get(tracecontext.TraceparentHeader))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(tracecontext.RequestIDHeader, "admin-req-1")
+	req.Header.Set(tracecontext.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, "admin-req-1", rec.Header().Get(tracecontext.RequestIDHeader))
+	assert.Contains(t, rec.Body.String(), "4bf92f3577b34da6a3ce929d0e0e4736")
+	lines := bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n"))
+	assert.Len(t, lines, 2)
+	for _, line := range lines {
+		assert.Contains(t, string(line), `"request_id":"admin-req-1"`)
+		assert.Contains(t, string(line), `"trace_id":"4bf92f3577b34da6a3ce929d0e0e4736"`)
+	}
+}
@@ -0,0 +1,26 @@
+package admin
+
+import "errors"
+
+// ErrInvalidReplicas is returned for a replica override outside of 1 to the version's max replicas
+var ErrInvalidReplicas = errors.New("replicas must be between 1 and the max replicas of the version")
+
+// ReplicaStatus is the state of the replica pool of a version
+type ReplicaStatus struct {
+	Service  string `json:"service"`
+	Version  uint   `json:"version"`
+	Ready    int    `json:"ready"`    // replicas serving requests
+	Starting int    `json:"starting"` // replicas being started
+	InFlight int64  `json:"in_flight"`
+	Desired  int    `json:"desired"`  // replicas the autoscaler or the override asks for
+	Override int    `json:"override"` // replicas set through the admin api, 0 when autoscaled
+}
+
+// ReplicaController shows and overrides the number of containers running a version.
+// implemented by the container manager
+type ReplicaController interface {
+	Replicas(sDef *ExternalServiceDefinition) ReplicaStatus
+	// SetReplicas keeps the version at replicas containers whatever the load,
+	// 0 hands it back to the autoscaler
+	SetReplicas(sDef *ExternalServiceDefinition, replicas int) error
+}
@@ -0,0 +1,146 @@
+package admin
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// RoutingTable is an immutable snapshot of the service definitions used to route requests.
+// a new table with a higher Version replaces the old one on every admin change,
+// so readers never need a lock and never touch the database.
+// service definitions in the table are shared between readers and must not be modified
+type RoutingTable struct {
+	Version   uint64
+	byHost    map[string]*ServiceDefinition
+	byName    map[string]*ServiceDefinition
+	rules     map[string][]route
+	splitters map[uint]splitterOf // by service ID
+}
+
+// splitterOf is the splitter of a service with what it was built from. kept apart from
+// the service definitions, callers change those before the routes are reloaded
+type splitterOf struct {
+	name     string
+	strategy string
+	splitter TrafficSplitter
+}
+
+// route is a routing rule together with the service it points to
+type route struct {
+	rule *RoutingRule
+	sDef *ServiceDefinition
+}
+
+// newRoutingTable builds the snapshot that follows previous, nil for the first one.
+// services keep the splitter of previous while their name and strategy don't change,
+// so an admin change doesn't restart the round robin of every service
+func newRoutingTable(previous *RoutingTable, sDefs []ServiceDefinition) *RoutingTable {
+	rt := &RoutingTable{
+		Version:   1,
+		byHost:    make(map[string]*ServiceDefinition, len(sDefs)),
+		byName:    make(map[string]*ServiceDefinition, len(sDefs)),
+		rules:     make(map[string][]route),
+		splitters: make(map[uint]splitterOf, len(sDefs)),
+	}
+	if previous != nil {
+		rt.Version = previous.Version + 1
+	}
+	for i := range sDefs {
+		sDef := &sDefs[i]
+		// sort a copy, the repository may still hold on to the original slice
+		sDef.VersionRules = append([]VersionRule(nil), sDef.VersionRules...)
+		sort.SliceStable(sDef.VersionRules, func(i, j int) bool {
+			a, b := sDef.VersionRules[i], sDef.VersionRules[j]
+			if a.Priority != b.Priority {
+				return a.Priority < b.Priority
+			}
+			return a.ID < b.ID
+		})
+		if prev, ok := previous.splitterOf(sDef); ok {
+			sDef.splitter = prev.splitter
+			rt.splitters[sDef.ID] = prev
+		} else if splitter, err := NewTrafficSplitter(sDef.SplitStrategy, sDef.Name, rand.NewSource(time.Now().UnixNano()+int64(sDef.ID))); err == nil {
+			sDef.splitter = splitter
+			rt.splitters[sDef.ID] = splitterOf{name: sDef.Name, strategy: sDef.SplitStrategy, splitter: splitter}
+		}
+		rt.byHost[sDef.Host] = sDef
+		rt.byName[sDef.Name] = sDef
+		for j := range sDef.RoutingRules {
+			rule := &sDef.RoutingRules[j]
+			rt.rules[rule.Host] = append(rt.rules[rule.Host], route{rule: rule, sDef: sDef})
+		}
+	}
+	// longest prefix first so the first match is the most specific one
+	for _, routes := range rt.rules {
+		sort.Slice(routes, func(i, j int) bool {
+			return len(routes[i].rule.PathPrefix) > len(routes[j].rule.PathPrefix)
+		})
+	}
+	return rt
+}
+
+// splitterOf returns the splitter sDef had in the table if it still fits
+func (rt *RoutingTable) splitterOf(sDef *ServiceDefinition) (splitterOf, bool) {
+	if rt == nil {
+		return splitterOf{}, false
+	}
+	prev, ok := rt.splitters[sDef.ID]
+	return prev, ok && prev.name == sDef.Name && prev.strategy == sDef.SplitStrategy
+}
+
+// ServiceByHost returns the service routed to by hostName
+func (rt *RoutingTable) ServiceByHost(hostName string) (*ServiceDefinition, error) {
+	sDef, ok := rt.byHost[hostName]
+	if !ok {
+		return nil, ErrServiceNotFound
+	}
+	return sDef, nil
+}
+
+// ServiceByName returns the service called name
+func (rt *RoutingTable) ServiceByName(name string) (*ServiceDefinition, error) {
+	sDef, ok := rt.byName[name]
+	if !ok {
+		return nil, ErrServiceNotFound
+	}
+	return sDef, nil
+}
+
+// Services returns every service in the table
+func (rt *RoutingTable) Services() []*ServiceDefinition {
+	services := make([]*ServiceDefinition, 0, len(rt.byHost))
+	for _, sDef := range rt.byHost {
+		services = append(services, sDef)
+	}
+	return services
+}
+
+// Serves reports whether requests for hostName reach a service, by its host or a routing rule
+func (rt *RoutingTable) Serves(hostName string) bool {
+	_, ok := rt.byHost[hostName]
+	return ok || len(rt.rules[hostName]) > 0
+}
+
+// Route returns the service a request for hostName and path goes to.
+// routing rules are tried first, longest prefix wins, then the host of the service itself.
+// the matching rule is nil when the request was routed by host alone
+func (rt *RoutingTable) Route(hostName, path string) (*ServiceDefinition, *RoutingRule, error) {
+	for _, r := range rt.rules[hostName] {
+		if r.rule.MatchesPath(path) {
+			return r.sDef, r.rule, nil
+		}
+	}
+	sDef, err := rt.ServiceByHost(hostName)
+	return sDef, nil, err
+}
+
+// hasRule reports whether a rule for exactly this host and prefix exists
+func (rt *RoutingTable) hasRule(hostName, pathPrefix string) bool {
+	for _, r := range rt.rules[hostName] {
+		if r.rule.PathPrefix == pathPrefix {
+			return true
+		}
+	}
+	return false
+}
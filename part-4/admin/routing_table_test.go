@@ -0,0 +1,193 @@
+package admin
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// TestRoutingTableFollowsAdminChanges tests that every admin change swaps in a newer snapshot
+func TestRoutingTableFollowsAdminChanges(t *testing.T) {
+	manager := NewServiceDefinitionManager(NewInMemoryServiceDefinitionRepository(), DefaultConfig())
+	initial := manager.Routes()
+	_, err := manager.GetServiceDefinitionByHost("test.cless.cloud")
+	assert.ErrorIs(t, err, ErrServiceNotFound)
+
+	err = manager.RegisterServiceDefinition("test", "test.cless.cloud")
+	assert.NoError(t, err)
+	sDef, err := manager.GetServiceDefinitionByHost("test.cless.cloud")
+	assert.NoError(t, err)
+	assert.Equal(t, "test", sDef.Name)
+	assert.Greater(t, manager.Routes().Version, initial.Version)
+
+	err = manager.AddVersion(sDef, &ServiceVersion{ImageName: "test", ImageTag: "latest", Port: 8080})
+	assert.NoError(t, err)
+	ext, err := manager.GetExternalServiceDefinitionByHost("test.cless.cloud", sDef.Versions[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", ext.Version.ImageName)
+
+	// the old snapshot is left untouched for readers still holding it
+	_, err = initial.ServiceByHost("test.cless.cloud")
+	assert.ErrorIs(t, err, ErrServiceNotFound)
+}
+
+// TestRoutingRulesLongestPrefix tests that the most specific rule wins and conflicting rules are rejected
+func TestRoutingRulesLongestPrefix(t *testing.T) {
+	manager := NewServiceDefinitionManager(NewInMemoryServiceDefinitionRepository(), DefaultConfig())
+	for _, name := range []string{"users", "admins", "orders"} {
+		assert.NoError(t, manager.RegisterServiceDefinition(name, ""))
+	}
+	users, _ := manager.GetServiceDefinitionByName("users")
+	admins, _ := manager.GetServiceDefinitionByName("admins")
+	orders, _ := manager.GetServiceDefinitionByName("orders")
+	assert.NoError(t, manager.AddRoutingRule(users, &RoutingRule{Host: "api.cless.cloud", PathPrefix: "/users"}))
+	assert.NoError(t, manager.AddRoutingRule(admins, &RoutingRule{Host: "api.cless.cloud", PathPrefix: "/users/admins/"}))
+	assert.NoError(t, manager.AddRoutingRule(orders, &RoutingRule{Host: "api.cless.cloud", PathPrefix: "orders"}))
+
+	err := manager.AddRoutingRule(orders, &RoutingRule{Host: "api.cless.cloud", PathPrefix: "/users/"})
+	assert.ErrorIs(t, err, ErrRoutingRuleConflict)
+
+	tests := []struct {
+		path    string
+		service string
+	}{
+		{"/users", "users"},
+		{"/users/42", "users"},
+		{"/users/admins", "admins"},
+		{"/users/admins/7", "admins"},
+		{"/orders/1", "orders"},
+	}
+	for _, tt := range tests {
+		sDef, _, err := manager.Routes().Route("api.cless.cloud", tt.path)
+		assert.NoError(t, err, tt.path)
+		assert.Equal(t, tt.service, sDef.Name, tt.path)
+	}
+
+	_, _, err = manager.Routes().Route("api.cless.cloud", "/usersettings")
+	assert.ErrorIs(t, err, ErrServiceNotFound)
+
+	// the service host keeps working next to the rules
+	sDef, rule, err := manager.Routes().Route(users.Host, "/anything")
+	assert.NoError(t, err)
+	assert.Nil(t, rule)
+	assert.Equal(t, "users", sDef.Name)
+}
+
+// TestRoutingRulesKeepOtherHosts tests that a rule can't take over the host of another service
+// and that rule hosts are not handed out to new services
+func TestRoutingRulesKeepOtherHosts(t *testing.T) {
+	manager := NewServiceDefinitionManager(NewInMemoryServiceDefinitionRepository(), DefaultConfig())
+	assert.NoError(t, manager.RegisterServiceDefinition("users", "users.cless.cloud"))
+	assert.NoError(t, manager.RegisterServiceDefinition("orders", "orders.cless.cloud"))
+	users, _ := manager.GetServiceDefinitionByName("users")
+
+	err := manager.AddRoutingRule(users, &RoutingRule{Host: "orders.cless.cloud", PathPrefix: "/users"})
+	assert.ErrorIs(t, err, ErrRoutingRuleConflict)
+	assert.NoError(t, manager.AddRoutingRule(users, &RoutingRule{Host: "users.cless.cloud", PathPrefix: "/v2"}))
+
+	next := fmt.Sprintf(DefaultConfig().HostNameTemplate, 7)
+	assert.NoError(t, manager.AddRoutingRule(users, &RoutingRule{Host: next, PathPrefix: "/"}))
+	assert.False(t, manager.hosts[next])
+	reloaded := NewServiceDefinitionManager(manager.repo, DefaultConfig())
+	assert.False(t, reloaded.hosts[next])
+
+	// a new service can't take the host of a service or of a rule either
+	assert.ErrorIs(t, manager.RegisterServiceDefinition("shop", "orders.cless.cloud"), ErrHostConflict)
+	assert.ErrorIs(t, manager.RegisterServiceDefinition("shop", next), ErrHostConflict)
+	assert.ErrorIs(t, manager.RegisterServiceDefinition("shop", DefaultConfig().Host), ErrHostConflict)
+	_, err = manager.GetServiceDefinitionByName("shop")
+	assert.ErrorIs(t, err, ErrServiceNotFound)
+}
+
+func newBenchmarkManager(b *testing.B) (*ServiceDefinitionManager, ServiceDefinitionRepository) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(b.TempDir(), "bench.sqlite3")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		b.Fatalf("Failed to open sqlite db: %s", err)
+	}
+	repo := NewSqliteServiceDefinitionRepository(db)
+	manager := NewServiceDefinitionManager(repo, DefaultConfig())
+	if err := manager.RegisterServiceDefinition("bench", "bench.cless.cloud"); err != nil {
+		b.Fatalf("Failed to register service definition: %s", err)
+	}
+	sDef, _ := manager.GetServiceDefinitionByName("bench")
+	for i := 0; i < 3; i++ {
+		if err := manager.AddVersion(sDef, &ServiceVersion{ImageName: "bench", ImageTag: "latest", Port: 8080}); err != nil {
+			b.Fatalf("Failed to add version: %s", err)
+		}
+	}
+	weight := &TrafficWeight{Weights: []Weight{
+		{ServiceVersionID: sDef.Versions[0].ID, Weight: 20},
+		{ServiceVersionID: sDef.Versions[1].ID, Weight: 30},
+		{ServiceVersionID: sDef.Versions[2].ID, Weight: 50},
+	}}
+	if err := manager.AddTrafficWeight(sDef, weight); err != nil {
+		b.Fatalf("Failed to add traffic weight: %s", err)
+	}
+	return manager, repo
+}
+
+// BenchmarkRequestPathSqlite is the lookup a proxied request used to do: two preloaded queries
+func BenchmarkRequestPathSqlite(b *testing.B) {
+	_, repo := newBenchmarkManager(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sDef, err := repo.GetByHostName("bench.cless.cloud")
+		if err != nil {
+			b.Fatal(err)
+		}
+		sDef.ChooseVersion("")
+		if _, err := repo.GetByHostName("bench.cless.cloud"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRequestPathRoutingTable is the same lookup served from the routing snapshot
+func BenchmarkRequestPathRoutingTable(b *testing.B) {
+	manager, _ := newBenchmarkManager(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sDef, err := manager.GetServiceDefinitionByHost("bench.cless.cloud")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := manager.GetExternalServiceDefinitionByHost("bench.cless.cloud", sDef.ChooseVersion("")); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestSplitterSurvivesReloads tests that the round robin of a service carries on over admin changes
+// that leave its strategy alone, and starts over when the strategy changes
+func TestSplitterSurvivesReloads(t *testing.T) {
+	manager := NewServiceDefinitionManager(NewInMemoryServiceDefinitionRepository(), DefaultConfig())
+	assert.NoError(t, manager.RegisterServiceDefinition("split", "split.cless.cloud"))
+	sDef, _ := manager.GetServiceDefinitionByName("split")
+	assert.NoError(t, manager.SetSplitStrategy(sDef, SplitRoundRobin))
+	sDef, _ = manager.GetServiceDefinitionByName("split")
+	assert.NoError(t, manager.AddTrafficWeight(sDef, &TrafficWeight{Weights: []Weight{{ServiceVersionID: 1, Weight: 50}, {ServiceVersionID: 2, Weight: 50}}}))
+
+	var picks []uint
+	for i := 0; i < 4; i++ {
+		routed, _ := manager.GetServiceDefinitionByHost("split.cless.cloud")
+		picks = append(picks, routed.ChooseVersion(""))
+		sDef, _ = manager.GetServiceDefinitionByName("split")
+		// an unrelated change reloads the routes between every request
+		assert.NoError(t, manager.SetRedirectHTTPS(sDef, i%2 == 0))
+	}
+	assert.Equal(t, []uint{1, 2, 1, 2}, picks)
+
+	routed, _ := manager.GetServiceDefinitionByHost("split.cless.cloud")
+	sDef, _ = manager.GetServiceDefinitionByName("split")
+	assert.NoError(t, manager.SetSplitStrategy(sDef, SplitWeightedRandom))
+	rerouted, _ := manager.GetServiceDefinitionByHost("split.cless.cloud")
+	assert.IsType(t, &RoundRobinSplitter{}, routed.splitter)
+	assert.IsType(t, &WeightedRandomSplitter{}, rerouted.splitter)
+}
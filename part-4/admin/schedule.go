@@ -0,0 +1,95 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"gorm.io/gorm"
+)
+
+var ErrScheduleNotFound = errors.New("schedule not found")
+
+// Schedule invokes a service on a cron expression, e.g. a nightly report job
+type Schedule struct {
+	gorm.Model
+	ServiceDefinitionID uint   `json:"service_definition_id" gorm:"index,references:ID"`
+	Cron                string `json:"cron"`      // five field cron expression or a descriptor like @daily
+	TimeZone            string `json:"time_zone"` // IANA name like Europe/Berlin, UTC if empty
+	Method              string `json:"method"`
+	Path                string `json:"path"`
+	Body                string `json:"body,omitempty"`
+	ServiceVersionID    uint   `json:"service_version_id"` // 0 picks the version by traffic weights
+}
+
+// NextRun returns the first time after the schedule fires, in the schedule's time zone
+func (s *Schedule) NextRun(after time.Time) (time.Time, error) {
+	loc := time.UTC
+	if s.TimeZone != "" {
+		var err error
+		loc, err = time.LoadLocation(s.TimeZone)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	spec, err := cron.ParseStandard(s.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return spec.Next(after.In(loc)), nil
+}
+
+func (s *Schedule) isValid() bool {
+	if _, err := s.NextRun(time.Now()); err != nil {
+		return false
+	}
+	return strings.HasPrefix(s.Path, "/") && s.Method != "" && !strings.ContainsAny(s.Method, " \t\r\n")
+}
+
+// schedule run states
+const (
+	RunRunning   = "running"
+	RunSucceeded = "succeeded" // the service answered with a status below 400
+	RunFailed    = "failed"
+	RunSkipped   = "skipped" // the previous run was still going
+)
+
+// ScheduleRun records one firing of a schedule and how it went
+type ScheduleRun struct {
+	gorm.Model
+	ScheduleID     uint       `json:"schedule_id" gorm:"index"`
+	Service        string     `json:"service"`
+	Version        uint       `json:"version"`
+	ScheduledAt    time.Time  `json:"scheduled_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	Status         string     `json:"status"`
+	ResponseStatus int        `json:"response_status,omitempty"`
+	Error          string     `json:"error,omitempty"`
+}
+
+// Outcome sets the status of a finished run from the response status or the error that prevented one
+func (run *ScheduleRun) Outcome(responseStatus int, err error) {
+	now := time.Now()
+	run.FinishedAt = &now
+	run.ResponseStatus = responseStatus
+	switch {
+	case err != nil:
+		run.Status = RunFailed
+		run.Error = err.Error()
+	case responseStatus >= http.StatusBadRequest:
+		run.Status = RunFailed
+	default:
+		run.Status = RunSucceeded
+	}
+}
+
+type ScheduleRunRepository interface {
+	Create(run *ScheduleRun) error
+	Update(run *ScheduleRun) error
+	// ListBySchedule returns the latest runs of a schedule, newest first
+	ListBySchedule(scheduleID uint, limit int) ([]ScheduleRun, error)
+	// Prune removes all but the latest keep runs of a schedule
+	Prune(scheduleID uint, keep int) error
+}
@@ -1,21 +1,33 @@
 package admin
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 
+	"codereliant.io/cless/metrics"
 	"github.com/labstack/echo/v4"
 )
 
-const AdminHost = "admin.cless.cloud"
-const AdminPort = 1323
-
-func StartAdminServer(manager *ServiceDefinitionManager) {
+func StartAdminServer(
+	cfg Config,
+	manager *ServiceDefinitionManager,
+	certManager *CertificateManager,
+	invocations InvocationRepository,
+	runs ScheduleRunRepository,
+	bus *EventBus,
+	replicas ReplicaController,
+) {
 	e := echo.New()
+	e.Use(requestContext())
 	e.GET("/", func(c echo.Context) error {
 		return c.String(http.StatusOK, "Admin server is running")
 	})
 
+	e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+
 	e.GET("/serviceDefinitions", func(c echo.Context) error {
 		services, err := manager.ListAllServiceDefinitions()
 		if err != nil {
@@ -41,7 +53,11 @@ func StartAdminServer(manager *ServiceDefinitionManager) {
 		if !service.isValid() {
 			return c.String(http.StatusBadRequest, "Invalid service definition")
 		}
-		if err := manager.RegisterServiceDefinition(service.Name, service.Host); err != nil {
+		err := manager.RegisterServiceDefinition(service.Name, service.Host)
+		if errors.Is(err, ErrHostConflict) {
+			return c.String(http.StatusConflict, err.Error())
+		}
+		if err != nil {
 			return c.String(http.StatusBadRequest, err.Error())
 		}
 		return c.String(http.StatusCreated, "Service definition created")
@@ -75,6 +91,47 @@ func StartAdminServer(manager *ServiceDefinitionManager) {
 		return c.JSON(http.StatusOK, service.Versions)
 	})
 
+	// replica pool of a version
+	e.GET("/serviceDefinitions/:name/versions/:id/replicas", func(c echo.Context) error {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		version, err := manager.GetExternalServiceDefinition(c.Param("name"), uint(id))
+		if errors.Is(err, ErrServiceNotFound) || errors.Is(err, ErrVersionNotFound) {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, replicas.Replicas(version))
+	})
+
+	// pin the replica count of a version, 0 goes back to autoscaling
+	e.PUT("/serviceDefinitions/:name/versions/:id/replicas", func(c echo.Context) error {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		version, err := manager.GetExternalServiceDefinition(c.Param("name"), uint(id))
+		if errors.Is(err, ErrServiceNotFound) || errors.Is(err, ErrVersionNotFound) {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		body := struct {
+			Replicas int `json:"replicas"`
+		}{}
+		if err := c.Bind(&body); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if err := replicas.SetReplicas(version, body.Replicas); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.JSON(http.StatusOK, replicas.Replicas(version))
+	})
+
 	// list traffic weights for a service definition
 	e.GET("/serviceDefinitions/:name/trafficWeights", func(c echo.Context) error {
 		name := c.Param("name")
@@ -103,5 +160,642 @@ func StartAdminServer(manager *ServiceDefinitionManager) {
 		return c.String(http.StatusCreated, "Traffic weight added")
 	})
 
-	e.Logger.Fatal(e.Start(fmt.Sprintf(":%d", AdminPort)))
+	// list routing rules for a service definition
+	e.GET("/serviceDefinitions/:name/routingRules", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, service.RoutingRules)
+	})
+
+	// add new routing rule for a service definition
+	e.POST("/serviceDefinitions/:name/routingRules", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		rule := new(RoutingRule)
+		if err := c.Bind(rule); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		err = manager.AddRoutingRule(service, rule)
+		if errors.Is(err, ErrRoutingRuleConflict) {
+			return c.String(http.StatusConflict, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.String(http.StatusCreated, "Routing rule added")
+	})
+
+	// delete a routing rule of a service definition
+	e.DELETE("/serviceDefinitions/:name/routingRules/:id", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		err = manager.DeleteRoutingRule(service, uint(id))
+		if err == ErrRoutingRuleNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.String(http.StatusOK, "Routing rule deleted")
+	})
+
+	// list version rules for a service definition
+	e.GET("/serviceDefinitions/:name/versionRules", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, service.VersionRules)
+	})
+
+	// add new version rule for a service definition
+	e.POST("/serviceDefinitions/:name/versionRules", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		rule := new(VersionRule)
+		if err := c.Bind(rule); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if err := manager.AddVersionRule(service, rule); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.String(http.StatusCreated, "Version rule added")
+	})
+
+	// delete a version rule of a service definition
+	e.DELETE("/serviceDefinitions/:name/versionRules/:id", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		err = manager.DeleteVersionRule(service, uint(id))
+		if err == ErrVersionRuleNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.String(http.StatusOK, "Version rule deleted")
+	})
+
+	// list schedules of a service definition
+	e.GET("/serviceDefinitions/:name/schedules", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, service.Schedules)
+	})
+
+	// add new schedule for a service definition
+	e.POST("/serviceDefinitions/:name/schedules", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		schedule := new(Schedule)
+		if err := c.Bind(schedule); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if err := manager.AddSchedule(service, schedule); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.JSON(http.StatusCreated, schedule)
+	})
+
+	// delete a schedule of a service definition
+	e.DELETE("/serviceDefinitions/:name/schedules/:id", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		err = manager.DeleteSchedule(service, uint(id))
+		if err == ErrScheduleNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.String(http.StatusOK, "Schedule deleted")
+	})
+
+	// latest runs of a schedule, newest first
+	e.GET("/serviceDefinitions/:name/schedules/:id/runs", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		found := false
+		for _, schedule := range service.Schedules {
+			found = found || schedule.ID == uint(id)
+		}
+		if !found {
+			return c.String(http.StatusNotFound, ErrScheduleNotFound.Error())
+		}
+		scheduleRuns, err := runs.ListBySchedule(uint(id), 100)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, scheduleRuns)
+	})
+
+	// turn http to https redirects on or off for a service definition
+	e.PUT("/serviceDefinitions/:name/redirectHTTPS", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		body := struct {
+			RedirectHTTPS bool `json:"redirect_https"`
+		}{}
+		if err := c.Bind(&body); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if err := manager.SetRedirectHTTPS(service, body.RedirectHTTPS); err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.String(http.StatusOK, "Redirect updated")
+	})
+
+	// configure sticky version assignment for a service definition
+	e.PUT("/serviceDefinitions/:name/sticky", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		sticky := new(StickySession)
+		if err := c.Bind(sticky); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if err := manager.SetStickySession(service, *sticky); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.String(http.StatusOK, "Sticky session updated")
+	})
+
+	// choose the traffic split strategy of a service definition
+	e.PUT("/serviceDefinitions/:name/splitStrategy", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		body := struct {
+			SplitStrategy string `json:"split_strategy"`
+		}{}
+		if err := c.Bind(&body); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if err := manager.SetSplitStrategy(service, body.SplitStrategy); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.String(http.StatusOK, "Split strategy updated")
+	})
+
+	// configure gateway retries for a service definition
+	e.PUT("/serviceDefinitions/:name/retryPolicy", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		policy := new(RetryPolicy)
+		if err := c.Bind(policy); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if err := manager.SetRetryPolicy(service, *policy); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.String(http.StatusOK, "Retry policy updated")
+	})
+
+	// get the rate limit of a service definition
+	e.GET("/serviceDefinitions/:name/rateLimit", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, service.RateLimit)
+	})
+
+	// set the rate limit of a service definition
+	e.PUT("/serviceDefinitions/:name/rateLimit", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		limit := new(RateLimit)
+		if err := c.Bind(limit); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if err := manager.SetRateLimit(service, *limit); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.String(http.StatusOK, "Rate limit updated")
+	})
+
+	// remove the rate limit of a service definition
+	e.DELETE("/serviceDefinitions/:name/rateLimit", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		if err := manager.SetRateLimit(service, RateLimit{}); err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.String(http.StatusOK, "Rate limit removed")
+	})
+
+	// mirror a share of the traffic of a service definition to a version
+	e.PUT("/serviceDefinitions/:name/mirror", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		mirror := new(MirrorPolicy)
+		if err := c.Bind(mirror); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if err := manager.SetMirror(service, *mirror); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.String(http.StatusOK, "Mirror updated")
+	})
+
+	// get the auth policy of a service definition
+	e.GET("/serviceDefinitions/:name/auth", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, service.Auth)
+	})
+
+	// set how callers of a service definition are authenticated
+	e.PUT("/serviceDefinitions/:name/auth", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		policy := new(AuthPolicy)
+		if err := c.Bind(policy); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if err := manager.SetAuthPolicy(service, *policy); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.String(http.StatusOK, "Auth policy updated")
+	})
+
+	// list the api keys of a service definition, the keys themselves are not kept
+	e.GET("/serviceDefinitions/:name/apiKeys", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, service.APIKeys)
+	})
+
+	// create an api key for a service definition, the answer is the only place the key shows up
+	e.POST("/serviceDefinitions/:name/apiKeys", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		body := struct {
+			Name string `json:"name"`
+		}{}
+		if err := c.Bind(&body); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		secret, key, err := manager.CreateAPIKey(service, body.Name)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.JSON(http.StatusCreated, map[string]interface{}{"id": key.ID, "name": key.Name, "key": secret})
+	})
+
+	// revoke an api key of a service definition
+	e.DELETE("/serviceDefinitions/:name/apiKeys/:id", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		err = manager.DeleteAPIKey(service, uint(id))
+		if err == ErrAPIKeyNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.String(http.StatusOK, "API key deleted")
+	})
+
+	// get the response cache policy of a service definition
+	e.GET("/serviceDefinitions/:name/cache", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, service.Cache)
+	})
+
+	// set the response cache policy of a service definition
+	e.PUT("/serviceDefinitions/:name/cache", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		policy := new(CachePolicy)
+		if err := c.Bind(policy); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if err := manager.SetCachePolicy(service, *policy); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.String(http.StatusOK, "Cache policy updated")
+	})
+
+	// drop the cached responses of a service definition
+	e.POST("/serviceDefinitions/:name/cache/purge", func(c echo.Context) error {
+		name := c.Param("name")
+		service, err := manager.GetServiceDefinitionByName(name)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		manager.PurgeCache(service)
+		return c.String(http.StatusOK, "Cache purged")
+	})
+
+	// list certificates, private keys are never returned
+	e.GET("/certificates", func(c echo.Context) error {
+		certs, err := certManager.ListCertificates()
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		for i := range certs {
+			certs[i].KeyPEM = ""
+		}
+		return c.JSON(http.StatusOK, certs)
+	})
+
+	// upload or replace the certificate for a host
+	e.PUT("/certificates/:host", func(c echo.Context) error {
+		cert := new(Certificate)
+		if err := c.Bind(cert); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if err := certManager.PutCertificate(c.Param("host"), cert.CertPEM, cert.KeyPEM); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.String(http.StatusOK, "Certificate stored")
+	})
+
+	e.DELETE("/certificates/:host", func(c echo.Context) error {
+		err := certManager.DeleteCertificate(c.Param("host"))
+		if err == ErrCertificateNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.String(http.StatusOK, "Certificate deleted")
+	})
+
+	// status and response of an asynchronous invocation
+	e.GET("/invocations/:id", func(c echo.Context) error {
+		inv, err := invocations.Get(c.Param("id"))
+		if err == ErrInvocationNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, inv)
+	})
+
+	// publish an event to a topic, the request body is the event data.
+	// ce-type, ce-source, ce-subject and ce-id headers override the defaults
+	e.POST("/topics/:topic/events", func(c echo.Context) error {
+		data, err := io.ReadAll(io.LimitReader(c.Request().Body, MaxEventBytes+1))
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if len(data) > MaxEventBytes {
+			return c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("events are limited to %d bytes", MaxEventBytes))
+		}
+		header := c.Request().Header
+		event := &Event{
+			EventID:     header.Get("ce-id"),
+			Topic:       c.Param("topic"),
+			Type:        header.Get("ce-type"),
+			Source:      header.Get("ce-source"),
+			Subject:     header.Get("ce-subject"),
+			ContentType: header.Get("Content-Type"),
+			Data:        data,
+		}
+		// a retried publish gets the event stored the first time
+		if err := bus.Publish(event); err != nil && !errors.Is(err, ErrEventExists) {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.JSON(http.StatusAccepted, map[string]string{"event_id": event.EventID})
+	})
+
+	// list subscriptions of a topic
+	e.GET("/topics/:topic/subscriptions", func(c echo.Context) error {
+		subs, err := bus.Subscriptions(c.Param("topic"))
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, subs)
+	})
+
+	// subscribe a service to a topic
+	e.POST("/topics/:topic/subscriptions", func(c echo.Context) error {
+		sub := new(Subscription)
+		if err := c.Bind(sub); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		sub.Topic = c.Param("topic")
+		err := bus.Subscribe(sub)
+		if err == ErrServiceNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.JSON(http.StatusCreated, sub)
+	})
+
+	e.DELETE("/subscriptions/:id", func(c echo.Context) error {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		err = bus.Unsubscribe(uint(id))
+		if err == ErrSubscriptionNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.String(http.StatusOK, "Subscription deleted")
+	})
+
+	// events that could not be delivered to a subscription
+	e.GET("/subscriptions/:id/deadLetters", func(c echo.Context) error {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		deliveries, err := bus.DeadLetters(uint(id))
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, deliveries)
+	})
+
+	// try the dead lettered events of a subscription again
+	e.POST("/subscriptions/:id/redrive", func(c echo.Context) error {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		n, err := bus.Redrive(uint(id))
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.String(http.StatusOK, fmt.Sprintf("%d events requeued", n))
+	})
+
+	e.Logger.Fatal(e.Start(fmt.Sprintf(":%d", cfg.Port)))
 }
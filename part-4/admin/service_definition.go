@@ -4,7 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
-	"sync"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"gorm.io/datatypes"
 	"gorm.io/gorm"
@@ -12,14 +15,49 @@ import (
 
 var ErrServiceNotFound = errors.New("service not found")
 var ErrServiceAlreadyExists = errors.New("service already exists")
-var randLock = &sync.Mutex{}
+var ErrVersionNotFound = errors.New("version not found")
+var ErrRoutingRuleNotFound = errors.New("routing rule not found")
+var ErrRoutingRuleConflict = errors.New("routing rule conflicts with an existing rule")
+var ErrHostConflict = errors.New("host is already routed")
+var ErrVersionRuleNotFound = errors.New("version rule not found")
+
+// used by services that don't have a splitter of their own
+var defaultSplitter = NewWeightedRandomSplitter(rand.NewSource(time.Now().UnixNano()))
 
 type ServiceDefinition struct {
 	gorm.Model
 	Name           string           `json:"name" gorm:"unique"`
 	Versions       []ServiceVersion `json:"versions" gorm:"foreignKey:ServiceDefinitionID"`
 	TrafficWeights []TrafficWeight  `json:"traffic_weights" gorm:"foreignKey:ServiceDefinitionID"`
+	RoutingRules   []RoutingRule    `json:"routing_rules" gorm:"foreignKey:ServiceDefinitionID"`
+	VersionRules   []VersionRule    `json:"version_rules" gorm:"foreignKey:ServiceDefinitionID"`
+	Schedules      []Schedule       `json:"schedules" gorm:"foreignKey:ServiceDefinitionID"`
+	APIKeys        []APIKey         `json:"api_keys" gorm:"foreignKey:ServiceDefinitionID"`
 	Host           string           `json:"host"`
+	RedirectHTTPS  bool             `json:"redirect_https"`
+	Sticky         StickySession    `json:"sticky" gorm:"embedded;embeddedPrefix:sticky_"`
+	SplitStrategy  string           `json:"split_strategy"`
+	Retry          RetryPolicy      `json:"retry" gorm:"embedded;embeddedPrefix:retry_"`
+	RateLimit      RateLimit        `json:"rate_limit" gorm:"embedded;embeddedPrefix:rate_limit_"`
+	Mirror         MirrorPolicy     `json:"mirror" gorm:"embedded;embeddedPrefix:mirror_"`
+	Cache          CachePolicy      `json:"cache" gorm:"embedded;embeddedPrefix:cache_"`
+	Auth           AuthPolicy       `json:"auth" gorm:"embedded;embeddedPrefix:auth_"`
+
+	splitter TrafficSplitter // set on services in the routing table
+}
+
+// sticky session modes
+const (
+	StickyNone     = ""
+	StickyCookie   = "cookie"    // the gateway remembers the version in a cookie
+	StickyHeader   = "header"    // the version is derived from a hash of a request header
+	StickyClientIP = "client_ip" // the version is derived from a hash of the client ip
+)
+
+// StickySession keeps a client on the version it was first assigned
+type StickySession struct {
+	Mode   string `json:"mode"`
+	Header string `json:"header,omitempty"` // header to hash in header mode, e.g. X-User-ID
 }
 
 type TrafficWeight struct {
@@ -40,6 +78,173 @@ type ServiceVersion struct {
 	ImageTag            string                      `json:"image_tag"`
 	Port                int                         `json:"port"`
 	EnvVars             datatypes.JSONSlice[string] `json:"env_vars"`
+	// how containers of the version are stopped: StopSignal once their requests have drained,
+	// SIGKILL if they are still running StopGracePeriodSeconds later
+	StopSignal             string `json:"stop_signal,omitempty"`
+	StopGracePeriodSeconds int    `json:"stop_grace_period_seconds,omitempty"`
+	// requests are spread over the replicas of the version by LoadBalancing. a replica is added
+	// when the requests in flight per replica pass ConcurrencyTarget, up to MaxReplicas,
+	// and removed as the load drops. without a target the version runs in one container
+	LoadBalancing     string `json:"load_balancing,omitempty"`
+	ConcurrencyTarget int    `json:"concurrency_target,omitempty"`
+	MaxReplicas       int    `json:"max_replicas,omitempty"`
+}
+
+// load balancing strategies over the replicas of a version
+const (
+	BalanceRoundRobin       = "round_robin" // default
+	BalanceLeastOutstanding = "least_outstanding"
+)
+
+// used for versions that don't set their own
+const (
+	DefaultStopSignal      = "SIGTERM"
+	DefaultStopGracePeriod = 10 * time.Second
+	DefaultMaxReplicas     = 10
+)
+
+// signals a version may be stopped with
+var stopSignals = map[string]bool{
+	"SIGTERM": true, "SIGINT": true, "SIGQUIT": true, "SIGHUP": true, "SIGUSR1": true, "SIGUSR2": true, "SIGWINCH": true,
+}
+
+func (sVer *ServiceVersion) GetStopSignal() string {
+	if sVer.StopSignal == "" {
+		return DefaultStopSignal
+	}
+	return sVer.StopSignal
+}
+
+func (sVer *ServiceVersion) GetStopGracePeriod() time.Duration {
+	if sVer.StopGracePeriodSeconds == 0 {
+		return DefaultStopGracePeriod
+	}
+	return time.Duration(sVer.StopGracePeriodSeconds) * time.Second
+}
+
+func (sVer *ServiceVersion) GetLoadBalancing() string {
+	if sVer.LoadBalancing == "" {
+		return BalanceRoundRobin
+	}
+	return sVer.LoadBalancing
+}
+
+func (sVer *ServiceVersion) GetMaxReplicas() int {
+	if sVer.MaxReplicas == 0 {
+		return DefaultMaxReplicas
+	}
+	return sVer.MaxReplicas
+}
+
+// RoutingRule sends requests for Host whose path starts with PathPrefix to the owning service.
+// when several rules match a request the one with the longest prefix wins,
+// StripPrefix removes the prefix from the path before the request is proxied
+type RoutingRule struct {
+	gorm.Model
+	ServiceDefinitionID uint   `json:"service_definition_id" gorm:"index,references:ID"`
+	Host                string `json:"host"`
+	PathPrefix          string `json:"path_prefix"`
+	StripPrefix         bool   `json:"strip_prefix"`
+}
+
+// VersionRule sends requests carrying a header or query parameter with the given value
+// to a specific version, ahead of the traffic weights.
+// rules are evaluated by ascending Priority, then in the order they were added
+type VersionRule struct {
+	gorm.Model
+	ServiceDefinitionID uint   `json:"service_definition_id" gorm:"index,references:ID"`
+	Priority            int    `json:"priority"`
+	Header              string `json:"header,omitempty"` // e.g. X-Beta-User
+	Query               string `json:"query,omitempty"`  // e.g. variant
+	Value               string `json:"value"`
+	ServiceVersionID    uint   `json:"service_version_id"`
+}
+
+func (rule *VersionRule) matches(header http.Header, query url.Values) bool {
+	if rule.Header != "" {
+		return header.Get(rule.Header) == rule.Value
+	}
+	return query.Get(rule.Query) == rule.Value
+}
+
+// the most attempts a retry policy may ask for
+const MaxRetryAttempts = 5
+
+// RetryPolicy lets the gateway send idempotent requests again when the container
+// refuses the connection or answers 502/503
+type RetryPolicy struct {
+	MaxAttempts  int   `json:"max_attempts"`   // attempts including the first one, 0 or 1 turns retries off
+	MaxBodyBytes int64 `json:"max_body_bytes"` // larger request bodies are not buffered and not retried
+	Failover     bool  `json:"failover"`       // retry on another version of the active traffic weight
+}
+
+func (rp *RetryPolicy) isValid() bool {
+	return rp.MaxAttempts >= 0 && rp.MaxAttempts <= MaxRetryAttempts && rp.MaxBodyBytes >= 0
+}
+
+// what a rate limit counts requests by
+const (
+	RateLimitGlobal   = "global"    // one bucket for the whole service
+	RateLimitClientIP = "client_ip" // one bucket per client ip
+	RateLimitHeader   = "header"    // one bucket per value of a header, e.g. an API key
+)
+
+// RateLimit caps how much traffic the gateway lets through to a service.
+// requests over the limit are answered with 429 before a container is woken up
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"` // token refill rate, 0 turns rate limiting off
+	Burst             int     `json:"burst"`               // bucket size
+	KeyBy             string  `json:"key_by"`              // global if empty
+	Header            string  `json:"header,omitempty"`    // header to key by in header mode
+	MaxInFlight       int     `json:"max_in_flight"`       // concurrent requests, 0 means no cap
+}
+
+func (rl *RateLimit) isValid() bool {
+	if rl.RequestsPerSecond < 0 || rl.MaxInFlight < 0 {
+		return false
+	}
+	if rl.RequestsPerSecond > 0 && rl.Burst < 1 {
+		return false
+	}
+	switch rl.KeyBy {
+	case "", RateLimitGlobal, RateLimitClientIP:
+		return true
+	case RateLimitHeader:
+		return rl.Header != ""
+	}
+	return false
+}
+
+// MirrorPolicy sends a copy of a share of the traffic to a version, e.g. one that is about
+// to get traffic weight. the copies are fire and forget, clients only ever see the answer
+// of the version the request was routed to
+type MirrorPolicy struct {
+	Percent          uint  `json:"percent"`            // share of requests to copy, 0 turns mirroring off
+	ServiceVersionID uint  `json:"service_version_id"` // version that gets the copies
+	MaxBodyBytes     int64 `json:"max_body_bytes"`     // requests with larger bodies are not mirrored
+}
+
+func (mp *MirrorPolicy) isValid() bool {
+	if mp.Percent > 100 || mp.MaxBodyBytes < 0 {
+		return false
+	}
+	return mp.Percent == 0 || mp.ServiceVersionID != 0
+}
+
+// CachePolicy lets the gateway answer GET and HEAD requests of a service from a response cache,
+// so repeated requests don't wake up a container. only responses that allow it through
+// Cache-Control are stored, each version has entries of its own
+type CachePolicy struct {
+	Enabled       bool  `json:"enabled"`
+	MaxBytes      int64 `json:"max_bytes"`       // size of the service's cache, headers and bodies
+	MaxTTLSeconds int   `json:"max_ttl_seconds"` // caps how long a response asks to be kept, 0 means no cap
+}
+
+func (cp *CachePolicy) isValid() bool {
+	if cp.MaxBytes < 0 || cp.MaxTTLSeconds < 0 {
+		return false
+	}
+	return !cp.Enabled || cp.MaxBytes > 0
 }
 
 type ExternalServiceDefinition struct {
@@ -57,7 +262,47 @@ func (sDef *ServiceDefinition) isValid() bool {
 }
 
 func (sVer *ServiceVersion) isValid() bool {
-	return sVer.ImageName != "" && sVer.ImageTag != "" && sVer.Port > 0
+	return sVer.ImageName != "" && sVer.ImageTag != "" && sVer.Port > 0 &&
+		(sVer.StopSignal == "" || stopSignals[sVer.StopSignal]) && sVer.StopGracePeriodSeconds >= 0 &&
+		(sVer.LoadBalancing == "" || sVer.LoadBalancing == BalanceRoundRobin || sVer.LoadBalancing == BalanceLeastOutstanding) &&
+		sVer.ConcurrencyTarget >= 0 && sVer.MaxReplicas >= 0
+}
+
+// the prefix is normalized before the rule is checked
+func (rule *RoutingRule) isValid() bool {
+	return rule.Host != ""
+}
+
+// normalizePathPrefix makes "/users", "/users/" and "users" the same prefix
+func normalizePathPrefix(prefix string) string {
+	return "/" + strings.Trim(prefix, "/")
+}
+
+// MatchesPath reports whether path falls under the rule's prefix,
+// "/users" matches "/users" and "/users/1" but not "/usersettings"
+func (rule *RoutingRule) MatchesPath(path string) bool {
+	if rule.PathPrefix == "/" {
+		return true
+	}
+	if !strings.HasPrefix(path, rule.PathPrefix) {
+		return false
+	}
+	return len(path) == len(rule.PathPrefix) || path[len(rule.PathPrefix)] == '/'
+}
+
+// a rule looks at exactly one header or query parameter
+func (rule *VersionRule) isValid() bool {
+	return (rule.Header == "") != (rule.Query == "") && rule.Value != "" && rule.ServiceVersionID != 0
+}
+
+func (ss *StickySession) isValid() bool {
+	switch ss.Mode {
+	case StickyNone, StickyCookie, StickyClientIP:
+		return true
+	case StickyHeader:
+		return ss.Header != ""
+	}
+	return false
 }
 
 func (tw *TrafficWeight) isValid() bool {
@@ -69,28 +314,95 @@ func (tw *TrafficWeight) isValid() bool {
 	return sum == 100
 }
 
-// ChooseVersion randomly chooses a version based on the weights
+// ActiveWeights returns the traffic weight currently in effect for a service, nil if there is none
+func (sDef *ServiceDefinition) ActiveWeights() *TrafficWeight {
+	if len(sDef.TrafficWeights) == 0 {
+		return nil
+	}
+	return &sDef.TrafficWeights[len(sDef.TrafficWeights)-1]
+}
+
+// ChooseVersion chooses a version based on the weights using the split strategy of the service
 // weight have the form of a slice of {version, weight} pairs
 // sum of weights is always 100
 // example: [{1, 50}, {2, 50}] means 50% of the traffic goes to version 1 and 50% to version 2
 // example: [{1, 10}, {2, 20}, {3, 70}] means 10% of the traffic goes to version 1, 20% to version 2 and 70% to version 3
 // example: [{1, 100}] means 100% of the traffic goes to version 1
 // example: [{1, 50}, {2, 50}, {3, 50}] is invalid because the sum of weights is 150
+// key identifies the client for the consistent_hash strategy, it may be empty
+// returns 0 if the service has no traffic weights yet
 // method needs to be concurrency safe
-func (sDef *ServiceDefinition) ChooseVersion() uint {
-	randLock.Lock()
-	r := rand.Intn(101)
-	randLock.Unlock()
+func (sDef *ServiceDefinition) ChooseVersion(key string) uint {
+	tw := sDef.ActiveWeights()
+	if tw == nil {
+		return 0
+	}
+	splitter := sDef.splitter
+	if splitter == nil {
+		splitter = defaultSplitter
+	}
+	return splitter.Split(tw, key)
+}
+
+// MatchVersionRule returns the version of the first version rule matching the request
+func (sDef *ServiceDefinition) MatchVersionRule(header http.Header, query url.Values) (uint, bool) {
+	for i := range sDef.VersionRules {
+		if sDef.VersionRules[i].matches(header, query) {
+			return sDef.VersionRules[i].ServiceVersionID, true
+		}
+	}
+	return 0, false
+}
 
-	// grab latest of traffic weights
-	tw := sDef.TrafficWeights[len(sDef.TrafficWeights)-1]
+// hasVersion reports whether version belongs to the service
+func (sDef *ServiceDefinition) hasVersion(version uint) bool {
+	for _, v := range sDef.Versions {
+		if v.ID == version {
+			return true
+		}
+	}
+	return false
+}
+
+// ChooseVersionForKey picks a version based on the weights by consistent hashing,
+// whatever the split strategy of the service is.
+// the same key always lands on the same version for as long as the weights don't change
+func (sDef *ServiceDefinition) ChooseVersionForKey(key string) uint {
+	tw := sDef.ActiveWeights()
+	if tw == nil {
+		return 0
+	}
+	return NewConsistentHashSplitter(sDef.Name, defaultSplitter).Split(tw, key)
+}
+
+// ChooseFallbackVersion picks another version of the active traffic weight by weight,
+// skipping the versions in exclude. returns 0 if there is none left
+func (sDef *ServiceDefinition) ChooseFallbackVersion(exclude map[uint]bool) uint {
+	tw := sDef.ActiveWeights()
+	if tw == nil {
+		return 0
+	}
+	remaining := &TrafficWeight{}
+	for _, w := range tw.Weights {
+		if w.Weight > 0 && !exclude[w.ServiceVersionID] {
+			remaining.Weights = append(remaining.Weights, w)
+		}
+	}
+	return defaultSplitter.Split(remaining, "")
+}
+
+// IsActiveVersion reports whether the current traffic weights still send traffic to version
+func (sDef *ServiceDefinition) IsActiveVersion(version uint) bool {
+	tw := sDef.ActiveWeights()
+	if tw == nil {
+		return false
+	}
 	for _, w := range tw.Weights {
-		r -= int(w.Weight)
-		if r <= 0 {
-			return w.ServiceVersionID
+		if w.ServiceVersionID == version {
+			return w.Weight > 0
 		}
 	}
-	return 0
+	return false
 }
 
 type ServiceDefinitionRepository interface {
@@ -98,6 +410,16 @@ type ServiceDefinitionRepository interface {
 	GetByName(name string) (*ServiceDefinition, error)
 	GetByHostName(hostName string) (*ServiceDefinition, error)
 	Create(service ServiceDefinition) error
+	// Update saves the settings of a service, versions, weights and rules are left alone
+	Update(service *ServiceDefinition) error
 	AddVersion(service *ServiceDefinition, version *ServiceVersion) error
 	AddTrafficWeight(service *ServiceDefinition, weight *TrafficWeight) error
+	AddRoutingRule(service *ServiceDefinition, rule *RoutingRule) error
+	DeleteRoutingRule(service *ServiceDefinition, ruleID uint) error
+	AddVersionRule(service *ServiceDefinition, rule *VersionRule) error
+	DeleteVersionRule(service *ServiceDefinition, ruleID uint) error
+	AddSchedule(service *ServiceDefinition, schedule *Schedule) error
+	DeleteSchedule(service *ServiceDefinition, scheduleID uint) error
+	AddAPIKey(service *ServiceDefinition, key *APIKey) error
+	DeleteAPIKey(service *ServiceDefinition, keyID uint) error
 }
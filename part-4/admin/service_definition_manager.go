@@ -3,39 +3,66 @@ package admin
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
-const HostNameTemplate = "app-%d.cless.cloud"
-
 type ServiceDefinitionManager struct {
-	repo  ServiceDefinitionRepository
-	hosts map[string]bool
-	mutex sync.Mutex
+	cfg    Config
+	repo   ServiceDefinitionRepository
+	hosts  map[string]bool
+	mutex  sync.Mutex
+	routes atomic.Pointer[RoutingTable]
+
+	onCachePurge []func(service string)
 }
 
-func SetOfAvailableHosts() map[string]bool {
+func SetOfAvailableHosts(hostNameTemplate string) map[string]bool {
 	hosts := make(map[string]bool)
 	for i := 0; i <= 100; i++ {
-		hosts[fmt.Sprintf(HostNameTemplate, i)] = true
+		hosts[fmt.Sprintf(hostNameTemplate, i)] = true
 	}
 	return hosts
 }
 
-func NewServiceDefinitionManager(repo ServiceDefinitionRepository) *ServiceDefinitionManager {
-	hosts := SetOfAvailableHosts()
+func NewServiceDefinitionManager(repo ServiceDefinitionRepository, cfg Config) *ServiceDefinitionManager {
+	hosts := SetOfAvailableHosts(cfg.HostNameTemplate)
 	sDefs, err := repo.GetAll()
 	if err != nil {
 		panic(err)
 	}
 	for _, sDef := range sDefs {
 		delete(hosts, sDef.Host)
+		for _, rule := range sDef.RoutingRules {
+			delete(hosts, rule.Host)
+		}
 	}
-	return &ServiceDefinitionManager{
+	m := &ServiceDefinitionManager{
+		cfg:   cfg,
 		repo:  repo,
 		hosts: hosts,
 		mutex: sync.Mutex{},
 	}
+	m.routes.Store(newRoutingTable(nil, sDefs))
+	return m
+}
+
+// Routes returns the current routing snapshot
+func (m *ServiceDefinitionManager) Routes() *RoutingTable {
+	return m.routes.Load()
+}
+
+// reloadRoutes swaps in a fresh routing snapshot after a change to the repository.
+// must be called with the mutex held so snapshots are built in order
+func (m *ServiceDefinitionManager) reloadRoutes() error {
+	sDefs, err := m.repo.GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to reload routing table: %w", err)
+	}
+	m.routes.Store(newRoutingTable(m.routes.Load(), sDefs))
+	return nil
 }
 
 func (m *ServiceDefinitionManager) RegisterServiceDefinition(
@@ -48,6 +75,10 @@ func (m *ServiceDefinitionManager) RegisterServiceDefinition(
 		Name: name,
 	}
 	if host != "" {
+		// the host of another service or of a routing rule would be taken over silently
+		if host == m.cfg.Host || m.Routes().Serves(host) {
+			return fmt.Errorf("%w: %s", ErrHostConflict, host)
+		}
 		service.Host = host
 	} else {
 		h, err := m.NewHostName()
@@ -62,7 +93,7 @@ func (m *ServiceDefinitionManager) RegisterServiceDefinition(
 	}
 
 	delete(m.hosts, service.Host)
-	return nil
+	return m.reloadRoutes()
 }
 
 // AddVersion adds a new version to a service definition
@@ -79,7 +110,7 @@ func (m *ServiceDefinitionManager) AddVersion(
 	if err != nil {
 		return err
 	}
-	return nil
+	return m.reloadRoutes()
 }
 
 // AddTrafficWeight adds a new traffic weight to a service definition
@@ -96,9 +127,331 @@ func (m *ServiceDefinitionManager) AddTrafficWeight(
 	if err != nil {
 		return err
 	}
+	return m.reloadRoutes()
+}
+
+// SetRedirectHTTPS turns redirecting plain http requests to https on or off for a service
+func (m *ServiceDefinitionManager) SetRedirectHTTPS(
+	service *ServiceDefinition,
+	redirect bool,
+) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	service.RedirectHTTPS = redirect
+	err := m.repo.Update(service)
+	if err != nil {
+		return err
+	}
+	return m.reloadRoutes()
+}
+
+// SetStickySession changes how clients are kept on a version of a service
+func (m *ServiceDefinitionManager) SetStickySession(
+	service *ServiceDefinition,
+	sticky StickySession,
+) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !sticky.isValid() {
+		return errors.New("invalid sticky session")
+	}
+	service.Sticky = sticky
+	err := m.repo.Update(service)
+	if err != nil {
+		return err
+	}
+	return m.reloadRoutes()
+}
+
+// SetSplitStrategy changes how a service splits traffic between its versions
+func (m *ServiceDefinitionManager) SetSplitStrategy(
+	service *ServiceDefinition,
+	strategy string,
+) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !isValidSplitStrategy(strategy) {
+		return fmt.Errorf("unknown split strategy %q", strategy)
+	}
+	service.SplitStrategy = strategy
+	err := m.repo.Update(service)
+	if err != nil {
+		return err
+	}
+	return m.reloadRoutes()
+}
+
+// SetRetryPolicy changes how the gateway retries failed requests to a service
+func (m *ServiceDefinitionManager) SetRetryPolicy(
+	service *ServiceDefinition,
+	policy RetryPolicy,
+) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !policy.isValid() {
+		return fmt.Errorf("invalid retry policy, at most %d attempts", MaxRetryAttempts)
+	}
+	service.Retry = policy
+	err := m.repo.Update(service)
+	if err != nil {
+		return err
+	}
+	return m.reloadRoutes()
+}
+
+// SetRateLimit changes the rate limit and concurrency quota of a service,
+// the zero RateLimit removes them
+func (m *ServiceDefinitionManager) SetRateLimit(
+	service *ServiceDefinition,
+	limit RateLimit,
+) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !limit.isValid() {
+		return errors.New("invalid rate limit")
+	}
+	service.RateLimit = limit
+	err := m.repo.Update(service)
+	if err != nil {
+		return err
+	}
+	return m.reloadRoutes()
+}
+
+// SetMirror changes which version gets a copy of the traffic of a service
+func (m *ServiceDefinitionManager) SetMirror(
+	service *ServiceDefinition,
+	mirror MirrorPolicy,
+) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !mirror.isValid() {
+		return errors.New("invalid mirror, percent must be between 0 and 100")
+	}
+	if mirror.Percent > 0 && !service.hasVersion(mirror.ServiceVersionID) {
+		return ErrVersionNotFound
+	}
+	service.Mirror = mirror
+	err := m.repo.Update(service)
+	if err != nil {
+		return err
+	}
+	return m.reloadRoutes()
+}
+
+// SetAuthPolicy changes how callers of a service are authenticated
+func (m *ServiceDefinitionManager) SetAuthPolicy(
+	service *ServiceDefinition,
+	policy AuthPolicy,
+) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if policy.Mode == AuthAPIKey && policy.APIKeyHeader == "" {
+		policy.APIKeyHeader = DefaultAPIKeyHeader
+	}
+	if !policy.isValid() {
+		return errors.New("invalid auth policy, jwt mode needs either a jwks_url or a jwks_file")
+	}
+	service.Auth = policy
+	err := m.repo.Update(service)
+	if err != nil {
+		return err
+	}
+	return m.reloadRoutes()
+}
+
+// CreateAPIKey creates a key to call a service with. the key itself is only returned here,
+// the service keeps its hash
+func (m *ServiceDefinitionManager) CreateAPIKey(
+	service *ServiceDefinition,
+	name string,
+) (string, *APIKey, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if name == "" {
+		return "", nil, errors.New("api key needs a name")
+	}
+	secret, err := newAPIKey()
+	if err != nil {
+		return "", nil, err
+	}
+	key := &APIKey{Name: name, Hash: HashAPIKey(secret)}
+	if err := m.repo.AddAPIKey(service, key); err != nil {
+		return "", nil, err
+	}
+	return secret, key, m.reloadRoutes()
+}
+
+func (m *ServiceDefinitionManager) DeleteAPIKey(
+	service *ServiceDefinition,
+	keyID uint,
+) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	err := m.repo.DeleteAPIKey(service, keyID)
+	if err != nil {
+		return err
+	}
+	return m.reloadRoutes()
+}
+
+// SetCachePolicy changes the response cache of a service, cached responses are dropped
+func (m *ServiceDefinitionManager) SetCachePolicy(
+	service *ServiceDefinition,
+	policy CachePolicy,
+) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !policy.isValid() {
+		return errors.New("invalid cache policy, max_bytes must be set when the cache is enabled")
+	}
+	service.Cache = policy
+	err := m.repo.Update(service)
+	if err != nil {
+		return err
+	}
+	if err := m.reloadRoutes(); err != nil {
+		return err
+	}
+	m.purgeCache(service.Name)
 	return nil
 }
 
+// OnCachePurge registers fn to be called with the name of a service whose cached responses
+// have to be dropped. fn must not call back into the manager
+func (m *ServiceDefinitionManager) OnCachePurge(fn func(service string)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.onCachePurge = append(m.onCachePurge, fn)
+}
+
+// PurgeCache drops the cached responses of a service
+func (m *ServiceDefinitionManager) PurgeCache(service *ServiceDefinition) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.purgeCache(service.Name)
+}
+
+func (m *ServiceDefinitionManager) purgeCache(name string) {
+	for _, fn := range m.onCachePurge {
+		fn(name)
+	}
+}
+
+// AddRoutingRule routes requests for rule.Host under rule.PathPrefix to a service.
+// a rule for the same host and prefix may only exist once
+func (m *ServiceDefinitionManager) AddRoutingRule(
+	service *ServiceDefinition,
+	rule *RoutingRule,
+) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	rule.PathPrefix = normalizePathPrefix(rule.PathPrefix)
+	if !rule.isValid() || rule.Host == m.cfg.Host {
+		return errors.New("invalid routing rule")
+	}
+	if m.Routes().hasRule(rule.Host, rule.PathPrefix) {
+		return fmt.Errorf("%w: %s%s", ErrRoutingRuleConflict, rule.Host, rule.PathPrefix)
+	}
+	// a rule would take over the traffic of the service owning the host
+	if owner, err := m.Routes().ServiceByHost(rule.Host); err == nil && owner.Name != service.Name {
+		return fmt.Errorf("%w: %s is the host of service %s", ErrRoutingRuleConflict, rule.Host, owner.Name)
+	}
+	err := m.repo.AddRoutingRule(service, rule)
+	if err != nil {
+		return err
+	}
+	// the next service must not get a host whose requests are routed by the rule
+	delete(m.hosts, rule.Host)
+	return m.reloadRoutes()
+}
+
+// DeleteRoutingRule removes a routing rule from a service
+func (m *ServiceDefinitionManager) DeleteRoutingRule(
+	service *ServiceDefinition,
+	ruleID uint,
+) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	err := m.repo.DeleteRoutingRule(service, ruleID)
+	if err != nil {
+		return err
+	}
+	return m.reloadRoutes()
+}
+
+// AddVersionRule adds a rule that forces matching requests to one of the service's versions
+func (m *ServiceDefinitionManager) AddVersionRule(
+	service *ServiceDefinition,
+	rule *VersionRule,
+) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !rule.isValid() {
+		return errors.New("invalid version rule")
+	}
+	if !service.hasVersion(rule.ServiceVersionID) {
+		return fmt.Errorf("%w: version %d for service %s", ErrVersionNotFound, rule.ServiceVersionID, service.Name)
+	}
+	err := m.repo.AddVersionRule(service, rule)
+	if err != nil {
+		return err
+	}
+	return m.reloadRoutes()
+}
+
+// DeleteVersionRule removes a version rule from a service
+func (m *ServiceDefinitionManager) DeleteVersionRule(
+	service *ServiceDefinition,
+	ruleID uint,
+) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	err := m.repo.DeleteVersionRule(service, ruleID)
+	if err != nil {
+		return err
+	}
+	return m.reloadRoutes()
+}
+
+// AddSchedule makes the service get invoked on a cron expression
+func (m *ServiceDefinitionManager) AddSchedule(
+	service *ServiceDefinition,
+	schedule *Schedule,
+) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	schedule.Method = strings.ToUpper(schedule.Method)
+	if schedule.Method == "" {
+		schedule.Method = http.MethodPost
+	}
+	if !schedule.isValid() {
+		return errors.New("invalid schedule, check the cron expression, time zone and path")
+	}
+	if schedule.ServiceVersionID != 0 && !service.hasVersion(schedule.ServiceVersionID) {
+		return fmt.Errorf("%w: version %d for service %s", ErrVersionNotFound, schedule.ServiceVersionID, service.Name)
+	}
+	err := m.repo.AddSchedule(service, schedule)
+	if err != nil {
+		return err
+	}
+	return m.reloadRoutes()
+}
+
+// DeleteSchedule removes a schedule from a service
+func (m *ServiceDefinitionManager) DeleteSchedule(
+	service *ServiceDefinition,
+	scheduleID uint,
+) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	err := m.repo.DeleteSchedule(service, scheduleID)
+	if err != nil {
+		return err
+	}
+	return m.reloadRoutes()
+}
+
 func (m *ServiceDefinitionManager) ListAllServiceDefinitions() ([]ServiceDefinition, error) {
 	return m.repo.GetAll()
 }
@@ -107,27 +460,29 @@ func (m *ServiceDefinitionManager) GetServiceDefinitionByName(name string) (*Ser
 	return m.repo.GetByName(name)
 }
 
+// GetServiceDefinitionByHost looks the host up in the routing snapshot,
+// the returned definition is shared and must not be modified
 func (m *ServiceDefinitionManager) GetServiceDefinitionByHost(hostname string) (*ServiceDefinition, error) {
-	return m.repo.GetByHostName(hostname)
+	return m.Routes().ServiceByHost(hostname)
 }
 
 func (m *ServiceDefinitionManager) GetExternalServiceDefinitionByHost(hostname string, version uint) (*ExternalServiceDefinition, error) {
-	sDef, err := m.repo.GetByHostName(hostname)
+	sDef, err := m.Routes().ServiceByHost(hostname)
 	if err != nil {
 		return nil, err
 	}
 
 	var sVersion *ServiceVersion
 
-	for _, v := range sDef.Versions {
-		if v.ID == version {
-			sVersion = &v
+	for i := range sDef.Versions {
+		if sDef.Versions[i].ID == version {
+			sVersion = &sDef.Versions[i]
 			break
 		}
 	}
 
 	if sVersion == nil {
-		return nil, fmt.Errorf("version %d not found for service %s and hostname %s", version, sDef.Name, hostname)
+		return nil, fmt.Errorf("%w: version %d for service %s and hostname %s", ErrVersionNotFound, version, sDef.Name, hostname)
 	}
 
 	return &ExternalServiceDefinition{
@@ -136,6 +491,20 @@ func (m *ServiceDefinitionManager) GetExternalServiceDefinitionByHost(hostname s
 	}, nil
 }
 
+// GetExternalServiceDefinition looks a version up by the name of its service
+func (m *ServiceDefinitionManager) GetExternalServiceDefinition(name string, version uint) (*ExternalServiceDefinition, error) {
+	sDef, err := m.repo.GetByName(name)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sDef.Versions {
+		if sDef.Versions[i].ID == version {
+			return &ExternalServiceDefinition{Sdef: sDef, Version: &sDef.Versions[i]}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: version %d for service %s", ErrVersionNotFound, version, name)
+}
+
 func (m *ServiceDefinitionManager) NewHostName() (*string, error) {
 	if len(m.hosts) == 0 {
 		return nil, errors.New("no more hosts available")
@@ -1,8 +1,11 @@
 package admin
 
 import (
+	"net/http"
+	"net/url"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -10,7 +13,7 @@ import (
 // TestRegisterServiceDefinition tests the RegisterServiceDefinition method
 func TestRegisterServiceDefinition(t *testing.T) {
 	repo := NewInMemoryServiceDefinitionRepository()
-	serviceDefinitionManager := NewServiceDefinitionManager(repo)
+	serviceDefinitionManager := NewServiceDefinitionManager(repo, DefaultConfig())
 	err := serviceDefinitionManager.RegisterServiceDefinition("test", "")
 	if err != nil {
 		t.Errorf("Failed to register service definition: %s", err)
@@ -27,7 +30,7 @@ func TestRegisterServiceDefinition(t *testing.T) {
 // TestRegisterServiceDefinitionWithHost tests the RegisterServiceDefinition method with a host
 func TestRegisterServiceDefinitionWithHost(t *testing.T) {
 	repo := NewInMemoryServiceDefinitionRepository()
-	serviceDefinitionManager := NewServiceDefinitionManager(repo)
+	serviceDefinitionManager := NewServiceDefinitionManager(repo, DefaultConfig())
 	err := serviceDefinitionManager.RegisterServiceDefinition("test", "test.cless.cloud")
 	if err != nil {
 		t.Errorf("Failed to register service definition: %s", err)
@@ -44,7 +47,7 @@ func TestRegisterServiceDefinitionWithHost(t *testing.T) {
 // TestListServiceDefinitions tests the ListServiceDefinitions method
 func TestListServiceDefinitions(t *testing.T) {
 	repo := NewInMemoryServiceDefinitionRepository()
-	serviceDefinitionManager := NewServiceDefinitionManager(repo)
+	serviceDefinitionManager := NewServiceDefinitionManager(repo, DefaultConfig())
 	err := serviceDefinitionManager.RegisterServiceDefinition("test", "")
 	if err != nil {
 		t.Errorf("Failed to register service definition: %s", err)
@@ -59,3 +62,77 @@ func TestListServiceDefinitions(t *testing.T) {
 	}
 	assert.Equal(t, 2, len(serviceDefinitions))
 }
+
+// TestVersionRules tests that version rules must target the service's own versions
+// and are matched by priority before anything else
+func TestVersionRules(t *testing.T) {
+	manager := NewServiceDefinitionManager(NewInMemoryServiceDefinitionRepository(), DefaultConfig())
+	assert.NoError(t, manager.RegisterServiceDefinition("test", "test.cless.cloud"))
+	assert.NoError(t, manager.RegisterServiceDefinition("other", "other.cless.cloud"))
+	sDef, _ := manager.GetServiceDefinitionByName("test")
+	other, _ := manager.GetServiceDefinitionByName("other")
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, manager.AddVersion(sDef, &ServiceVersion{ImageName: "test", ImageTag: "latest", Port: 8080}))
+	}
+	assert.NoError(t, manager.AddVersion(other, &ServiceVersion{ImageName: "other", ImageTag: "latest", Port: 8080}))
+	stable, canary := sDef.Versions[0].ID, sDef.Versions[1].ID
+
+	err := manager.AddVersionRule(sDef, &VersionRule{Header: "X-Beta-User", Value: "true", ServiceVersionID: other.Versions[0].ID})
+	assert.ErrorIs(t, err, ErrVersionNotFound)
+	err = manager.AddVersionRule(sDef, &VersionRule{Header: "X-Beta-User", Query: "beta", Value: "true", ServiceVersionID: canary})
+	assert.Error(t, err, "a rule looks at a header or a query parameter, not both")
+
+	assert.NoError(t, manager.AddVersionRule(sDef, &VersionRule{Priority: 2, Header: "X-Beta-User", Value: "true", ServiceVersionID: canary}))
+	assert.NoError(t, manager.AddVersionRule(sDef, &VersionRule{Priority: 1, Query: "variant", Value: "a", ServiceVersionID: stable}))
+
+	routed, _ := manager.GetServiceDefinitionByHost("test.cless.cloud")
+	header := http.Header{"X-Beta-User": []string{"true"}}
+
+	version, ok := routed.MatchVersionRule(header, url.Values{})
+	assert.True(t, ok)
+	assert.Equal(t, canary, version)
+
+	version, ok = routed.MatchVersionRule(header, url.Values{"variant": []string{"a"}})
+	assert.True(t, ok)
+	assert.Equal(t, stable, version, "the lower priority number wins")
+
+	_, ok = routed.MatchVersionRule(http.Header{}, url.Values{})
+	assert.False(t, ok)
+}
+
+// TestStopSettings tests the stop signal and grace period of a version and their defaults
+func TestStopSettings(t *testing.T) {
+	manager := NewServiceDefinitionManager(NewInMemoryServiceDefinitionRepository(), DefaultConfig())
+	assert.NoError(t, manager.RegisterServiceDefinition("test", "test.cless.cloud"))
+	sDef, _ := manager.GetServiceDefinitionByName("test")
+
+	assert.Error(t, manager.AddVersion(sDef, &ServiceVersion{ImageName: "test", ImageTag: "latest", Port: 8080, StopSignal: "SIGKILL"}))
+	assert.Error(t, manager.AddVersion(sDef, &ServiceVersion{ImageName: "test", ImageTag: "latest", Port: 8080, StopGracePeriodSeconds: -1}))
+
+	version := ServiceVersion{ImageName: "test", ImageTag: "latest", Port: 8080}
+	assert.Equal(t, DefaultStopSignal, version.GetStopSignal())
+	assert.Equal(t, DefaultStopGracePeriod, version.GetStopGracePeriod())
+
+	version = ServiceVersion{ImageName: "test", ImageTag: "latest", Port: 8080, StopSignal: "SIGQUIT", StopGracePeriodSeconds: 30}
+	assert.NoError(t, manager.AddVersion(sDef, &version))
+	assert.Equal(t, "SIGQUIT", version.GetStopSignal())
+	assert.Equal(t, 30*time.Second, version.GetStopGracePeriod())
+}
+
+// TestReplicaSettings tests the load balancing and autoscaling settings of a version
+func TestReplicaSettings(t *testing.T) {
+	manager := NewServiceDefinitionManager(NewInMemoryServiceDefinitionRepository(), DefaultConfig())
+	assert.NoError(t, manager.RegisterServiceDefinition("test", "test.cless.cloud"))
+	sDef, _ := manager.GetServiceDefinitionByName("test")
+
+	assert.Error(t, manager.AddVersion(sDef, &ServiceVersion{ImageName: "test", ImageTag: "latest", Port: 8080, LoadBalancing: "random"}))
+	assert.Error(t, manager.AddVersion(sDef, &ServiceVersion{ImageName: "test", ImageTag: "latest", Port: 8080, ConcurrencyTarget: -1}))
+	assert.NoError(t, manager.AddVersion(sDef, &ServiceVersion{ImageName: "test", ImageTag: "latest", Port: 8080, ConcurrencyTarget: 5, LoadBalancing: BalanceLeastOutstanding}))
+
+	version, err := manager.GetExternalServiceDefinition("test", sDef.Versions[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, BalanceLeastOutstanding, version.Version.GetLoadBalancing())
+	assert.Equal(t, DefaultMaxReplicas, version.Version.GetMaxReplicas())
+	_, err = manager.GetExternalServiceDefinition("test", sDef.Versions[0].ID+1)
+	assert.ErrorIs(t, err, ErrVersionNotFound)
+}
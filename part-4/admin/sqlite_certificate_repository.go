@@ -0,0 +1,45 @@
+package admin
+
+import (
+	"gorm.io/gorm"
+)
+
+type SqliteCertificateRepository struct {
+	db *gorm.DB
+}
+
+func NewSqliteCertificateRepository(db *gorm.DB) CertificateRepository {
+	db.AutoMigrate(&Certificate{})
+	return &SqliteCertificateRepository{db: db}
+}
+
+func (r *SqliteCertificateRepository) GetAll() ([]Certificate, error) {
+	var certs []Certificate
+	result := r.db.Find(&certs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return certs, nil
+}
+
+// Put deletes any certificate for the same host first so a new upload replaces the old certificate
+func (r *SqliteCertificateRepository) Put(cert *Certificate) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().Where("host = ?", cert.Host).Delete(&Certificate{})
+		if result.Error != nil {
+			return result.Error
+		}
+		return tx.Create(cert).Error
+	})
+}
+
+func (r *SqliteCertificateRepository) Delete(host string) error {
+	result := r.db.Unscoped().Where("host = ?", host).Delete(&Certificate{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrCertificateNotFound
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package admin
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type SqliteEventRepository struct {
+	db *gorm.DB
+}
+
+func NewSqliteEventRepository(db *gorm.DB) EventRepository {
+	db.AutoMigrate(&Event{})
+	db.AutoMigrate(&Subscription{})
+	db.AutoMigrate(&EventDelivery{})
+	return &SqliteEventRepository{db: db}
+}
+
+// Publish creates the event and its deliveries in one transaction,
+// so an event is never stored without the deliveries it needs
+func (r *SqliteEventRepository) Publish(event *Event) error {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(event).Error; err != nil {
+			return err
+		}
+		var subs []Subscription
+		if err := tx.Where("topic = ?", event.Topic).Find(&subs).Error; err != nil {
+			return err
+		}
+		if len(subs) == 0 {
+			return nil
+		}
+		deliveries := make([]EventDelivery, len(subs))
+		for i, sub := range subs {
+			deliveries[i] = EventDelivery{
+				EventID:        event.ID,
+				SubscriptionID: sub.ID,
+				Status:         DeliveryPending,
+				NextAttemptAt:  event.Time,
+			}
+		}
+		return tx.Omit("Event", "Subscription").Create(&deliveries).Error
+	})
+	if err == nil || !isDuplicate(r.db, err) {
+		return err
+	}
+	var existing Event
+	if err := r.db.Where("event_id = ?", event.EventID).First(&existing).Error; err != nil {
+		return err
+	}
+	*event = existing
+	return ErrEventExists
+}
+
+// isDuplicate reports whether err is a unique constraint violation
+func isDuplicate(db *gorm.DB, err error) bool {
+	if translator, ok := db.Dialector.(gorm.ErrorTranslator); ok {
+		err = translator.Translate(err)
+	}
+	return errors.Is(err, gorm.ErrDuplicatedKey)
+}
+
+func (r *SqliteEventRepository) CreateSubscription(sub *Subscription) error {
+	return r.db.Create(sub).Error
+}
+
+func (r *SqliteEventRepository) DeleteSubscription(id uint) error {
+	result := r.db.Delete(&Subscription{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+func (r *SqliteEventRepository) GetSubscriptions(topic string) ([]Subscription, error) {
+	var subs []Subscription
+	result := r.db.Where("topic = ?", topic).Find(&subs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return subs, nil
+}
+
+func (r *SqliteEventRepository) ClaimDue(now time.Time, limit int) ([]EventDelivery, error) {
+	var deliveries []EventDelivery
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Preload("Event").Preload("Subscription").
+			Where("status = ? AND next_attempt_at <= ?", DeliveryPending, now).
+			Order("next_attempt_at").
+			Limit(limit).
+			Find(&deliveries)
+		if result.Error != nil || len(deliveries) == 0 {
+			return result.Error
+		}
+		ids := make([]uint, len(deliveries))
+		for i := range deliveries {
+			ids[i] = deliveries[i].ID
+			deliveries[i].Status = DeliveryRunning
+		}
+		return tx.Model(&EventDelivery{}).Where("id IN ?", ids).Update("status", DeliveryRunning).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (r *SqliteEventRepository) UpdateDelivery(delivery *EventDelivery) error {
+	return r.db.Omit("Event", "Subscription").Save(delivery).Error
+}
+
+func (r *SqliteEventRepository) RequeueRunning() error {
+	return r.db.Model(&EventDelivery{}).
+		Where("status = ?", DeliveryRunning).
+		Update("status", DeliveryPending).Error
+}
+
+func (r *SqliteEventRepository) DeadLetters(subscriptionID uint) ([]EventDelivery, error) {
+	var deliveries []EventDelivery
+	result := r.db.Preload("Event").
+		Where("subscription_id = ? AND status = ?", subscriptionID, DeliveryDeadLetter).
+		Order("id").
+		Find(&deliveries)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return deliveries, nil
+}
+
+func (r *SqliteEventRepository) Redrive(subscriptionID uint) (int64, error) {
+	result := r.db.Model(&EventDelivery{}).
+		Where("subscription_id = ? AND status = ?", subscriptionID, DeliveryDeadLetter).
+		Updates(map[string]interface{}{
+			"status":          DeliveryPending,
+			"attempts":        0,
+			"next_attempt_at": time.Now(),
+		})
+	return result.RowsAffected, result.Error
+}
+
+// DeleteDelivered removes the rows for good, soft deleted events would still hold their ids
+func (r *SqliteEventRepository) DeleteDelivered(before time.Time) (int64, error) {
+	var deleted int64
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().
+			Where("status = ? AND delivered_at < ?", DeliveryDelivered, before).
+			Delete(&EventDelivery{})
+		if result.Error != nil {
+			return result.Error
+		}
+		deleted = result.RowsAffected
+		return tx.Unscoped().
+			Where("created_at < ? AND NOT EXISTS (SELECT 1 FROM event_deliveries WHERE event_deliveries.event_id = events.id)", before).
+			Delete(&Event{}).Error
+	})
+	return deleted, err
+}
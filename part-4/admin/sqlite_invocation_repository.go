@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type SqliteInvocationRepository struct {
+	db *gorm.DB
+}
+
+func NewSqliteInvocationRepository(db *gorm.DB) InvocationRepository {
+	db.AutoMigrate(&Invocation{})
+	return &SqliteInvocationRepository{db: db}
+}
+
+func (r *SqliteInvocationRepository) Create(inv *Invocation) error {
+	return r.db.Create(inv).Error
+}
+
+func (r *SqliteInvocationRepository) Get(invocationID string) (*Invocation, error) {
+	var inv Invocation
+	result := r.db.Where("invocation_id = ?", invocationID).First(&inv)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrInvocationNotFound
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &inv, nil
+}
+
+// ClaimDue selects and marks in one transaction so no invocation is handed out twice
+func (r *SqliteInvocationRepository) ClaimDue(now time.Time, limit int) ([]Invocation, error) {
+	var invs []Invocation
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("status = ? AND next_attempt_at <= ?", InvocationQueued, now).
+			Order("next_attempt_at").
+			Limit(limit).
+			Find(&invs)
+		if result.Error != nil || len(invs) == 0 {
+			return result.Error
+		}
+		ids := make([]uint, len(invs))
+		for i := range invs {
+			ids[i] = invs[i].ID
+			invs[i].Status = InvocationRunning
+		}
+		return tx.Model(&Invocation{}).Where("id IN ?", ids).Update("status", InvocationRunning).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return invs, nil
+}
+
+func (r *SqliteInvocationRepository) Update(inv *Invocation) error {
+	return r.db.Save(inv).Error
+}
+
+func (r *SqliteInvocationRepository) RequeueRunning() error {
+	return r.db.Model(&Invocation{}).
+		Where("status = ?", InvocationRunning).
+		Update("status", InvocationQueued).Error
+}
+
+// DeleteFinished removes the rows for good, a soft delete would keep the stored requests around
+func (r *SqliteInvocationRepository) DeleteFinished(before time.Time) (int64, error) {
+	result := r.db.Unscoped().
+		Where("status IN ? AND completed_at < ?", []string{InvocationCompleted, InvocationDeadLetter}, before).
+		Delete(&Invocation{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,42 @@
+package admin
+
+import (
+	"gorm.io/gorm"
+)
+
+type SqliteScheduleRunRepository struct {
+	db *gorm.DB
+}
+
+func NewSqliteScheduleRunRepository(db *gorm.DB) ScheduleRunRepository {
+	db.AutoMigrate(&ScheduleRun{})
+	return &SqliteScheduleRunRepository{db: db}
+}
+
+func (r *SqliteScheduleRunRepository) Create(run *ScheduleRun) error {
+	return r.db.Create(run).Error
+}
+
+func (r *SqliteScheduleRunRepository) Update(run *ScheduleRun) error {
+	return r.db.Save(run).Error
+}
+
+func (r *SqliteScheduleRunRepository) ListBySchedule(scheduleID uint, limit int) ([]ScheduleRun, error) {
+	var runs []ScheduleRun
+	result := r.db.Where("schedule_id = ?", scheduleID).Order("id desc").Limit(limit).Find(&runs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return runs, nil
+}
+
+func (r *SqliteScheduleRunRepository) Prune(scheduleID uint, keep int) error {
+	newest := r.db.Unscoped().Model(&ScheduleRun{}).
+		Select("id").
+		Where("schedule_id = ?", scheduleID).
+		Order("id desc").
+		Limit(keep)
+	return r.db.Unscoped().
+		Where("schedule_id = ? AND id NOT IN (?)", scheduleID, newest).
+		Delete(&ScheduleRun{}).Error
+}
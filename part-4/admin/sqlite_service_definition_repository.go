@@ -1,7 +1,10 @@
 package admin
 
 import (
+	"errors"
+
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // create type for the sqlite repository that will implement the ServiceDefinitionRepository interface
@@ -14,13 +17,17 @@ func NewSqliteServiceDefinitionRepository(db *gorm.DB) ServiceDefinitionReposito
 	db.AutoMigrate(&ServiceDefinition{})
 	db.AutoMigrate(&ServiceVersion{})
 	db.AutoMigrate(&TrafficWeight{})
+	db.AutoMigrate(&RoutingRule{})
+	db.AutoMigrate(&VersionRule{})
+	db.AutoMigrate(&Schedule{})
+	db.AutoMigrate(&APIKey{})
 	return &SqliteServiceDefinitionRepository{db: db}
 }
 
 // implement the GetAll method
 func (r *SqliteServiceDefinitionRepository) GetAll() ([]ServiceDefinition, error) {
 	var services []ServiceDefinition
-	result := r.db.Preload("Versions").Preload("TrafficWeights").Find(&services)
+	result := r.db.Preload("Versions").Preload("TrafficWeights").Preload("RoutingRules").Preload("VersionRules").Preload("Schedules").Preload("APIKeys").Find(&services)
 	if result.Error != nil {
 		return nil, result.Error
 	}
@@ -30,7 +37,10 @@ func (r *SqliteServiceDefinitionRepository) GetAll() ([]ServiceDefinition, error
 // implement the GetByName method
 func (r *SqliteServiceDefinitionRepository) GetByName(name string) (*ServiceDefinition, error) {
 	var service ServiceDefinition
-	result := r.db.Preload("Versions").Preload("TrafficWeights").First(&service, "name = ?", name)
+	result := r.db.Preload("Versions").Preload("TrafficWeights").Preload("RoutingRules").Preload("VersionRules").Preload("Schedules").Preload("APIKeys").First(&service, "name = ?", name)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrServiceNotFound
+	}
 	if result.Error != nil {
 		return nil, result.Error
 	}
@@ -40,7 +50,10 @@ func (r *SqliteServiceDefinitionRepository) GetByName(name string) (*ServiceDefi
 // implement the GetByHostName method
 func (r *SqliteServiceDefinitionRepository) GetByHostName(hostName string) (*ServiceDefinition, error) {
 	var service ServiceDefinition
-	result := r.db.Preload("Versions").Preload("TrafficWeights").First(&service, "host = ?", hostName)
+	result := r.db.Preload("Versions").Preload("TrafficWeights").Preload("RoutingRules").Preload("VersionRules").Preload("Schedules").Preload("APIKeys").First(&service, "host = ?", hostName)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrServiceNotFound
+	}
 	if result.Error != nil {
 		return nil, result.Error
 	}
@@ -56,6 +69,15 @@ func (r *SqliteServiceDefinitionRepository) Create(service ServiceDefinition) er
 	return nil
 }
 
+// implement the Update method
+func (r *SqliteServiceDefinitionRepository) Update(service *ServiceDefinition) error {
+	result := r.db.Omit(clause.Associations).Save(service)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
 // AddVersion create new version and add it to the service
 func (r *SqliteServiceDefinitionRepository) AddVersion(service *ServiceDefinition, version *ServiceVersion) error {
 	err := r.db.Model(service).Association("Versions").Append(version)
@@ -73,3 +95,87 @@ func (r *SqliteServiceDefinitionRepository) AddTrafficWeight(service *ServiceDef
 	}
 	return nil
 }
+
+// AddRoutingRule create new routing rule and add it to the service
+func (r *SqliteServiceDefinitionRepository) AddRoutingRule(service *ServiceDefinition, rule *RoutingRule) error {
+	err := r.db.Model(service).Association("RoutingRules").Append(rule)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteRoutingRule delete a routing rule of the service
+func (r *SqliteServiceDefinitionRepository) DeleteRoutingRule(service *ServiceDefinition, ruleID uint) error {
+	result := r.db.Where("service_definition_id = ?", service.ID).Delete(&RoutingRule{}, ruleID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRoutingRuleNotFound
+	}
+	return nil
+}
+
+// AddVersionRule create new version rule and add it to the service
+func (r *SqliteServiceDefinitionRepository) AddVersionRule(service *ServiceDefinition, rule *VersionRule) error {
+	err := r.db.Model(service).Association("VersionRules").Append(rule)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteVersionRule delete a version rule of the service
+func (r *SqliteServiceDefinitionRepository) DeleteVersionRule(service *ServiceDefinition, ruleID uint) error {
+	result := r.db.Where("service_definition_id = ?", service.ID).Delete(&VersionRule{}, ruleID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrVersionRuleNotFound
+	}
+	return nil
+}
+
+// AddSchedule create new schedule and add it to the service
+func (r *SqliteServiceDefinitionRepository) AddSchedule(service *ServiceDefinition, schedule *Schedule) error {
+	err := r.db.Model(service).Association("Schedules").Append(schedule)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteSchedule delete a schedule of the service
+func (r *SqliteServiceDefinitionRepository) DeleteSchedule(service *ServiceDefinition, scheduleID uint) error {
+	result := r.db.Where("service_definition_id = ?", service.ID).Delete(&Schedule{}, scheduleID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrScheduleNotFound
+	}
+	return nil
+}
+
+// AddAPIKey create new api key and add it to the service
+func (r *SqliteServiceDefinitionRepository) AddAPIKey(service *ServiceDefinition, key *APIKey) error {
+	err := r.db.Model(service).Association("APIKeys").Append(key)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteAPIKey delete an api key of the service
+func (r *SqliteServiceDefinitionRepository) DeleteAPIKey(service *ServiceDefinition, keyID uint) error {
+	result := r.db.Where("service_definition_id = ?", service.ID).Delete(&APIKey{}, keyID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
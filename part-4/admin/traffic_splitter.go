@@ -0,0 +1,163 @@
+package admin
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+)
+
+// traffic split strategies a service can choose from
+const (
+	SplitWeightedRandom = "weighted_random" // default, every request rolls the dice
+	SplitRoundRobin     = "round_robin"     // smooth weighted round robin, exact split over every 100 requests
+	SplitConsistentHash = "consistent_hash" // the same client key always lands on the same version
+)
+
+// TrafficSplitter picks a version out of a traffic weight.
+// key identifies the client for strategies that need one and may be empty.
+// implementations must be safe for concurrent use
+type TrafficSplitter interface {
+	Split(tw *TrafficWeight, key string) uint
+}
+
+// NewTrafficSplitter creates the splitter for strategy. salt varies how keys are hashed,
+// src feeds the strategies that need randomness
+func NewTrafficSplitter(strategy string, salt string, src rand.Source) (TrafficSplitter, error) {
+	switch strategy {
+	case "", SplitWeightedRandom:
+		return NewWeightedRandomSplitter(src), nil
+	case SplitRoundRobin:
+		return NewRoundRobinSplitter(), nil
+	case SplitConsistentHash:
+		return NewConsistentHashSplitter(salt, NewWeightedRandomSplitter(src)), nil
+	}
+	return nil, fmt.Errorf("unknown split strategy %q", strategy)
+}
+
+func isValidSplitStrategy(strategy string) bool {
+	_, err := NewTrafficSplitter(strategy, "", rand.NewSource(0))
+	return err == nil
+}
+
+// pickByPoint walks the weights until point, which must be in [0, sum of weights), is used up
+func pickByPoint(tw *TrafficWeight, point int) uint {
+	for _, w := range tw.Weights {
+		point -= int(w.Weight)
+		if point < 0 {
+			return w.ServiceVersionID
+		}
+	}
+	return 0
+}
+
+func totalWeight(tw *TrafficWeight) int {
+	total := 0
+	for _, w := range tw.Weights {
+		total += int(w.Weight)
+	}
+	return total
+}
+
+// WeightedRandomSplitter draws a uniform point over the weights for every request
+type WeightedRandomSplitter struct {
+	mutex sync.Mutex
+	rnd   *rand.Rand
+}
+
+func NewWeightedRandomSplitter(src rand.Source) *WeightedRandomSplitter {
+	return &WeightedRandomSplitter{rnd: rand.New(src)}
+}
+
+func (s *WeightedRandomSplitter) Split(tw *TrafficWeight, key string) uint {
+	total := totalWeight(tw)
+	if total == 0 {
+		return 0
+	}
+	s.mutex.Lock()
+	point := s.rnd.Intn(total)
+	s.mutex.Unlock()
+	return pickByPoint(tw, point)
+}
+
+// RoundRobinSplitter is nginx style smooth weighted round robin,
+// weights 50/30/20 give exactly 50/30/20 out of every 100 requests, interleaved
+type RoundRobinSplitter struct {
+	mutex   sync.Mutex
+	current map[uint]int
+}
+
+func NewRoundRobinSplitter() *RoundRobinSplitter {
+	return &RoundRobinSplitter{current: make(map[uint]int)}
+}
+
+func (s *RoundRobinSplitter) Split(tw *TrafficWeight, key string) uint {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// a version that left the weights restarts the rotation, otherwise it would stay
+	// in current forever and its leftover credit would skew the split when it comes back
+	if s.hasRemovedVersion(tw) {
+		s.current = make(map[uint]int)
+	}
+	total := 0
+	var best uint
+	for _, w := range tw.Weights {
+		if w.Weight == 0 {
+			continue
+		}
+		total += int(w.Weight)
+		s.current[w.ServiceVersionID] += int(w.Weight)
+		if best == 0 || s.current[w.ServiceVersionID] > s.current[best] {
+			best = w.ServiceVersionID
+		}
+	}
+	if best != 0 {
+		s.current[best] -= total
+	}
+	return best
+}
+
+// hasRemovedVersion reports whether current holds a version without weight in tw
+func (s *RoundRobinSplitter) hasRemovedVersion(tw *TrafficWeight) bool {
+	for version := range s.current {
+		weighted := false
+		for _, w := range tw.Weights {
+			if w.ServiceVersionID == version && w.Weight > 0 {
+				weighted = true
+				break
+			}
+		}
+		if !weighted {
+			return true
+		}
+	}
+	return false
+}
+
+// ConsistentHashSplitter hashes the key onto the weights so a client keeps its version
+// for as long as the weights don't change. keys are spread evenly over the weight points,
+// so the split holds across all clients. requests without a key go to fallback
+type ConsistentHashSplitter struct {
+	salt     string
+	fallback TrafficSplitter
+}
+
+// NewConsistentHashSplitter creates a splitter whose assignments depend on salt,
+// so different services spread the same clients differently
+func NewConsistentHashSplitter(salt string, fallback TrafficSplitter) *ConsistentHashSplitter {
+	return &ConsistentHashSplitter{salt: salt, fallback: fallback}
+}
+
+func (s *ConsistentHashSplitter) Split(tw *TrafficWeight, key string) uint {
+	if key == "" {
+		return s.fallback.Split(tw, key)
+	}
+	total := totalWeight(tw)
+	if total == 0 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(s.salt))
+	h.Write([]byte(key))
+	return pickByPoint(tw, int(h.Sum32()%uint32(total)))
+}
@@ -0,0 +1,134 @@
+package admin
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// chi-square critical values at p = 0.001 by degrees of freedom
+var chiSquareCritical = map[int]float64{1: 10.828, 2: 13.816, 3: 16.266, 4: 18.467}
+
+func testWeight(weights ...uint) *TrafficWeight {
+	tw := &TrafficWeight{}
+	for i, w := range weights {
+		tw.Weights = append(tw.Weights, Weight{ServiceVersionID: uint(i + 1), Weight: w})
+	}
+	return tw
+}
+
+// assertDistribution runs a chi-square goodness of fit test of the observed counts against the weights
+func assertDistribution(t *testing.T, tw *TrafficWeight, counts map[uint]int, draws int) {
+	t.Helper()
+	chiSquare := 0.0
+	categories := 0
+	for _, w := range tw.Weights {
+		if w.Weight == 0 {
+			assert.Zero(t, counts[w.ServiceVersionID], "version %d has no weight", w.ServiceVersionID)
+			continue
+		}
+		expected := float64(draws) * float64(w.Weight) / 100
+		diff := float64(counts[w.ServiceVersionID]) - expected
+		chiSquare += diff * diff / expected
+		categories++
+	}
+	if categories < 2 {
+		// everything went to the one weighted version
+		return
+	}
+	assert.Less(t, chiSquare, chiSquareCritical[categories-1], "counts %v don't match weights %v", counts, tw.Weights)
+}
+
+func TestWeightedRandomSplitterDistribution(t *testing.T) {
+	for _, tw := range []*TrafficWeight{testWeight(10, 30, 60), testWeight(50, 50), testWeight(1, 99), testWeight(0, 100), testWeight(25, 0, 75)} {
+		splitter := NewWeightedRandomSplitter(rand.NewSource(42))
+		counts := make(map[uint]int)
+		const draws = 100000
+		for i := 0; i < draws; i++ {
+			counts[splitter.Split(tw, "")]++
+		}
+		assertDistribution(t, tw, counts, draws)
+	}
+}
+
+// TestWeightedRandomSplitterIsDeterministic tests that the same seed gives the same sequence
+func TestWeightedRandomSplitterIsDeterministic(t *testing.T) {
+	tw := testWeight(10, 30, 60)
+	a := NewWeightedRandomSplitter(rand.NewSource(7))
+	b := NewWeightedRandomSplitter(rand.NewSource(7))
+	for i := 0; i < 1000; i++ {
+		assert.Equal(t, a.Split(tw, ""), b.Split(tw, ""))
+	}
+}
+
+// TestRoundRobinSplitterIsExact tests that every window of 100 requests matches the weights exactly
+// and that versions are interleaved instead of sent in bursts
+func TestRoundRobinSplitterIsExact(t *testing.T) {
+	tw := testWeight(50, 30, 20)
+	splitter := NewRoundRobinSplitter()
+	for round := 0; round < 5; round++ {
+		counts := make(map[uint]int)
+		longestRun, run := 0, 0
+		var previous uint
+		for i := 0; i < 100; i++ {
+			version := splitter.Split(tw, "")
+			counts[version]++
+			if version == previous {
+				run++
+			} else {
+				run = 1
+			}
+			if run > longestRun {
+				longestRun = run
+			}
+			previous = version
+		}
+		assert.Equal(t, map[uint]int{1: 50, 2: 30, 3: 20}, counts)
+		assert.LessOrEqual(t, longestRun, 2)
+	}
+}
+
+// TestRoundRobinSplitterForgetsRemovedVersions tests that versions dropped from the weights
+// don't pile up in the splitter and the remaining ones split exactly again
+func TestRoundRobinSplitterForgetsRemovedVersions(t *testing.T) {
+	splitter := NewRoundRobinSplitter()
+	for i := 0; i < 10; i++ {
+		splitter.Split(testWeight(50, 30, 20), "")
+	}
+	assert.Len(t, splitter.current, 3)
+
+	tw := testWeight(50, 50)
+	counts := make(map[uint]int)
+	for i := 0; i < 10; i++ {
+		counts[splitter.Split(tw, "")]++
+	}
+	assert.Len(t, splitter.current, 2)
+	assert.Equal(t, map[uint]int{1: 5, 2: 5}, counts)
+}
+
+// TestConsistentHashSplitterDistribution tests that keys are stable and spread by weight
+func TestConsistentHashSplitterDistribution(t *testing.T) {
+	tw := testWeight(10, 30, 60)
+	splitter := NewConsistentHashSplitter("svc", NewWeightedRandomSplitter(rand.NewSource(1)))
+	counts := make(map[uint]int)
+	const keys = 100000
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		version := splitter.Split(tw, key)
+		assert.Equal(t, version, splitter.Split(tw, key))
+		counts[version]++
+	}
+	assertDistribution(t, tw, counts, keys)
+}
+
+// TestNewTrafficSplitter tests that unknown strategies are rejected
+func TestNewTrafficSplitter(t *testing.T) {
+	for _, strategy := range []string{"", SplitWeightedRandom, SplitRoundRobin, SplitConsistentHash} {
+		_, err := NewTrafficSplitter(strategy, "svc", rand.NewSource(1))
+		assert.NoError(t, err, strategy)
+	}
+	_, err := NewTrafficSplitter("fastest", "svc", rand.NewSource(1))
+	assert.Error(t, err)
+}
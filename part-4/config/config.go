@@ -0,0 +1,312 @@
+// Package config loads the settings of cless. defaults are overridden by a YAML or TOML file,
+// the file by CLESS_* environment variables and those by flags
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"codereliant.io/cless/container"
+	"codereliant.io/cless/db"
+	"codereliant.io/cless/gateway"
+	"codereliant.io/cless/tracing"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// environment variables are named after flags, CLESS_ADMIN_PORT sets --admin-port
+const EnvPrefix = "CLESS_"
+
+// environment variable naming the config file when --config is not given
+const FileEnv = EnvPrefix + "CONFIG"
+
+// ServerConfig holds the settings of the public listeners
+type ServerConfig struct {
+	HTTPAddr   string `yaml:"http_addr" toml:"http_addr"`
+	HTTPSAddr  string `yaml:"https_addr" toml:"https_addr"`   // https is off if empty
+	InternalCA bool   `yaml:"internal_ca" toml:"internal_ca"` // mint certificates for hosts under CADomain from a local CA
+	CADomain   string `yaml:"ca_domain" toml:"ca_domain"`
+	// where the internal CA is kept, created on first start
+	CACertFile string `yaml:"ca_cert_file" toml:"ca_cert_file"`
+	CAKeyFile  string `yaml:"ca_key_file" toml:"ca_key_file"`
+	// how long shutdown waits for requests in flight
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+}
+
+func (cfg ServerConfig) Validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(cfg.HTTPAddr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid http address %q", cfg.HTTPAddr))
+	}
+	if cfg.HTTPSAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.HTTPSAddr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid https address %q", cfg.HTTPSAddr))
+		}
+	}
+	if cfg.InternalCA && (cfg.CACertFile == "" || cfg.CAKeyFile == "") {
+		errs = append(errs, errors.New("internal CA needs a cert and a key file"))
+	}
+	if cfg.InternalCA && strings.Trim(cfg.CADomain, ".") == "" {
+		errs = append(errs, errors.New("internal CA needs a domain"))
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("shutdown timeout must be positive, got %s", cfg.ShutdownTimeout))
+	}
+	return errors.Join(errs...)
+}
+
+// Config is everything cless can be told at startup
+type Config struct {
+	Debug      bool                    `yaml:"debug" toml:"debug"`
+	Server     ServerConfig            `yaml:"server" toml:"server"`
+	Admin      admin.Config            `yaml:"admin" toml:"admin"`
+	Gateway    gateway.Config          `yaml:"gateway" toml:"gateway"`
+	Transport  gateway.TransportConfig `yaml:"transport" toml:"transport"`
+	Async      gateway.AsyncConfig     `yaml:"async" toml:"async"`
+	Events     gateway.EventConfig     `yaml:"events" toml:"events"`
+	Scheduler  gateway.SchedulerConfig `yaml:"scheduler" toml:"scheduler"`
+	Containers container.Config        `yaml:"containers" toml:"containers"`
+	Database   db.Config               `yaml:"database" toml:"database"`
+	AccessLog  gateway.AccessLogConfig `yaml:"access_log" toml:"access_log"`
+	Tracing    tracing.Config          `yaml:"tracing" toml:"tracing"`
+}
+
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			HTTPAddr:        ":80",
+			CADomain:        "cless.cloud",
+			CACertFile:      "cless-ca.crt",
+			CAKeyFile:       "cless-ca.key",
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Admin:      admin.DefaultConfig(),
+		Gateway:    gateway.DefaultConfig(),
+		Transport:  gateway.DefaultTransportConfig(),
+		Async:      gateway.DefaultAsyncConfig(),
+		Events:     gateway.DefaultEventConfig(),
+		Scheduler:  gateway.DefaultSchedulerConfig(),
+		Containers: container.DefaultConfig(),
+		Database:   db.DefaultConfig(),
+		AccessLog:  gateway.DefaultAccessLogConfig(),
+		Tracing:    tracing.DefaultConfig(),
+	}
+}
+
+// Validate checks every section and reports all problems at once
+func (cfg Config) Validate() error {
+	sections := []struct {
+		name string
+		err  error
+	}{
+		{"server", cfg.Server.Validate()},
+		{"admin", cfg.Admin.Validate()},
+		{"gateway", cfg.Gateway.Validate()},
+		{"transport", cfg.Transport.Validate()},
+		{"async", cfg.Async.Validate()},
+		{"events", cfg.Events.Validate()},
+		{"scheduler", cfg.Scheduler.Validate()},
+		{"containers", cfg.Containers.Validate()},
+		{"database", cfg.Database.Validate()},
+		{"access_log", cfg.AccessLog.Validate()},
+		{"tracing", cfg.Tracing.Validate()},
+	}
+	var errs []error
+	for _, section := range sections {
+		if section.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", section.name, section.err))
+		}
+	}
+	if cfg.Admin.Port >= cfg.Containers.PortRangeStart && cfg.Admin.Port <= cfg.Containers.PortRangeEnd {
+		errs = append(errs, fmt.Errorf("admin: port %d lies in the container port range", cfg.Admin.Port))
+	}
+	return errors.Join(errs...)
+}
+
+// resolve fills in settings that follow from others
+func (cfg *Config) resolve() {
+	cfg.Gateway.AdminHost = cfg.Admin.Host
+	cfg.Gateway.AdminAddr = cfg.Admin.Addr()
+}
+
+// Options control loading instead of cless itself
+type Options struct {
+	File        string // config file, YAML or TOML by extension
+	PrintConfig bool   // print the resulting config and exit
+}
+
+// Load builds the config from args, which don't include the program name, and the environment.
+// flag.ErrHelp is returned when help was asked for
+func Load(args []string, lookupEnv func(string) (string, bool)) (Config, Options, error) {
+	// flags are parsed first to find the config file, and applied again
+	// after the file and the environment so they win over both
+	var opts Options
+	scratch := Default()
+	fs := newFlagSet(&scratch, &opts)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, opts, err
+	}
+	set := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+	if opts.File == "" {
+		opts.File, _ = lookupEnv(FileEnv)
+	}
+
+	cfg := Default()
+	if opts.File != "" {
+		if err := decodeFile(opts.File, &cfg); err != nil {
+			return Config{}, opts, err
+		}
+	}
+	var ignored Options
+	layers := newFlagSet(&cfg, &ignored)
+	var err error
+	layers.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		name := envName(f.Name)
+		if v, ok := lookupEnv(name); ok {
+			if setErr := f.Value.Set(v); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", v, name, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return Config{}, opts, err
+	}
+	for name, v := range set {
+		if err := layers.Set(name, v); err != nil {
+			return Config{}, opts, err
+		}
+	}
+
+	cfg.resolve()
+	if err := cfg.Validate(); err != nil {
+		return Config{}, opts, fmt.Errorf("invalid config:\n%w", err)
+	}
+	return cfg, opts, nil
+}
+
+// envName is the environment variable for a flag, admin-port becomes CLESS_ADMIN_PORT
+func envName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// decodeFile reads a YAML or TOML file into cfg, keys cfg doesn't have are an error
+func decodeFile(path string, cfg *Config) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(b), cfg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("%s: unknown setting %s", path, undecoded[0])
+		}
+	default:
+		return fmt.Errorf("%s: config files must end in .yaml, .yml or .toml", path)
+	}
+	return nil
+}
+
+// YAML renders cfg the way a config file would hold it
+func (cfg Config) YAML() ([]byte, error) {
+	return yaml.Marshal(cfg)
+}
+
+// newFlagSet binds a flag to every setting of cfg
+func newFlagSet(cfg *Config, opts *Options) *flag.FlagSet {
+	fs := flag.NewFlagSet("cless", flag.ContinueOnError)
+	fs.StringVar(&opts.File, "config", "", "YAML or TOML config file, "+FileEnv+" is used if empty")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the config after files, environment and flags are applied and exit")
+
+	fs.BoolVar(&cfg.Debug, "debug", cfg.Debug, "sets log level to debug")
+	fs.StringVar(&cfg.Server.HTTPAddr, "http-addr", cfg.Server.HTTPAddr, "address of the http listener")
+	fs.StringVar(&cfg.Server.HTTPSAddr, "https-addr", cfg.Server.HTTPSAddr, "address of the https listener, https is off if empty")
+	fs.BoolVar(&cfg.Server.InternalCA, "internal-ca", cfg.Server.InternalCA, "mint certificates for the hosts of services from a local CA")
+	fs.StringVar(&cfg.Server.CADomain, "ca-domain", cfg.Server.CADomain, "domain the internal CA mints certificates under")
+	fs.StringVar(&cfg.Server.CACertFile, "ca-cert-file", cfg.Server.CACertFile, "certificate of the internal CA")
+	fs.StringVar(&cfg.Server.CAKeyFile, "ca-key-file", cfg.Server.CAKeyFile, "private key of the internal CA")
+	fs.DurationVar(&cfg.Server.ShutdownTimeout, "shutdown-timeout", cfg.Server.ShutdownTimeout, "how long shutdown waits for requests in flight")
+
+	fs.StringVar(&cfg.Admin.Host, "admin-host", cfg.Admin.Host, "host name requests for the admin server are sent to")
+	fs.IntVar(&cfg.Admin.Port, "admin-port", cfg.Admin.Port, "port of the admin server")
+	fs.StringVar(&cfg.Admin.HostNameTemplate, "host-name-template", cfg.Admin.HostNameTemplate, "host names of services registered without one, %d is replaced by a number")
+
+	fs.DurationVar(&cfg.Gateway.ColdStartTimeout, "cold-start-timeout", cfg.Gateway.ColdStartTimeout, "how long a request waits on a cold start before it gets a 503")
+	fs.DurationVar(&cfg.Gateway.RetryAfter, "retry-after", cfg.Gateway.RetryAfter, "what clients are told to wait after a 503 during a cold start")
+
+	fs.IntVar(&cfg.Transport.MaxIdleConns, "transport-max-idle-conns", cfg.Transport.MaxIdleConns, "idle connections to containers kept open")
+	fs.IntVar(&cfg.Transport.MaxIdleConnsPerHost, "transport-max-idle-conns-per-host", cfg.Transport.MaxIdleConnsPerHost, "idle connections kept open to one container")
+	fs.DurationVar(&cfg.Transport.IdleConnTimeout, "transport-idle-conn-timeout", cfg.Transport.IdleConnTimeout, "idle connections to containers are closed after this long")
+	fs.DurationVar(&cfg.Transport.DialTimeout, "transport-dial-timeout", cfg.Transport.DialTimeout, "how long connecting to a container may take")
+	fs.DurationVar(&cfg.Transport.ResponseHeaderTimeout, "transport-response-header-timeout", cfg.Transport.ResponseHeaderTimeout, "how long a container may take to send the response headers")
+
+	fs.IntVar(&cfg.Async.Workers, "async-workers", cfg.Async.Workers, "async invocations delivered at the same time")
+	fs.IntVar(&cfg.Async.MaxAttempts, "async-max-attempts", cfg.Async.MaxAttempts, "attempts before an async invocation is dead lettered")
+	fs.DurationVar(&cfg.Async.Backoff, "async-backoff", cfg.Async.Backoff, "wait before the second attempt of an async invocation, doubled for every attempt after")
+	fs.DurationVar(&cfg.Async.MaxBackoff, "async-max-backoff", cfg.Async.MaxBackoff, "longest wait between attempts of an async invocation")
+	fs.DurationVar(&cfg.Async.AttemptTimeout, "async-attempt-timeout", cfg.Async.AttemptTimeout, "how long one attempt of an async invocation may take, cold start included")
+	fs.Int64Var(&cfg.Async.MaxBodyBytes, "async-max-body-bytes", cfg.Async.MaxBodyBytes, "larger async requests are turned away with 413")
+	fs.Int64Var(&cfg.Async.MaxResponseBytes, "async-max-response-bytes", cfg.Async.MaxResponseBytes, "stored responses of async invocations are cut off after this many bytes")
+	fs.DurationVar(&cfg.Async.PollInterval, "async-poll-interval", cfg.Async.PollInterval, "how often the queue is checked for retries that became due")
+	fs.DurationVar(&cfg.Async.Retention, "async-retention", cfg.Async.Retention, "how long completed and dead lettered async invocations are kept, 0 keeps them forever")
+
+	fs.IntVar(&cfg.Events.Workers, "events-workers", cfg.Events.Workers, "event deliveries made at the same time")
+	fs.IntVar(&cfg.Events.MaxAttempts, "events-max-attempts", cfg.Events.MaxAttempts, "attempts before an event delivery is dead lettered")
+	fs.DurationVar(&cfg.Events.Backoff, "events-backoff", cfg.Events.Backoff, "wait before the second attempt of an event delivery, doubled for every attempt after")
+	fs.DurationVar(&cfg.Events.MaxBackoff, "events-max-backoff", cfg.Events.MaxBackoff, "longest wait between attempts of an event delivery")
+	fs.DurationVar(&cfg.Events.AttemptTimeout, "events-attempt-timeout", cfg.Events.AttemptTimeout, "how long one attempt of an event delivery may take, cold start included")
+	fs.DurationVar(&cfg.Events.PollInterval, "events-poll-interval", cfg.Events.PollInterval, "how often deliveries are checked for retries that became due")
+	fs.DurationVar(&cfg.Events.Retention, "events-retention", cfg.Events.Retention, "how long delivered events are kept, 0 keeps them forever")
+
+	fs.DurationVar(&cfg.Scheduler.RunTimeout, "scheduler-run-timeout", cfg.Scheduler.RunTimeout, "how long a scheduled run may take, cold start included")
+	fs.IntVar(&cfg.Scheduler.KeepRuns, "scheduler-keep-runs", cfg.Scheduler.KeepRuns, "runs kept per schedule, 0 keeps them all")
+
+	fs.IntVar(&cfg.Containers.PortRangeStart, "port-range-start", cfg.Containers.PortRangeStart, "first host port handed out to containers")
+	fs.IntVar(&cfg.Containers.PortRangeEnd, "port-range-end", cfg.Containers.PortRangeEnd, "last host port handed out to containers")
+	fs.DurationVar(&cfg.Containers.IdleTimeout, "idle-timeout", cfg.Containers.IdleTimeout, "containers that served nothing for this long are removed")
+	fs.DurationVar(&cfg.Containers.GCInterval, "gc-interval", cfg.Containers.GCInterval, "how often idle containers are looked for")
+	fs.IntVar(&cfg.Containers.ReadinessAttempts, "readiness-attempts", cfg.Containers.ReadinessAttempts, "polls a started container gets to answer 200")
+	fs.DurationVar(&cfg.Containers.ReadinessInterval, "readiness-interval", cfg.Containers.ReadinessInterval, "time between readiness polls")
+	fs.DurationVar(&cfg.Containers.AutoscaleInterval, "autoscale-interval", cfg.Containers.AutoscaleInterval, "how often replica pools are sized to their load")
+
+	fs.StringVar(&cfg.Database.File, "db-file", cfg.Database.File, "path of the sqlite database")
+
+	fs.StringVar(&cfg.AccessLog.Output, "access-log", cfg.AccessLog.Output, "where access log entries go: stdout, file, both or off")
+	fs.StringVar(&cfg.AccessLog.File, "access-log-file", cfg.AccessLog.File, "path of the rotated access log file")
+	fs.StringVar(&cfg.AccessLog.Format, "access-log-format", cfg.AccessLog.Format, "access log format: json or clf")
+	fs.Float64Var(&cfg.AccessLog.SampleRate, "access-log-sample", cfg.AccessLog.SampleRate, "share of requests to log, server errors are always logged")
+	fs.IntVar(&cfg.AccessLog.MaxSizeMB, "access-log-max-size-mb", cfg.AccessLog.MaxSizeMB, "size at which the access log file is rotated")
+	fs.IntVar(&cfg.AccessLog.MaxBackups, "access-log-max-backups", cfg.AccessLog.MaxBackups, "rotated access log files to keep")
+	fs.IntVar(&cfg.AccessLog.MaxAgeDays, "access-log-max-age-days", cfg.AccessLog.MaxAgeDays, "days to keep rotated access log files")
+
+	fs.StringVar(&cfg.Tracing.Exporter, "tracing", cfg.Tracing.Exporter, "where spans are exported: none, otlp, stdout or file")
+	fs.StringVar(&cfg.Tracing.Endpoint, "tracing-endpoint", cfg.Tracing.Endpoint, "host:port of the OTLP http collector, OTEL_EXPORTER_OTLP_ENDPOINT applies if empty")
+	fs.BoolVar(&cfg.Tracing.Insecure, "tracing-insecure", cfg.Tracing.Insecure, "send spans to the collector over plain http")
+	fs.StringVar(&cfg.Tracing.File, "tracing-file", cfg.Tracing.File, "file the file exporter appends spans to")
+	fs.Float64Var(&cfg.Tracing.SampleRatio, "tracing-sample-ratio", cfg.Tracing.SampleRatio, "share of new traces that are recorded")
+	return fs
+}
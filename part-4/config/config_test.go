@@ -0,0 +1,119 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+// TestLayers tests that the file overrides defaults, the environment the file and flags the environment
+func TestLayers(t *testing.T) {
+	file := writeFile(t, "cless.yaml", `
+admin:
+  port: 2000
+  host: admin.example.com
+containers:
+  idle_timeout: 5m
+  readiness_attempts: 10
+`)
+	cfg, opts, err := Load(
+		[]string{"--config", file, "--idle-timeout", "4m", "--debug"},
+		env(map[string]string{"CLESS_IDLE_TIMEOUT": "3m", "CLESS_ADMIN_PORT": "2001"}),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, file, opts.File)
+	assert.True(t, cfg.Debug)
+	assert.Equal(t, "admin.example.com", cfg.Admin.Host)
+	assert.Equal(t, 2001, cfg.Admin.Port)
+	assert.Equal(t, 4*time.Minute, cfg.Containers.IdleTimeout)
+	assert.Equal(t, 10, cfg.Containers.ReadinessAttempts)
+	assert.Equal(t, 70*time.Second, cfg.Containers.GCInterval)
+	// the gateway learns where the admin server is
+	assert.Equal(t, "admin.example.com", cfg.Gateway.AdminHost)
+	assert.Equal(t, "localhost:2001", cfg.Gateway.AdminAddr)
+}
+
+func TestTOMLFileFromEnvironment(t *testing.T) {
+	file := writeFile(t, "cless.toml", `
+[server]
+http_addr = ":8080"
+
+[database]
+file = "/var/lib/cless/cless.sqlite3"
+`)
+	cfg, _, err := Load(nil, env(map[string]string{FileEnv: file}))
+	assert.NoError(t, err)
+	assert.Equal(t, ":8080", cfg.Server.HTTPAddr)
+	assert.Equal(t, "/var/lib/cless/cless.sqlite3", cfg.Database.File)
+}
+
+func TestDefaultsAreValid(t *testing.T) {
+	cfg, opts, err := Load(nil, env(nil))
+	assert.NoError(t, err)
+	assert.False(t, opts.PrintConfig)
+	assert.Equal(t, ":80", cfg.Server.HTTPAddr)
+	assert.Equal(t, 8000, cfg.Containers.PortRangeStart)
+	assert.Equal(t, 8999, cfg.Containers.PortRangeEnd)
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+	}{
+		{"unknown yaml key", []string{"--config", writeFile(t, "c.yaml", "admin:\n  prot: 1\n")}, nil},
+		{"unknown toml key", []string{"--config", writeFile(t, "c.toml", "[admin]\nprot = 1\n")}, nil},
+		{"unknown extension", []string{"--config", writeFile(t, "c.json", "{}")}, nil},
+		{"bad env value", nil, map[string]string{"CLESS_ADMIN_PORT": "many"}},
+		{"bad flag", []string{"--readiness-attempts", "0"}, nil},
+		{"reversed port range", []string{"--port-range-start", "9000", "--port-range-end", "8000"}, nil},
+		{"admin port in container range", []string{"--admin-port", "8080"}, nil},
+		{"host name template", []string{"--host-name-template", "app.cless.cloud"}, nil},
+		{"access log output", nil, map[string]string{"CLESS_ACCESS_LOG": "syslog"}},
+		{"tracing exporter", []string{"--tracing", "zipkin"}, nil},
+		{"async backoff", []string{"--async-backoff", "1m", "--async-max-backoff", "10s"}, nil},
+		{"events workers", nil, map[string]string{"CLESS_EVENTS_WORKERS": "0"}},
+		{"transport dial timeout", []string{"--config", writeFile(t, "c.toml", "[transport]\ndial_timeout = \"0s\"\n")}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := Load(tt.args, env(tt.env))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestHelp(t *testing.T) {
+	_, _, err := Load([]string{"-h"}, env(nil))
+	assert.ErrorIs(t, err, flag.ErrHelp)
+}
+
+// TestPrintedConfigLoadsBack tests that the output of --print-config is a valid config file
+func TestPrintedConfigLoadsBack(t *testing.T) {
+	cfg, opts, err := Load([]string{"--print-config", "--gc-interval", "30s"}, env(nil))
+	assert.NoError(t, err)
+	assert.True(t, opts.PrintConfig)
+	b, err := cfg.YAML()
+	assert.NoError(t, err)
+	loaded, _, err := Load([]string{"--config", writeFile(t, "printed.yaml", string(b))}, env(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, cfg, loaded)
+}
@@ -1,22 +1,115 @@
 package container
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync/atomic"
 	"time"
 )
 
+// ErrContainerStarting is returned when the caller gave up waiting on a cold start
+// that is still in progress, the same request is likely to succeed later
+var ErrContainerStarting = errors.New("container is starting")
+
+// ErrNoPortAvailable is returned when every port of the range is assigned to a container
+var ErrNoPortAvailable = errors.New("no port available for the container")
+
+// ErrShuttingDown is returned for requests that need a new container after shutdown began
+var ErrShuttingDown = errors.New("container manager is shutting down")
+
+// ErrContainerNotReady is returned when a started container never passed its readiness check
+var ErrContainerNotReady = errors.New("container not ready")
+
 type RunningService struct {
+	Service          string    // name of the service the container runs
+	Version          uint      // id of the service version the container runs
 	ContainerID      string    // docker container ID
 	AssignedPort     int       // port assigned to the container
 	Ready            bool      // whether the container is ready to serve requests
 	LastTimeAccessed time.Time // last time the container was accessed
+	// sent once the requests in flight are done, SIGKILL follows if the container
+	// is still running StopGracePeriod later
+	StopSignal      string
+	StopGracePeriod time.Duration
+
+	activeRequests atomic.Int64 // requests being proxied right now, including open streams and websockets
+	lastRequestEnd atomic.Int64 // unix nanos of the last finished request
 }
 
 func (rSvc *RunningService) GetHost() string {
 	return fmt.Sprintf("localhost:%d", rSvc.AssignedPort)
 }
 
+// BeginRequest marks a request to the container as in flight until EndRequest is called.
+// an upgraded websocket or a streamed response stays in flight as long as it is open.
+// the container manager calls it while handing the container out
+func (rSvc *RunningService) BeginRequest() {
+	rSvc.activeRequests.Add(1)
+}
+
+func (rSvc *RunningService) EndRequest() {
+	rSvc.lastRequestEnd.Store(time.Now().UnixNano())
+	rSvc.activeRequests.Add(-1)
+}
+
+func (rSvc *RunningService) ActiveRequests() int64 {
+	return rSvc.activeRequests.Load()
+}
+
+// how often drain checks for requests in flight
+const drainPollInterval = 50 * time.Millisecond
+
+// drain waits until rSvc has no requests in flight, at most timeout.
+// it reports whether all of them finished
+func (rSvc *RunningService) drain(ctx context.Context, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for rSvc.ActiveRequests() > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// isIdle reports whether the container served nothing for longer than timeout,
+// a container with requests in flight is never idle. caller must hold the manager mutex
+func (rSvc *RunningService) isIdle(timeout time.Duration) bool {
+	if rSvc.ActiveRequests() > 0 {
+		return false
+	}
+	lastActive := rSvc.LastTimeAccessed
+	if end := time.Unix(0, rSvc.lastRequestEnd.Load()); end.After(lastActive) {
+		lastActive = end
+	}
+	return time.Since(lastActive) > timeout
+}
+
+type coldStartKey struct{}
+
+// WithColdStartReport returns a context through which GetRunningServiceForHost sets coldStart
+// when the call had to wait for a container to start. the flag must only be read after the call returned
+func WithColdStartReport(ctx context.Context, coldStart *bool) context.Context {
+	return context.WithValue(ctx, coldStartKey{}, coldStart)
+}
+
+func reportColdStart(ctx context.Context) {
+	if coldStart, ok := ctx.Value(coldStartKey{}).(*bool); ok {
+		*coldStart = true
+	}
+}
+
 type ContainerManager interface {
-	GetRunningServiceForHost(host string, version uint) (*string, error)
-	StopAndRemoveAllContainers() []error
+	// GetRunningServiceForHost hands out a container with the request already in flight on it,
+	// callers must call EndRequest on it once they are done
+	GetRunningServiceForHost(ctx context.Context, host string, version uint) (*RunningService, error)
+	// StopAndRemoveAllContainers drains and stops all containers, killing those still running when ctx is done
+	StopAndRemoveAllContainers(ctx context.Context) []error
+	// OnContainerRemoved registers fn to be called after a container was removed
+	OnContainerRemoved(fn func(rSvc *RunningService))
 }
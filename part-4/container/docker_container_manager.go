@@ -2,118 +2,588 @@ package container
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
 	"codereliant.io/cless/admin"
+	"codereliant.io/cless/metrics"
+	"codereliant.io/cless/tracing"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
 	"github.com/rs/zerolog/log"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Config holds the settings of the docker container manager
+type Config struct {
+	// host ports handed out to containers, both ends included
+	PortRangeStart int `yaml:"port_range_start" toml:"port_range_start"`
+	PortRangeEnd   int `yaml:"port_range_end" toml:"port_range_end"`
+	// containers that served nothing for IdleTimeout are removed, checked every GCInterval
+	IdleTimeout time.Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	GCInterval  time.Duration `yaml:"gc_interval" toml:"gc_interval"`
+	// a started container must answer 200 within ReadinessAttempts polls, ReadinessInterval apart
+	ReadinessAttempts int           `yaml:"readiness_attempts" toml:"readiness_attempts"`
+	ReadinessInterval time.Duration `yaml:"readiness_interval" toml:"readiness_interval"`
+	// every AutoscaleInterval replica pools are sized to the peak load of the interval
+	AutoscaleInterval time.Duration `yaml:"autoscale_interval" toml:"autoscale_interval"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		PortRangeStart:    8000,
+		PortRangeEnd:      8999,
+		IdleTimeout:       2 * time.Minute,
+		GCInterval:        70 * time.Second,
+		ReadinessAttempts: 30,
+		ReadinessInterval: time.Second,
+		AutoscaleInterval: 30 * time.Second,
+	}
+}
+
+func (cfg Config) Validate() error {
+	var errs []error
+	if cfg.PortRangeStart < 1024 || cfg.PortRangeEnd > 65535 || cfg.PortRangeStart > cfg.PortRangeEnd {
+		errs = append(errs, fmt.Errorf("port range must lie within 1024-65535, got %d-%d", cfg.PortRangeStart, cfg.PortRangeEnd))
+	}
+	if cfg.IdleTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("idle timeout must be positive, got %s", cfg.IdleTimeout))
+	}
+	if cfg.GCInterval <= 0 {
+		errs = append(errs, fmt.Errorf("gc interval must be positive, got %s", cfg.GCInterval))
+	}
+	if cfg.ReadinessAttempts < 1 {
+		errs = append(errs, fmt.Errorf("readiness attempts must be at least 1, got %d", cfg.ReadinessAttempts))
+	}
+	if cfg.ReadinessInterval <= 0 {
+		errs = append(errs, fmt.Errorf("readiness interval must be positive, got %s", cfg.ReadinessInterval))
+	}
+	if cfg.AutoscaleInterval <= 0 {
+		errs = append(errs, fmt.Errorf("autoscale interval must be positive, got %s", cfg.AutoscaleInterval))
+	}
+	return errors.Join(errs...)
+}
+
+// portRangeSize is the number of ports in the range
+func (cfg Config) portRangeSize() int {
+	return cfg.PortRangeEnd - cfg.PortRangeStart + 1
+}
+
 type DockerContainerManager struct {
+	cfg          Config
 	mutex        *sync.Mutex
-	containers   map[string]*RunningService
+	pools        map[string]*replicaPool // by service key
+	closing      bool                    // set once StopAndRemoveAllContainers began, no replicas start anymore
+	leftovers    []*RunningService       // containers of startups that finished while closing
 	usedPorts    map[int]bool
 	sDefManager  *admin.ServiceDefinitionManager
-	dockerClient *client.Client
+	dockerClient client.ContainerAPIClient
+	onRemoved    []func(rSvc *RunningService)
+}
+
+// startup is a replica of a pool being started. requests arriving while
+// the pool has no ready replica wait on done instead of starting their
+// own container, requests for other keys are not affected
+type startup struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	rSvc   *RunningService
+	err    error
 }
 
-func NewDockerContainerManager(manager *admin.ServiceDefinitionManager) (ContainerManager, error) {
+func NewDockerContainerManager(manager *admin.ServiceDefinitionManager, cfg Config) (*DockerContainerManager, error) {
 	cli, err := client.NewClientWithOpts(client.FromEnv)
 	if err != nil {
 		return nil, err
 	}
-	mgr := &DockerContainerManager{
+	mgr := newDockerContainerManager(manager, cli, cfg)
+
+	go mgr.garbageCollectIdleContainers()
+	go mgr.autoscaleLoop()
+
+	return mgr, nil
+}
+
+func newDockerContainerManager(manager *admin.ServiceDefinitionManager, cli client.ContainerAPIClient, cfg Config) *DockerContainerManager {
+	metrics.ContainerPortPoolSize.Set(float64(cfg.portRangeSize()))
+	return &DockerContainerManager{
+		cfg:          cfg,
 		mutex:        &sync.Mutex{},
-		containers:   make(map[string]*RunningService),
+		pools:        make(map[string]*replicaPool),
 		usedPorts:    make(map[int]bool),
 		sDefManager:  manager,
 		dockerClient: cli,
 	}
-
-	go mgr.garbageCollectIdleContainers()
-
-	return mgr, nil
 }
 
-func (cm *DockerContainerManager) GetRunningServiceForHost(host string, version uint) (*string, error) {
+// GetRunningServiceForHost returns a ready replica of version for host, starting one if needed.
+// the request counts as in flight on the replica from here on, the caller must call EndRequest.
+// a replica is added in the background when the version is busier than its concurrency target. if ctx is done before the startup finishes, ErrContainerStarting
+// is returned and the startup carries on in the background
+func (cm *DockerContainerManager) GetRunningServiceForHost(ctx context.Context, host string, version uint) (_ *RunningService, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "container.get_running_service", trace.WithAttributes(
+		tracing.AttrHost.String(host),
+		tracing.AttrVersion.Int64(int64(version)),
+	))
+	defer func() { tracing.End(span, err) }()
+
 	log.Debug().Str("host", host).Msg("getting container")
+	_, lookupSpan := tracing.Tracer().Start(ctx, "admin.get_service_definition")
 	sExternalDef, err := cm.sDefManager.GetExternalServiceDefinitionByHost(host, version)
+	tracing.End(lookupSpan, err)
 	log.Debug().Str("service definition", host).Msg("got service definition")
 	if err != nil {
 		return nil, err
 	}
+	key := sExternalDef.GetKey()
+	span.SetAttributes(tracing.AttrService.String(sExternalDef.Sdef.Name))
+
+	// startups outlive ctx when the caller gives up, they only keep the trace
+	startupCtx := trace.ContextWithSpanContext(context.Background(), span.SpanContext())
+	cm.mutex.Lock()
+	pool := cm.pool(sExternalDef)
+	if rSvc := pool.pick(); rSvc != nil {
+		rSvc.LastTimeAccessed = time.Now()
+		if pool.observe() {
+			log.Info().Str("svc key", key).Int("replicas", pool.size()+1).Msg("Adding replica")
+			cm.startReplica(startupCtx, key, pool)
+		}
+		cm.mutex.Unlock()
+		span.SetAttributes(tracing.AttrContainerID.String(rSvc.ContainerID), tracing.AttrColdStart.Bool(false))
+		return rSvc, nil
+	}
+	var s *startup
+	if len(pool.startups) > 0 {
+		s = pool.startups[0]
+	} else {
+		s = cm.startReplica(startupCtx, key, pool)
+	}
+	cm.mutex.Unlock()
+	reportColdStart(ctx)
+	span.SetAttributes(tracing.AttrColdStart.Bool(true))
+
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: %s", ErrContainerStarting, sExternalDef.Sdef.Name)
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	// the new replica may have been retired since, then another one takes the request
+	cm.mutex.Lock()
+	rSvc := s.rSvc
+	if pool.has(rSvc) {
+		rSvc.BeginRequest()
+	} else {
+		rSvc = pool.pick()
+	}
+	cm.mutex.Unlock()
+	if rSvc == nil {
+		return nil, fmt.Errorf("%w: %s", ErrContainerStarting, sExternalDef.Sdef.Name)
+	}
+	span.SetAttributes(tracing.AttrContainerID.String(rSvc.ContainerID))
+	return rSvc, nil
+}
+
+func (cm *DockerContainerManager) OnContainerRemoved(fn func(rSvc *RunningService)) {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
-	rSvc, exists := cm.containers[sExternalDef.GetKey()]
+	cm.onRemoved = append(cm.onRemoved, fn)
+}
+
+// notifyRemoved must be called without holding the mutex
+func (cm *DockerContainerManager) notifyRemoved(removed []*RunningService) {
+	cm.mutex.Lock()
+	listeners := cm.onRemoved
+	cm.mutex.Unlock()
+	for _, rSvc := range removed {
+		for _, fn := range listeners {
+			fn(rSvc)
+		}
+	}
+}
+
+// pool returns the replica pool of a version, creating an empty one the first time.
+// must be called with the mutex held
+func (cm *DockerContainerManager) pool(sExternalDef *admin.ExternalServiceDefinition) *replicaPool {
+	pool, exists := cm.pools[sExternalDef.GetKey()]
 	if !exists {
-		rSvc, err = cm.startContainer(sExternalDef)
+		pool = newReplicaPool(sExternalDef)
+		cm.pools[sExternalDef.GetKey()] = pool
+	}
+	pool.sExternalDef = sExternalDef
+	return pool
+}
+
+// deletePool must be called with the mutex held
+func (cm *DockerContainerManager) deletePool(key string) {
+	if pool, exists := cm.pools[key]; exists {
+		metrics.ContainerReplicas.DeleteLabelValues(pool.sExternalDef.Sdef.Name, strconv.FormatUint(uint64(pool.sExternalDef.Version.ID), 10))
+		delete(cm.pools, key)
+	}
+}
+
+// startReplica adds a replica to pool in the background.
+// must be called with the mutex held
+func (cm *DockerContainerManager) startReplica(ctx context.Context, key string, pool *replicaPool) *startup {
+	s := &startup{done: make(chan struct{})}
+	if cm.closing {
+		s.err = ErrShuttingDown
+		close(s.done)
+		return s
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	pool.startups = append(pool.startups, s)
+	go cm.runStartup(ctx, key, pool, s)
+	return s
+}
+
+// runStartup brings up a replica of pool and wakes up everyone waiting on s.
+// the manager mutex is only held for bookkeeping, never while talking to docker
+// or polling for readiness
+func (cm *DockerContainerManager) runStartup(ctx context.Context, key string, pool *replicaPool, s *startup) {
+	cm.mutex.Lock()
+	sExternalDef := pool.sExternalDef
+	// a container that failed its readiness check before gets another chance
+	var rSvc *RunningService
+	if n := len(pool.unready); n > 0 {
+		rSvc = pool.unready[n-1]
+		pool.unready = pool.unready[:n-1]
+	}
+	cm.mutex.Unlock()
+
+	ctx, span := tracing.Tracer().Start(ctx, "container.startup", trace.WithAttributes(
+		tracing.AttrService.String(sExternalDef.Sdef.Name),
+		tracing.AttrVersion.Int64(int64(sExternalDef.Version.ID)),
+	))
+	defer func() {
+		s.cancel()
+		tracing.End(span, s.err)
+		if s.err != nil {
+			log.Error().Err(s.err).Str("svc key", key).Msg("Failed to start replica")
+		}
+		cm.mutex.Lock()
+		pool.removeStartup(s)
+		switch {
+		case cm.closing && rSvc != nil:
+			// the pool is gone, shutdown stops the container
+			cm.leftovers = append(cm.leftovers, rSvc)
+		case s.rSvc != nil:
+			pool.ready = append(pool.ready, s.rSvc)
+		case rSvc != nil:
+			pool.unready = append(pool.unready, rSvc)
+		}
+		cm.updateGauges()
+		cm.mutex.Unlock()
+		close(s.done)
+	}()
+
+	if rSvc == nil {
+		var err error
+		rSvc, err = cm.startContainer(ctx, sExternalDef)
 		if err != nil {
-			return nil, err
+			metrics.ContainerColdStarts.WithLabelValues(sExternalDef.Sdef.Name, "failed").Inc()
+			s.err = err
+			return
 		}
 	}
-	rSvc.LastTimeAccessed = time.Now()
 
-	if !cm.isContainerReady(rSvc) {
-		return nil, fmt.Errorf("container %s not ready", sExternalDef.Sdef.Name)
+	span.SetAttributes(tracing.AttrContainerID.String(rSvc.ContainerID))
+	if !cm.isContainerReady(ctx, rSvc) {
+		metrics.ContainerColdStarts.WithLabelValues(sExternalDef.Sdef.Name, "failed").Inc()
+		s.err = fmt.Errorf("%w: %s", ErrContainerNotReady, sExternalDef.Sdef.Name)
+		return
 	}
-	svcLocalHost := rSvc.GetHost()
-	return &svcLocalHost, nil
+	metrics.ContainerColdStarts.WithLabelValues(sExternalDef.Sdef.Name, "ready").Inc()
+
+	cm.mutex.Lock()
+	rSvc.Ready = true
+	rSvc.LastTimeAccessed = time.Now()
+	cm.mutex.Unlock()
+	s.rSvc = rSvc
 }
 
-func (cm *DockerContainerManager) startContainer(sExternalDef *admin.ExternalServiceDefinition) (*RunningService, error) {
-	port := cm.getUnusedPort()
-	rSvc, err := cm.createContainer(sExternalDef, port)
+func (cm *DockerContainerManager) startContainer(ctx context.Context, sExternalDef *admin.ExternalServiceDefinition) (*RunningService, error) {
+	cm.mutex.Lock()
+	port, err := cm.getUnusedPort()
 	if err != nil {
+		cm.mutex.Unlock()
 		return nil, err
 	}
-	cm.containers[sExternalDef.GetKey()] = rSvc
 	cm.usedPorts[port] = true
-	return rSvc, err
+	cm.updateGauges()
+	cm.mutex.Unlock()
+
+	rSvc, err := cm.createContainer(ctx, sExternalDef, port)
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	defer cm.updateGauges()
+	if err != nil {
+		delete(cm.usedPorts, port)
+		return nil, err
+	}
+	rSvc.LastTimeAccessed = time.Now()
+	return rSvc, nil
+}
+
+// updateGauges must be called with the mutex held
+func (cm *DockerContainerManager) updateGauges() {
+	containers := 0
+	for _, pool := range cm.pools {
+		containers += len(pool.ready) + len(pool.unready) + len(pool.startups)
+		metrics.ContainerReplicas.WithLabelValues(pool.sExternalDef.Sdef.Name, strconv.FormatUint(uint64(pool.sExternalDef.Version.ID), 10)).Set(float64(len(pool.ready)))
+	}
+	metrics.ContainersRunning.Set(float64(containers))
+	metrics.ContainerPortsUsed.Set(float64(len(cm.usedPorts)))
 }
 
-// garabge collect unused containers based on last time accessed
+// countDockerError records a failed docker API call
+func countDockerError(operation string, err error) {
+	if err != nil {
+		metrics.DockerErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// garabge collect unused containers based on last time accessed, this is how
+// a version scales to zero. containers with open connections and pools
+// with a replica override are left alone
 func (cm *DockerContainerManager) garbageCollectIdleContainers() {
 	for {
+		var idle []*RunningService
 		cm.mutex.Lock()
 		log.Info().Msg("Garbage collecting idle containers")
-		for key, rSvc := range cm.containers {
-			if time.Since(rSvc.LastTimeAccessed) > 2*time.Minute {
-				log.Info().Str("svc key", key).Str("containerID", rSvc.ContainerID).Msg("Removing idle container")
-				err := cm.dockerClient.ContainerKill(context.Background(), rSvc.ContainerID, "SIGKILL")
-				if err != nil {
-					log.Error().Err(err).Str("container name", key).Msg("Failed to kill container")
-				}
-				err = cm.dockerClient.ContainerRemove(context.Background(), rSvc.ContainerID, types.ContainerRemoveOptions{})
-				if err != nil {
-					log.Error().Err(err).Str("container name", key).Msg("Failed to remove container")
-				}
-				delete(cm.containers, key)
-				delete(cm.usedPorts, rSvc.AssignedPort)
+		for key, pool := range cm.pools {
+			if pool.override > 0 {
+				continue
+			}
+			// no request gets an idle container from here on
+			pool.ready = cm.removeIdle(key, pool.ready, &idle)
+			pool.unready = cm.removeIdle(key, pool.unready, &idle)
+			if pool.empty() {
+				cm.deletePool(key)
 			}
 		}
+		cm.updateGauges()
 		cm.mutex.Unlock()
-		time.Sleep(70 * time.Second)
+		for _, err := range cm.stopContainers(context.Background(), idle) {
+			log.Error().Err(err).Msg("Failed to stop idle container")
+		}
+		time.Sleep(cm.cfg.GCInterval)
+	}
+}
+
+// removeIdle returns the containers of rSvcs that are still in use and adds the others to idle.
+// must be called with the mutex held
+func (cm *DockerContainerManager) removeIdle(key string, rSvcs []*RunningService, idle *[]*RunningService) []*RunningService {
+	kept := rSvcs[:0]
+	for _, rSvc := range rSvcs {
+		if !rSvc.isIdle(cm.cfg.IdleTimeout) {
+			kept = append(kept, rSvc)
+			continue
+		}
+		log.Info().Str("svc key", key).Str("containerID", rSvc.ContainerID).Msg("Removing idle container")
+		metrics.ContainerIdleRemovals.WithLabelValues(rSvc.Service).Inc()
+		*idle = append(*idle, rSvc)
+	}
+	return kept
+}
+
+// autoscaleLoop sizes the replica pools every AutoscaleInterval
+func (cm *DockerContainerManager) autoscaleLoop() {
+	for {
+		time.Sleep(cm.cfg.AutoscaleInterval)
+		cm.autoscale()
+	}
+}
+
+// autoscale removes the replicas a pool no longer needs for the peak load since the last round,
+// pools with an override are brought to their replica count. new replicas for load are added
+// by requests as soon as it rises, so a burst never waits for the next round
+func (cm *DockerContainerManager) autoscale() {
+	var retired []*RunningService
+	cm.mutex.Lock()
+	for key, pool := range cm.pools {
+		if pool.empty() && pool.override == 0 {
+			continue
+		}
+		desired := pool.desired()
+		// no startup is added once shutdown began, the pool would never grow
+		for pool.override > 0 && pool.size() < desired && !cm.closing {
+			cm.startReplica(context.Background(), key, pool)
+		}
+		if removed := pool.shrink(desired); len(removed) > 0 {
+			log.Info().Str("svc key", key).Int("replicas", len(pool.ready)).Msg("Removing replicas")
+			retired = append(retired, removed...)
+		}
+		pool.peak = pool.inFlight()
+	}
+	cm.updateGauges()
+	cm.mutex.Unlock()
+	cm.retire(retired)
+}
+
+// retire stops replicas taken out of their pool in the background
+func (cm *DockerContainerManager) retire(rSvcs []*RunningService) {
+	if len(rSvcs) == 0 {
+		return
+	}
+	go func() {
+		for _, err := range cm.stopContainers(context.Background(), rSvcs) {
+			log.Error().Err(err).Msg("Failed to stop replica")
+		}
+	}()
+}
+
+// Replicas shows the replica pool of a version
+func (cm *DockerContainerManager) Replicas(sExternalDef *admin.ExternalServiceDefinition) admin.ReplicaStatus {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	pool, exists := cm.pools[sExternalDef.GetKey()]
+	if !exists {
+		return newReplicaPool(sExternalDef).status()
+	}
+	return pool.status()
+}
+
+// SetReplicas starts or stops replicas of a version right away until it has replicas of them
+// and keeps it there, 0 hands the version back to the autoscaler
+func (cm *DockerContainerManager) SetReplicas(sExternalDef *admin.ExternalServiceDefinition, replicas int) error {
+	if replicas < 0 || replicas > sExternalDef.Version.GetMaxReplicas() {
+		return fmt.Errorf("%w, got %d", admin.ErrInvalidReplicas, replicas)
+	}
+	key := sExternalDef.GetKey()
+	cm.mutex.Lock()
+	if cm.closing {
+		cm.mutex.Unlock()
+		return ErrShuttingDown
+	}
+	pool := cm.pool(sExternalDef)
+	pool.override = replicas
+	var retired []*RunningService
+	if replicas > 0 {
+		for pool.size() < replicas {
+			cm.startReplica(context.Background(), key, pool)
+		}
+		retired = pool.shrink(replicas)
+	}
+	cm.updateGauges()
+	cm.mutex.Unlock()
+	log.Info().Str("svc key", key).Int("replicas", replicas).Msg("Replica override set")
+	cm.retire(retired)
+	return nil
+}
+
+// stopContainers stops and removes containers that are no longer handed out to requests,
+// all at the same time. their ports are free again once it returns
+func (cm *DockerContainerManager) stopContainers(ctx context.Context, rSvcs []*RunningService) []error {
+	results := make([]error, len(rSvcs))
+	var wg sync.WaitGroup
+	for i, rSvc := range rSvcs {
+		wg.Add(1)
+		go func(i int, rSvc *RunningService) {
+			defer wg.Done()
+			results[i] = cm.stopContainer(ctx, rSvc)
+		}(i, rSvc)
+	}
+	wg.Wait()
+
+	cm.mutex.Lock()
+	for _, rSvc := range rSvcs {
+		delete(cm.usedPorts, rSvc.AssignedPort)
+	}
+	cm.updateGauges()
+	cm.mutex.Unlock()
+	cm.notifyRemoved(rSvcs)
+
+	var errs []error
+	for _, err := range results {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// stopContainer lets the requests in flight on rSvc finish, for at most its grace period,
+// then sends its stop signal and kills it if it is still running a grace period later.
+// once ctx is done the waits are cut short and the container is killed right away
+func (cm *DockerContainerManager) stopContainer(ctx context.Context, rSvc *RunningService) error {
+	ctx, span := tracing.Tracer().Start(ctx, "container.stop", trace.WithAttributes(
+		tracing.AttrService.String(rSvc.Service),
+		tracing.AttrVersion.Int64(int64(rSvc.Version)),
+		tracing.AttrContainerID.String(rSvc.ContainerID),
+	))
+	var errs []error
+	defer func() { tracing.End(span, errors.Join(errs...)) }()
+	logger := log.With().Str("containerID", rSvc.ContainerID).Str("service", rSvc.Service).Logger()
+
+	if !rSvc.drain(ctx, rSvc.StopGracePeriod) {
+		logger.Warn().Int64("in_flight", rSvc.ActiveRequests()).Msg("Stopping container with requests in flight")
+	}
+	exited := false
+	if err := cm.dockerClient.ContainerKill(ctx, rSvc.ContainerID, rSvc.StopSignal); err != nil {
+		if ctx.Err() == nil {
+			countDockerError("kill", err)
+			logger.Error().Err(err).Str("signal", rSvc.StopSignal).Msg("Failed to signal container")
+		}
+	} else {
+		exited = cm.waitForExit(ctx, rSvc.ContainerID, rSvc.StopGracePeriod)
+	}
+	span.SetAttributes(tracing.AttrKilled.Bool(!exited))
+	if !exited {
+		logger.Warn().Msg("Killing container")
+		err := cm.dockerClient.ContainerKill(context.Background(), rSvc.ContainerID, "SIGKILL")
+		countDockerError("kill", err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("kill %s: %w", rSvc.ContainerID, err))
+		}
+	}
+	err := cm.dockerClient.ContainerRemove(context.Background(), rSvc.ContainerID, types.ContainerRemoveOptions{})
+	countDockerError("remove", err)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("remove %s: %w", rSvc.ContainerID, err))
+	}
+	return errors.Join(errs...)
+}
+
+// waitForExit reports whether the container stopped running within timeout
+func (cm *DockerContainerManager) waitForExit(ctx context.Context, containerID string, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	statusCh, errCh := cm.dockerClient.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
+	select {
+	case <-statusCh:
+		return true
+	case <-errCh:
+		return false
 	}
 }
 
 // create container with docker run
-func (cm *DockerContainerManager) createContainer(sExternalDef *admin.ExternalServiceDefinition, assignedPort int) (*RunningService, error) {
+func (cm *DockerContainerManager) createContainer(ctx context.Context, sExternalDef *admin.ExternalServiceDefinition, assignedPort int) (*RunningService, error) {
 
 	image := fmt.Sprintf("%s:%s", sExternalDef.Version.ImageName, sExternalDef.Version.ImageTag)
-	ctx := context.Background()
+	createCtx, createSpan := tracing.Tracer().Start(ctx, "docker.container_create", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.ContainerImageName(sExternalDef.Version.ImageName),
+		semconv.ContainerImageTag(sExternalDef.Version.ImageTag),
+	))
 	resp, err := cm.dockerClient.ContainerCreate(
-		ctx,
+		createCtx,
 		&container.Config{
-			Image: image,
-			Tty:   false,
-			Env:   sExternalDef.Version.EnvVars,
+			Image:      image,
+			Tty:        false,
+			Env:        sExternalDef.Version.EnvVars,
+			StopSignal: sExternalDef.Version.GetStopSignal(),
 		},
 		&container.HostConfig{
 			PortBindings: buildPortBindings(sExternalDef.Version.Port, assignedPort),
@@ -122,18 +592,34 @@ func (cm *DockerContainerManager) createContainer(sExternalDef *admin.ExternalSe
 		nil,
 		"",
 	)
+	createSpan.SetAttributes(tracing.AttrContainerID.String(resp.ID))
+	tracing.End(createSpan, err)
+	countDockerError("create", err)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := cm.dockerClient.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+	startCtx, startSpan := tracing.Tracer().Start(ctx, "docker.container_start", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		tracing.AttrContainerID.String(resp.ID),
+	))
+	err = cm.dockerClient.ContainerStart(startCtx, resp.ID, types.ContainerStartOptions{})
+	tracing.End(startSpan, err)
+	countDockerError("start", err)
+	if err != nil {
+		// the created container would otherwise be left behind
+		removeErr := cm.dockerClient.ContainerRemove(context.Background(), resp.ID, types.ContainerRemoveOptions{Force: true})
+		countDockerError("remove", removeErr)
 		return nil, err
 	}
 
 	rSvc := RunningService{
-		ContainerID:  string(resp.ID),
-		AssignedPort: assignedPort,
-		Ready:        false,
+		Service:         sExternalDef.Sdef.Name,
+		Version:         sExternalDef.Version.ID,
+		ContainerID:     string(resp.ID),
+		AssignedPort:    assignedPort,
+		Ready:           false,
+		StopSignal:      sExternalDef.Version.GetStopSignal(),
+		StopGracePeriod: sExternalDef.Version.GetStopGracePeriod(),
 	}
 
 	return &rSvc, nil
@@ -152,54 +638,92 @@ func buildPortBindings(sDefPort, assignedPort int) nat.PortMap {
 	return portBindings
 }
 
-func (cm *DockerContainerManager) StopAndRemoveAllContainers() []error {
+// StopAndRemoveAllContainers stops every container the way idle ones are stopped, all at the same time.
+// startups in progress are cancelled and waited for whatever ctx says, a container they
+// hand over later would never be stopped. containers still running when ctx is done are killed
+func (cm *DockerContainerManager) StopAndRemoveAllContainers(ctx context.Context) []error {
 	cm.mutex.Lock()
-	defer cm.mutex.Unlock()
-	var errors []error
-	for _, rSvc := range cm.containers {
-		err := cm.dockerClient.ContainerKill(context.Background(), rSvc.ContainerID, "SIGKILL")
-		if err != nil {
-			errors = append(errors, err)
-		}
-		err = cm.dockerClient.ContainerRemove(context.Background(), rSvc.ContainerID, types.ContainerRemoveOptions{})
-		if err != nil {
-			errors = append(errors, err)
-		}
+	cm.closing = true
+	var all []*RunningService
+	var startups []*startup
+	for key, pool := range cm.pools {
+		all = append(all, pool.ready...)
+		all = append(all, pool.unready...)
+		startups = append(startups, pool.startups...)
+		pool.ready, pool.unready = nil, nil
+		cm.deletePool(key)
 	}
-	return errors
+	cm.updateGauges()
+	cm.mutex.Unlock()
+
+	for _, s := range startups {
+		s.cancel()
+	}
+	for _, s := range startups {
+		<-s.done
+	}
+	cm.mutex.Lock()
+	all = append(all, cm.leftovers...)
+	cm.leftovers = nil
+	cm.mutex.Unlock()
+	return cm.stopContainers(ctx, all)
 }
 
-func (cm *DockerContainerManager) getUnusedPort() int {
-	// get random port between 8000 and 9000
+// getUnusedPort must be called with the mutex held
+func (cm *DockerContainerManager) getUnusedPort() (int, error) {
+	if len(cm.usedPorts) >= cm.cfg.portRangeSize() {
+		return 0, ErrNoPortAvailable
+	}
+	// get random port of the range
 	// check if port is in use
 	for {
-		port := rand.Intn(1000) + 8000
+		port := rand.Intn(cm.cfg.portRangeSize()) + cm.cfg.PortRangeStart
 		_, exists := cm.usedPorts[port]
 		if !exists {
-			return port
+			return port, nil
 		}
 	}
 }
 
-func (cm *DockerContainerManager) isContainerReady(rSvc *RunningService) bool {
-	if rSvc.Ready {
-		return true
-	}
+func (cm *DockerContainerManager) isContainerReady(ctx context.Context, rSvc *RunningService) bool {
 	start := time.Now()
-	for i := 0; i < 30; i++ {
+	for i := 0; i < cm.cfg.ReadinessAttempts; i++ {
 		log.Debug().Msg("Waiting for container to start...")
-		resp, err := http.Get(fmt.Sprintf("http://localhost:%d", rSvc.AssignedPort))
-		if err != nil {
-			fmt.Println(err.Error())
-		}
-		if resp != nil && resp.StatusCode == 200 {
+		if cm.pollReadiness(ctx, rSvc, i+1) {
 			log.Debug().Msg("container ready...")
 			log.Info().Int64("duration_ms", time.Since(start).Milliseconds()).Msg("Container started\n")
-			rSvc.Ready = true
+			metrics.ContainerStartupDuration.WithLabelValues(rSvc.Service).Observe(time.Since(start).Seconds())
 			return true
 		}
 		log.Debug().Msg("Container not ready yet...")
-		time.Sleep(1 * time.Second)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(cm.cfg.ReadinessInterval):
+		}
 	}
 	return false
 }
+
+// pollReadiness asks the container once whether it answers with 200
+func (cm *DockerContainerManager) pollReadiness(ctx context.Context, rSvc *RunningService, attempt int) bool {
+	ctx, span := tracing.Tracer().Start(ctx, "container.readiness_poll", trace.WithAttributes(
+		tracing.AttrContainerID.String(rSvc.ContainerID),
+		tracing.AttrAttempt.Int(attempt),
+	))
+	defer span.End()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://localhost:%d", rSvc.AssignedPort), nil)
+	if err != nil {
+		span.RecordError(err)
+		return false
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Debug().Err(err).Str("containerID", rSvc.ContainerID).Msg("Readiness check failed")
+		span.RecordError(err)
+		return false
+	}
+	resp.Body.Close()
+	span.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode))
+	return resp.StatusCode == 200
+}
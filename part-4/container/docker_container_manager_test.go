@@ -0,0 +1,498 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"codereliant.io/cless/metrics"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// fakeDockerClient implements only the calls the manager makes,
+// ContainerCreate blocks until release is closed or its ctx is done
+type fakeDockerClient struct {
+	client.ContainerAPIClient
+	creates atomic.Int32
+	release chan struct{}
+}
+
+func (f *fakeDockerClient) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error) {
+	f.creates.Add(1)
+	select {
+	case <-f.release:
+	case <-ctx.Done():
+		return container.ContainerCreateCreatedBody{}, ctx.Err()
+	}
+	return container.ContainerCreateCreatedBody{}, errors.New("docker unavailable")
+}
+
+func (f *fakeDockerClient) ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
+	return nil
+}
+
+func newTestManager(t *testing.T, names ...string) (*DockerContainerManager, *fakeDockerClient, map[string]*admin.ExternalServiceDefinition) {
+	sDefManager := admin.NewServiceDefinitionManager(admin.NewInMemoryServiceDefinitionRepository(), admin.DefaultConfig())
+	defs := make(map[string]*admin.ExternalServiceDefinition)
+	for _, name := range names {
+		host := name + ".cless.cloud"
+		if err := sDefManager.RegisterServiceDefinition(name, host); err != nil {
+			t.Fatalf("Failed to register service definition: %s", err)
+		}
+		sDef, err := sDefManager.GetServiceDefinitionByName(name)
+		if err != nil {
+			t.Fatalf("Failed to get service definition: %s", err)
+		}
+		err = sDefManager.AddVersion(sDef, &admin.ServiceVersion{ImageName: name, ImageTag: "latest", Port: 8080})
+		if err != nil {
+			t.Fatalf("Failed to add version: %s", err)
+		}
+		defs[name], err = sDefManager.GetExternalServiceDefinitionByHost(host, sDef.Versions[0].ID)
+		if err != nil {
+			t.Fatalf("Failed to get external service definition: %s", err)
+		}
+	}
+	cli := &fakeDockerClient{release: make(chan struct{})}
+	return newDockerContainerManager(sDefManager, cli, DefaultConfig()), cli, defs
+}
+
+// TestStalledStartupDoesNotBlockOtherServices tests that a cold start stuck in docker
+// adds no latency to requests for a different, already running service
+func TestStalledStartupDoesNotBlockOtherServices(t *testing.T) {
+	cm, cli, defs := newTestManager(t, "slow", "warm")
+	defer close(cli.release)
+
+	warm := defs["warm"]
+	cm.pools[warm.GetKey()] = &replicaPool{sExternalDef: warm, ready: []*RunningService{{ContainerID: "warm", AssignedPort: 8001, Ready: true}}}
+
+	go cm.GetRunningServiceForHost(context.Background(), defs["slow"].Sdef.Host, defs["slow"].Version.ID)
+	assert.Eventually(t, func() bool { return cli.creates.Load() == 1 }, time.Second, time.Millisecond)
+
+	start := time.Now()
+	coldStart := false
+	ctx := WithColdStartReport(context.Background(), &coldStart)
+	rSvc, err := cm.GetRunningServiceForHost(ctx, warm.Sdef.Host, warm.Version.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "localhost:8001", rSvc.GetHost())
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+	assert.False(t, coldStart)
+}
+
+// TestConcurrentStartupsShareOneContainer tests that concurrent requests for the
+// same service version wait for a single startup and all see its result
+func TestConcurrentStartupsShareOneContainer(t *testing.T) {
+	cm, cli, defs := newTestManager(t, "svc")
+	svc := defs["svc"]
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = cm.GetRunningServiceForHost(context.Background(), svc.Sdef.Host, svc.Version.ID)
+		}(i)
+	}
+	assert.Eventually(t, func() bool {
+		cm.mutex.Lock()
+		defer cm.mutex.Unlock()
+		return cm.pools[svc.GetKey()] != nil && len(cm.pools[svc.GetKey()].startups) == 1
+	}, time.Second, time.Millisecond)
+	// give the other requests time to pile up behind the first one
+	time.Sleep(50 * time.Millisecond)
+	close(cli.release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), cli.creates.Load())
+	for _, err := range errs {
+		assert.EqualError(t, err, "docker unavailable")
+	}
+	assert.True(t, cm.pools[svc.GetKey()].empty())
+	assert.Empty(t, cm.usedPorts)
+}
+
+// TestStartupSpans tests that a cold start is traced under the request that caused it
+// and that a failed docker call marks its span
+func TestStartupSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	cm, cli, defs := newTestManager(t, "svc")
+	close(cli.release)
+	_, err := cm.GetRunningServiceForHost(context.Background(), defs["svc"].Sdef.Host, defs["svc"].Version.ID)
+	assert.Error(t, err)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	get := spans["container.get_running_service"]
+	assert.Equal(t, get.SpanContext().SpanID(), spans["admin.get_service_definition"].Parent().SpanID())
+	assert.Equal(t, get.SpanContext().SpanID(), spans["container.startup"].Parent().SpanID())
+	assert.Equal(t, spans["container.startup"].SpanContext().SpanID(), spans["docker.container_create"].Parent().SpanID())
+	assert.Equal(t, codes.Error, spans["docker.container_create"].Status().Code)
+	assert.Equal(t, codes.Error, get.Status().Code)
+	assert.NotContains(t, spans, "docker.container_start")
+}
+
+// TestFailedStartupMetrics tests that a docker error is counted and gives its port back
+func TestFailedStartupMetrics(t *testing.T) {
+	cm, cli, defs := newTestManager(t, "metered")
+	close(cli.release)
+	createErrors := testutil.ToFloat64(metrics.DockerErrors.WithLabelValues("create"))
+
+	_, err := cm.GetRunningServiceForHost(context.Background(), defs["metered"].Sdef.Host, defs["metered"].Version.ID)
+	assert.Error(t, err)
+	assert.Equal(t, createErrors+1, testutil.ToFloat64(metrics.DockerErrors.WithLabelValues("create")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.ContainerColdStarts.WithLabelValues("metered", "failed")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.ContainerPortsUsed))
+	assert.Equal(t, float64(1000), testutil.ToFloat64(metrics.ContainerPortPoolSize))
+}
+
+// stoppingDockerClient records the signals containers get. containers exit on their
+// first signal, those in ignore only on SIGKILL
+type stoppingDockerClient struct {
+	client.ContainerAPIClient
+	mutex   sync.Mutex
+	ignore  map[string]bool
+	signals map[string][]string
+	exited  map[string]chan struct{}
+	removed []string
+}
+
+func newStoppingDockerClient(ignore ...string) *stoppingDockerClient {
+	f := &stoppingDockerClient{ignore: make(map[string]bool), signals: make(map[string][]string), exited: make(map[string]chan struct{})}
+	for _, id := range ignore {
+		f.ignore[id] = true
+	}
+	return f
+}
+
+func (f *stoppingDockerClient) exitChan(id string) chan struct{} {
+	if f.exited[id] == nil {
+		f.exited[id] = make(chan struct{})
+	}
+	return f.exited[id]
+}
+
+func (f *stoppingDockerClient) ContainerKill(ctx context.Context, id, signal string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.signals[id] = append(f.signals[id], signal)
+	if signal == "SIGKILL" || !f.ignore[id] {
+		select {
+		case <-f.exitChan(id):
+		default:
+			close(f.exitChan(id))
+		}
+	}
+	return nil
+}
+
+func (f *stoppingDockerClient) ContainerWait(ctx context.Context, id string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+	f.mutex.Lock()
+	exited := f.exitChan(id)
+	f.mutex.Unlock()
+	statusCh, errCh := make(chan container.ContainerWaitOKBody, 1), make(chan error, 1)
+	go func() {
+		select {
+		case <-exited:
+			statusCh <- container.ContainerWaitOKBody{}
+		case <-ctx.Done():
+			errCh <- ctx.Err()
+		}
+	}()
+	return statusCh, errCh
+}
+
+func (f *stoppingDockerClient) ContainerRemove(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.removed = append(f.removed, id)
+	return nil
+}
+
+func (f *stoppingDockerClient) signalsOf(id string) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.signals[id]...)
+}
+
+func newStoppingManager(cli *stoppingDockerClient, rSvcs ...*RunningService) *DockerContainerManager {
+	cm := newDockerContainerManager(admin.NewServiceDefinitionManager(admin.NewInMemoryServiceDefinitionRepository(), admin.DefaultConfig()), cli, DefaultConfig())
+	sExternalDef := &admin.ExternalServiceDefinition{Sdef: &admin.ServiceDefinition{Name: "test"}, Version: &admin.ServiceVersion{}}
+	cm.pools[sExternalDef.GetKey()] = &replicaPool{sExternalDef: sExternalDef, ready: rSvcs}
+	for _, rSvc := range rSvcs {
+		cm.usedPorts[rSvc.AssignedPort] = true
+	}
+	return cm
+}
+
+// TestStopDrainsRequestsInFlight tests that a container is taken out of routing at once
+// but only signalled after its last request finished
+func TestStopDrainsRequestsInFlight(t *testing.T) {
+	cli := newStoppingDockerClient()
+	rSvc := &RunningService{ContainerID: "busy", AssignedPort: 8001, StopSignal: "SIGTERM", StopGracePeriod: 5 * time.Second}
+	cm := newStoppingManager(cli, rSvc)
+	var removed atomic.Int32
+	cm.OnContainerRemoved(func(*RunningService) { removed.Add(1) })
+	rSvc.BeginRequest()
+
+	done := make(chan []error)
+	go func() { done <- cm.StopAndRemoveAllContainers(context.Background()) }()
+	assert.Eventually(t, func() bool {
+		cm.mutex.Lock()
+		defer cm.mutex.Unlock()
+		return len(cm.pools) == 0
+	}, time.Second, time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, cli.signalsOf("busy"))
+
+	rSvc.EndRequest()
+	assert.Empty(t, <-done)
+	assert.Equal(t, []string{"SIGTERM"}, cli.signalsOf("busy"))
+	assert.Equal(t, []string{"busy"}, cli.removed)
+	assert.Empty(t, cm.usedPorts)
+	assert.Equal(t, int32(1), removed.Load())
+}
+
+// TestStopEscalatesToSIGKILL tests that a container ignoring its stop signal is killed after the grace period
+func TestStopEscalatesToSIGKILL(t *testing.T) {
+	cli := newStoppingDockerClient("stubborn")
+	rSvc := &RunningService{ContainerID: "stubborn", AssignedPort: 8001, StopSignal: "SIGQUIT", StopGracePeriod: 100 * time.Millisecond}
+	cm := newStoppingManager(cli, rSvc)
+
+	start := time.Now()
+	assert.Empty(t, cm.StopAndRemoveAllContainers(context.Background()))
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	assert.Equal(t, []string{"SIGQUIT", "SIGKILL"}, cli.signalsOf("stubborn"))
+}
+
+// TestStopAllIsParallelAndBounded tests that shutdown stops containers at the same time
+// and kills whatever is left when its budget runs out
+func TestStopAllIsParallelAndBounded(t *testing.T) {
+	cli := newStoppingDockerClient("a", "b", "c")
+	var rSvcs []*RunningService
+	for i, id := range []string{"a", "b", "c"} {
+		rSvcs = append(rSvcs, &RunningService{ContainerID: id, AssignedPort: 8001 + i, StopSignal: "SIGTERM", StopGracePeriod: 10 * time.Second})
+	}
+	cm := newStoppingManager(cli, rSvcs...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Empty(t, cm.StopAndRemoveAllContainers(ctx))
+	assert.Less(t, time.Since(start), time.Second)
+	for _, id := range []string{"a", "b", "c"} {
+		assert.Equal(t, []string{"SIGTERM", "SIGKILL"}, cli.signalsOf(id))
+	}
+	assert.Len(t, cli.removed, 3)
+}
+
+// TestOpenStreamsAreNeverIdle tests that the idle check ignores containers with requests in flight
+func TestOpenStreamsAreNeverIdle(t *testing.T) {
+	rSvc := &RunningService{LastTimeAccessed: time.Now().Add(-10 * time.Minute)}
+	rSvc.BeginRequest()
+	assert.False(t, rSvc.isIdle(2*time.Minute))
+
+	rSvc.EndRequest()
+	assert.False(t, rSvc.isIdle(2*time.Minute), "idle time counts from the end of the last request")
+	assert.True(t, rSvc.isIdle(0))
+}
+
+// TestBusyVersionAddsReplica tests that a request to a version over its concurrency target
+// is served by a ready replica while another one starts in the background
+func TestBusyVersionAddsReplica(t *testing.T) {
+	cm, cli, defs := newTestManager(t, "busy")
+	defer close(cli.release)
+	svc := defs["busy"]
+	// the routing snapshot shares the version with svc
+	svc.Version.ConcurrencyTarget = 2
+	rSvc := &RunningService{ContainerID: "busy", AssignedPort: 8001, Ready: true}
+	rSvc.BeginRequest()
+	rSvc.BeginRequest()
+	cm.pools[svc.GetKey()] = &replicaPool{sExternalDef: svc, ready: []*RunningService{rSvc}}
+
+	coldStart := false
+	got, err := cm.GetRunningServiceForHost(WithColdStartReport(context.Background(), &coldStart), svc.Sdef.Host, svc.Version.ID)
+	assert.NoError(t, err)
+	assert.Same(t, rSvc, got)
+	assert.False(t, coldStart)
+	assert.Eventually(t, func() bool { return cli.creates.Load() == 1 }, time.Second, time.Millisecond)
+
+	// the replica on its way counts against the target
+	_, err = cm.GetRunningServiceForHost(context.Background(), svc.Sdef.Host, svc.Version.ID)
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), cli.creates.Load())
+	status := cm.Replicas(svc)
+	assert.Equal(t, 1, status.Ready)
+	assert.Equal(t, 1, status.Starting)
+	assert.Equal(t, int64(4), status.InFlight, "both requests are counted until they end")
+}
+
+// TestAutoscaleRemovesReplicas tests that replicas the peak load doesn't need are stopped
+// and that the busiest replica stays
+func TestAutoscaleRemovesReplicas(t *testing.T) {
+	cli := newStoppingDockerClient()
+	var rSvcs []*RunningService
+	for i, id := range []string{"a", "b", "c"} {
+		rSvcs = append(rSvcs, &RunningService{ContainerID: id, AssignedPort: 8001 + i, Ready: true, StopSignal: "SIGTERM", StopGracePeriod: time.Second})
+	}
+	rSvcs[1].BeginRequest()
+	cm := newStoppingManager(cli, rSvcs...)
+	var pool *replicaPool
+	for _, p := range cm.pools {
+		pool = p
+	}
+	pool.sExternalDef.Version.ConcurrencyTarget = 1
+	pool.peak = 1
+
+	cm.autoscale()
+	assert.Equal(t, []*RunningService{rSvcs[1]}, pool.ready)
+	assert.Equal(t, int64(1), pool.peak, "the next round starts from the load in flight")
+	assert.Eventually(t, func() bool {
+		cli.mutex.Lock()
+		defer cli.mutex.Unlock()
+		return len(cli.removed) == 2
+	}, time.Second, time.Millisecond)
+	assert.ElementsMatch(t, []string{"a", "c"}, cli.removed)
+	assert.Empty(t, cli.signalsOf("b"))
+}
+
+// TestSetReplicas tests that an override starts replicas right away and is bounded by the max replicas
+func TestSetReplicas(t *testing.T) {
+	cm, cli, defs := newTestManager(t, "pinned")
+	defer close(cli.release)
+	svc := defs["pinned"]
+
+	assert.ErrorIs(t, cm.SetReplicas(svc, admin.DefaultMaxReplicas+1), admin.ErrInvalidReplicas)
+	assert.ErrorIs(t, cm.SetReplicas(svc, -1), admin.ErrInvalidReplicas)
+	assert.Equal(t, 0, cm.Replicas(svc).Desired, "a version without containers is scaled to zero")
+
+	assert.NoError(t, cm.SetReplicas(svc, 3))
+	assert.Eventually(t, func() bool { return cli.creates.Load() == 3 }, time.Second, time.Millisecond)
+	status := cm.Replicas(svc)
+	assert.Equal(t, 3, status.Starting)
+	assert.Equal(t, 3, status.Desired)
+	assert.Equal(t, 3, status.Override)
+
+	assert.NoError(t, cm.SetReplicas(svc, 0))
+	assert.Equal(t, 0, cm.Replicas(svc).Override)
+	assert.Equal(t, 1, cm.Replicas(svc).Desired)
+}
+
+// startingDockerClient creates containers that never pass their readiness check
+type startingDockerClient struct {
+	*stoppingDockerClient
+	created chan struct{}
+}
+
+func (f *startingDockerClient) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error) {
+	close(f.created)
+	return container.ContainerCreateCreatedBody{ID: "late"}, nil
+}
+
+func (f *startingDockerClient) ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
+	return nil
+}
+
+// TestShutdownStopsStartingReplicas tests that shutdown cancels a startup in progress,
+// stops its container and starts no new ones
+func TestShutdownStopsStartingReplicas(t *testing.T) {
+	cm, _, defs := newTestManager(t, "starting")
+	cli := &startingDockerClient{stoppingDockerClient: newStoppingDockerClient(), created: make(chan struct{})}
+	cm.dockerClient = cli
+	svc := defs["starting"]
+
+	waited := make(chan error)
+	go func() {
+		_, err := cm.GetRunningServiceForHost(context.Background(), svc.Sdef.Host, svc.Version.ID)
+		waited <- err
+	}()
+	<-cli.created
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	assert.Empty(t, cm.StopAndRemoveAllContainers(ctx))
+	assert.Less(t, time.Since(start), 2*time.Second, "the readiness check is cut short")
+	assert.Equal(t, []string{"SIGTERM"}, cli.signalsOf("late"))
+	assert.Equal(t, []string{"late"}, cli.removed)
+	assert.Error(t, <-waited)
+
+	_, err := cm.GetRunningServiceForHost(context.Background(), svc.Sdef.Host, svc.Version.ID)
+	assert.ErrorIs(t, err, ErrShuttingDown)
+}
+
+// TestReplicasAfterShutdown tests that overrides neither hang nor start containers once shutdown began
+func TestReplicasAfterShutdown(t *testing.T) {
+	cm, cli, defs := newTestManager(t, "pinned", "overridden")
+	defer close(cli.release)
+	assert.NoError(t, cm.SetReplicas(defs["overridden"], 2))
+	assert.Eventually(t, func() bool { return cli.creates.Load() == 2 }, time.Second, time.Millisecond)
+
+	cm.StopAndRemoveAllContainers(context.Background())
+
+	done := make(chan error)
+	go func() {
+		done <- cm.SetReplicas(defs["pinned"], 2)
+		cm.autoscale()
+	}()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, ErrShuttingDown)
+	case <-time.After(time.Second):
+		t.Fatal("SetReplicas hangs after shutdown")
+	}
+	assert.Equal(t, int32(2), cli.creates.Load())
+}
+
+// slowDockerClient creates a container only once release is closed, even if the startup was cancelled
+type slowDockerClient struct {
+	*stoppingDockerClient
+	created chan struct{}
+	release chan struct{}
+}
+
+func (f *slowDockerClient) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error) {
+	close(f.created)
+	<-f.release
+	return container.ContainerCreateCreatedBody{ID: "slow"}, nil
+}
+
+func (f *slowDockerClient) ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
+	return nil
+}
+
+// TestShutdownWaitsForSlowStartups tests that a container whose startup only finishes
+// after the shutdown deadline is still removed
+func TestShutdownWaitsForSlowStartups(t *testing.T) {
+	cm, _, defs := newTestManager(t, "slow")
+	cli := &slowDockerClient{stoppingDockerClient: newStoppingDockerClient(), created: make(chan struct{}), release: make(chan struct{})}
+	cm.dockerClient = cli
+	assert.NoError(t, cm.SetReplicas(defs["slow"], 1))
+	<-cli.created
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	time.AfterFunc(50*time.Millisecond, func() { close(cli.release) })
+	cm.StopAndRemoveAllContainers(ctx)
+	assert.Equal(t, []string{"slow"}, cli.removed)
+}
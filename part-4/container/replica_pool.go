@@ -0,0 +1,145 @@
+package container
+
+import (
+	"codereliant.io/cless/admin"
+)
+
+// replicaPool holds the containers running one service version. requests are spread over
+// its ready replicas, the autoscaler sizes it to the load. guarded by the manager mutex
+type replicaPool struct {
+	sExternalDef *admin.ExternalServiceDefinition // definition the pool was last used with
+	ready        []*RunningService                // replicas handed out to requests
+	unready      []*RunningService                // started but never passed their readiness check, the next startup polls them again
+	startups     []*startup                       // replicas being started
+	next         int                              // round robin position
+	peak         int64                            // most requests in flight since the last autoscale round
+	override     int                              // replicas set through the admin api, 0 when autoscaled
+}
+
+func newReplicaPool(sExternalDef *admin.ExternalServiceDefinition) *replicaPool {
+	return &replicaPool{sExternalDef: sExternalDef}
+}
+
+// size counts the replicas serving or about to serve requests
+func (p *replicaPool) size() int {
+	return len(p.ready) + len(p.startups)
+}
+
+// empty reports whether the pool has no containers at all
+func (p *replicaPool) empty() bool {
+	return len(p.ready) == 0 && len(p.unready) == 0 && len(p.startups) == 0
+}
+
+func (p *replicaPool) inFlight() int64 {
+	var n int64
+	for _, rSvc := range p.ready {
+		n += rSvc.ActiveRequests()
+	}
+	return n
+}
+
+// pick chooses the replica for the next request by the version's load balancing and counts
+// the request as in flight on it, so it is never retired in between. nil if no replica is ready
+func (p *replicaPool) pick() *RunningService {
+	if len(p.ready) == 0 {
+		return nil
+	}
+	start := p.next % len(p.ready)
+	p.next++
+	chosen := p.ready[start]
+	if p.sExternalDef.Version.GetLoadBalancing() == admin.BalanceLeastOutstanding {
+		// ties go round robin, so an idle pool still spreads its requests
+		for i := 1; i < len(p.ready); i++ {
+			rSvc := p.ready[(start+i)%len(p.ready)]
+			if rSvc.ActiveRequests() < chosen.ActiveRequests() {
+				chosen = rSvc
+			}
+		}
+	}
+	chosen.BeginRequest()
+	return chosen
+}
+
+// observe records the load after a request was picked and reports whether
+// the pool needs another replica for it
+func (p *replicaPool) observe() bool {
+	load := p.inFlight()
+	if load > p.peak {
+		p.peak = load
+	}
+	version := p.sExternalDef.Version
+	if p.override > 0 || version.ConcurrencyTarget == 0 {
+		return false
+	}
+	return load > int64(version.ConcurrencyTarget*p.size()) && p.size() < version.GetMaxReplicas()
+}
+
+// desired is the number of replicas for the peak load since the last autoscale round, at least one.
+// going down to zero is left to the idle timeout
+func (p *replicaPool) desired() int {
+	if p.override > 0 {
+		return p.override
+	}
+	target := int64(p.sExternalDef.Version.ConcurrencyTarget)
+	if target == 0 {
+		return 1
+	}
+	n := int((p.peak + target - 1) / target)
+	if n < 1 {
+		n = 1
+	}
+	if max := p.sExternalDef.Version.GetMaxReplicas(); n > max {
+		n = max
+	}
+	return n
+}
+
+// shrink takes ready replicas out of the pool until at most n are left, the least busy go first
+func (p *replicaPool) shrink(n int) []*RunningService {
+	var removed []*RunningService
+	for len(p.ready) > n {
+		idlest := len(p.ready) - 1
+		for i := idlest - 1; i >= 0; i-- {
+			if p.ready[i].ActiveRequests() < p.ready[idlest].ActiveRequests() {
+				idlest = i
+			}
+		}
+		removed = append(removed, p.ready[idlest])
+		p.ready = append(p.ready[:idlest], p.ready[idlest+1:]...)
+	}
+	return removed
+}
+
+func (p *replicaPool) has(rSvc *RunningService) bool {
+	for _, ready := range p.ready {
+		if ready == rSvc {
+			return true
+		}
+	}
+	return false
+}
+
+// removeStartup forgets a finished startup
+func (p *replicaPool) removeStartup(s *startup) {
+	for i := range p.startups {
+		if p.startups[i] == s {
+			p.startups = append(p.startups[:i], p.startups[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *replicaPool) status() admin.ReplicaStatus {
+	status := admin.ReplicaStatus{
+		Service:  p.sExternalDef.Sdef.Name,
+		Version:  p.sExternalDef.Version.ID,
+		Ready:    len(p.ready),
+		Starting: len(p.startups),
+		InFlight: p.inFlight(),
+		Override: p.override,
+	}
+	if p.override > 0 || p.size() > 0 {
+		status.Desired = p.desired()
+	}
+	return status
+}
@@ -0,0 +1,99 @@
+package container
+
+import (
+	"testing"
+
+	"codereliant.io/cless/admin"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPool(version admin.ServiceVersion, active ...int) *replicaPool {
+	pool := newReplicaPool(&admin.ExternalServiceDefinition{Sdef: &admin.ServiceDefinition{Name: "test"}, Version: &version})
+	for i, n := range active {
+		rSvc := &RunningService{AssignedPort: 8001 + i, Ready: true}
+		for j := 0; j < n; j++ {
+			rSvc.BeginRequest()
+		}
+		pool.ready = append(pool.ready, rSvc)
+	}
+	return pool
+}
+
+// TestRoundRobin tests that requests take turns over the replicas and are counted as in flight
+// as soon as they are picked
+func TestRoundRobin(t *testing.T) {
+	pool := newTestPool(admin.ServiceVersion{}, 5, 0, 0)
+	var ports []int
+	for i := 0; i < 6; i++ {
+		ports = append(ports, pool.pick().AssignedPort)
+	}
+	assert.Equal(t, []int{8001, 8002, 8003, 8001, 8002, 8003}, ports)
+	assert.Equal(t, int64(7), pool.ready[0].ActiveRequests())
+	assert.Nil(t, newTestPool(admin.ServiceVersion{}).pick())
+}
+
+// TestLeastOutstanding tests that a request goes to the replica with the fewest requests in flight
+// and that replicas with as many take turns
+func TestLeastOutstanding(t *testing.T) {
+	pool := newTestPool(admin.ServiceVersion{LoadBalancing: admin.BalanceLeastOutstanding}, 3, 0, 2)
+	assert.Equal(t, 8002, pool.pick().AssignedPort)
+	assert.Equal(t, 8002, pool.pick().AssignedPort)
+	assert.Equal(t, 8003, pool.pick().AssignedPort, "a burst spreads because picked requests count")
+	assert.Equal(t, 8002, pool.pick().AssignedPort)
+
+	pool = newTestPool(admin.ServiceVersion{LoadBalancing: admin.BalanceLeastOutstanding}, 0, 0)
+	assert.Equal(t, 8001, pool.pick().AssignedPort)
+	assert.Equal(t, 8002, pool.pick().AssignedPort)
+}
+
+// TestObserveAsksForReplicas tests that a replica is wanted once the load, with the picked
+// request counted, passes the target of the replicas there are, up to the max
+func TestObserveAsksForReplicas(t *testing.T) {
+	assert.False(t, newTestPool(admin.ServiceVersion{ConcurrencyTarget: 2}, 2).observe())
+	assert.True(t, newTestPool(admin.ServiceVersion{ConcurrencyTarget: 2}, 3).observe())
+	assert.False(t, newTestPool(admin.ServiceVersion{ConcurrencyTarget: 2}, 2, 2).observe())
+	assert.False(t, newTestPool(admin.ServiceVersion{ConcurrencyTarget: 1, MaxReplicas: 2}, 3, 3).observe())
+	assert.False(t, newTestPool(admin.ServiceVersion{}, 50).observe(), "without a target the version keeps one replica")
+
+	pool := newTestPool(admin.ServiceVersion{ConcurrencyTarget: 2}, 2)
+	pool.override = 1
+	assert.False(t, pool.observe(), "an override is not autoscaled")
+	assert.Equal(t, int64(2), pool.peak)
+}
+
+// TestDesiredReplicas tests the replica count for the peak load
+func TestDesiredReplicas(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  admin.ServiceVersion
+		peak     int64
+		override int
+		want     int
+	}{
+		{"no target", admin.ServiceVersion{}, 40, 0, 1},
+		{"peak over target", admin.ServiceVersion{ConcurrencyTarget: 2}, 5, 0, 3},
+		{"no load", admin.ServiceVersion{ConcurrencyTarget: 2}, 0, 0, 1},
+		{"capped", admin.ServiceVersion{ConcurrencyTarget: 2, MaxReplicas: 2}, 9, 0, 2},
+		{"override", admin.ServiceVersion{ConcurrencyTarget: 2}, 9, 4, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newTestPool(tt.version)
+			pool.peak = tt.peak
+			pool.override = tt.override
+			assert.Equal(t, tt.want, pool.desired())
+		})
+	}
+}
+
+// TestShrinkKeepsBusyReplicas tests that the replicas with the fewest requests in flight are removed first
+func TestShrinkKeepsBusyReplicas(t *testing.T) {
+	pool := newTestPool(admin.ServiceVersion{}, 2, 0, 3, 0)
+	removed := pool.shrink(2)
+	assert.Len(t, removed, 2)
+	assert.Equal(t, 8004, removed[0].AssignedPort, "the newest of the idle replicas goes first")
+	assert.Equal(t, 8002, removed[1].AssignedPort)
+	assert.Equal(t, 8001, pool.ready[0].AssignedPort)
+	assert.Equal(t, 8003, pool.ready[1].AssignedPort)
+	assert.Empty(t, pool.shrink(2))
+}
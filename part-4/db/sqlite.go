@@ -1,14 +1,30 @@
 package db
 
 import (
+	"errors"
+
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-const DBFileName = "cless.sqlite3"
+// Config holds the database settings
+type Config struct {
+	File string `yaml:"file" toml:"file"` // path of the sqlite database, created if missing
+}
+
+func DefaultConfig() Config {
+	return Config{File: "cless.sqlite3"}
+}
+
+func (cfg Config) Validate() error {
+	if cfg.File == "" {
+		return errors.New("file must not be empty")
+	}
+	return nil
+}
 
-func NewSqliteDB() (*gorm.DB, error) {
-	db, err := gorm.Open(sqlite.Open(DBFileName), &gorm.Config{})
+func NewSqliteDB(cfg Config) (*gorm.DB, error) {
+	db, err := gorm.Open(sqlite.Open(cfg.File), &gorm.Config{})
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,230 @@
+package gateway
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// where access log entries go
+const (
+	AccessLogOff    = "off"
+	AccessLogStdout = "stdout"
+	AccessLogFile   = "file"
+	AccessLogBoth   = "both"
+)
+
+// access log formats
+const (
+	AccessLogJSON = "json"
+	AccessLogCLF  = "clf" // common log format with the gateway fields appended as key=value
+)
+
+// AccessLogConfig configures the access log of the gateway
+type AccessLogConfig struct {
+	Output     string  `yaml:"output" toml:"output"`
+	Format     string  `yaml:"format" toml:"format"`
+	File       string  `yaml:"file" toml:"file"`                 // path of the log file for the file and both outputs
+	MaxSizeMB  int     `yaml:"max_size_mb" toml:"max_size_mb"`   // size at which the file is rotated
+	MaxBackups int     `yaml:"max_backups" toml:"max_backups"`   // rotated files to keep
+	MaxAgeDays int     `yaml:"max_age_days" toml:"max_age_days"` // days to keep rotated files
+	SampleRate float64 `yaml:"sample_rate" toml:"sample_rate"`   // share of requests that are logged, server errors are always logged
+}
+
+func DefaultAccessLogConfig() AccessLogConfig {
+	return AccessLogConfig{
+		Output:     AccessLogStdout,
+		Format:     AccessLogJSON,
+		File:       "cless-access.log",
+		MaxSizeMB:  100,
+		MaxBackups: 5,
+		MaxAgeDays: 30,
+		SampleRate: 1,
+	}
+}
+
+// AccessLogger writes one entry per proxied request
+type AccessLogger struct {
+	format     string
+	sampleRate float64
+	mutex      sync.Mutex // serializes clf lines and guards rnd
+	out        io.Writer
+	json       zerolog.Logger
+	rnd        *rand.Rand
+}
+
+func (cfg AccessLogConfig) Validate() error {
+	switch cfg.Output {
+	case AccessLogOff, AccessLogStdout, AccessLogFile, AccessLogBoth:
+	default:
+		return fmt.Errorf("unknown access log output %q", cfg.Output)
+	}
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return fmt.Errorf("access log sample rate must be between 0 and 1, got %v", cfg.SampleRate)
+	}
+	if cfg.Format != AccessLogJSON && cfg.Format != AccessLogCLF {
+		return fmt.Errorf("unknown access log format %q", cfg.Format)
+	}
+	if (cfg.Output == AccessLogFile || cfg.Output == AccessLogBoth) && cfg.File == "" {
+		return fmt.Errorf("access log output %q needs a file", cfg.Output)
+	}
+	return nil
+}
+
+// NewAccessLogger creates the access logger for cfg, nil if the access log is off
+func NewAccessLogger(cfg AccessLogConfig) (*AccessLogger, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	file := &lumberjack.Logger{
+		Filename:   cfg.File,
+		MaxSize:    cfg.MaxSizeMB,
+		MaxBackups: cfg.MaxBackups,
+		MaxAge:     cfg.MaxAgeDays,
+	}
+	var out io.Writer
+	switch cfg.Output {
+	case AccessLogOff:
+		return nil, nil
+	case AccessLogStdout:
+		out = os.Stdout
+	case AccessLogFile:
+		out = file
+	case AccessLogBoth:
+		out = io.MultiWriter(os.Stdout, file)
+	}
+	return newAccessLogger(out, cfg.Format, cfg.SampleRate), nil
+}
+
+func newAccessLogger(out io.Writer, format string, sampleRate float64) *AccessLogger {
+	return &AccessLogger{
+		format:     format,
+		sampleRate: sampleRate,
+		out:        out,
+		json:       zerolog.New(out),
+		rnd:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// accessLogEntry is everything the access log records about a request
+type accessLogEntry struct {
+	Time       time.Time
+	RemoteAddr string
+	Host       string
+	Method     string
+	Path       string
+	Proto      string
+	Status     int
+	Bytes      int64
+	Total      time.Duration
+	Info       *requestInfo
+}
+
+func (l *AccessLogger) sampled(status int) bool {
+	if status >= 500 || l.sampleRate >= 1 {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rnd.Float64() < l.sampleRate
+}
+
+func (l *AccessLogger) log(e *accessLogEntry) {
+	if !l.sampled(e.Status) {
+		return
+	}
+	if l.format == AccessLogCLF {
+		l.writeCLF(e)
+		return
+	}
+	l.json.Log().
+		Time("time", e.Time).
+		Str("request_id", e.Info.ID).
+		Str("trace_id", e.Info.TraceID).
+		Str("remote_addr", e.RemoteAddr).
+		Str("host", e.Host).
+		Str("service", e.Info.Service).
+		Uint("version", e.Info.Version).
+		Str("container_id", e.Info.ContainerID).
+		Str("method", e.Method).
+		Str("path", e.Path).
+		Int("status", e.Status).
+		Int64("bytes", e.Bytes).
+		Float64("upstream_ms", float64(e.Info.Upstream.Microseconds())/1000).
+		Float64("total_ms", float64(e.Total.Microseconds())/1000).
+		Bool("cold_start", e.Info.ColdStart).
+		Send()
+}
+
+func (l *AccessLogger) writeCLF(e *accessLogEntry) {
+	line := fmt.Sprintf("%s - - [%s] %q %d %d host=%s service=%s version=%d container_id=%s upstream_ms=%.3f total_ms=%.3f cold_start=%t request_id=%s trace_id=%s\n",
+		e.RemoteAddr,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method+" "+e.Path+" "+e.Proto,
+		e.Status,
+		e.Bytes,
+		e.Host,
+		dashIfEmpty(e.Info.Service),
+		e.Info.Version,
+		dashIfEmpty(e.Info.ContainerID),
+		float64(e.Info.Upstream.Microseconds())/1000,
+		float64(e.Total.Microseconds())/1000,
+		e.Info.ColdStart,
+		e.Info.ID,
+		dashIfEmpty(e.Info.TraceID),
+	)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	io.WriteString(l.out, line)
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// statusRecorder remembers the status and size of the response on its way out.
+// Unwrap lets http.ResponseController reach the flusher and hijacker underneath
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	// informational responses are followed by the real one, except for protocol switches
+	if sr.status == 0 && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// Status is the status sent to the client, 200 if the handler wrote nothing
+func (sr *statusRecorder) Status() int {
+	if sr.status == 0 {
+		return http.StatusOK
+	}
+	return sr.status
+}
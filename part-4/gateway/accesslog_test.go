@@ -0,0 +1,84 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"codereliant.io/cless/container"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAccessLogJSON tests that a proxied request is logged with the routing details and the response
+func TestAccessLogJSON(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+	rSvc := backendService(t, backend)
+	rSvc.ContainerID = "abc123"
+	g := newTestGateway(t, &fakeContainerManager{rSvc: rSvc})
+	var out bytes.Buffer
+	g.SetAccessLogger(newAccessLogger(&out, AccessLogJSON, 1))
+
+	req := httptest.NewRequest(http.MethodPost, "/users?id=1", nil)
+	req.Host = "test.cless.cloud"
+	g.ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &entry))
+	assert.Equal(t, "test.cless.cloud", entry["host"])
+	assert.Equal(t, "test", entry["service"])
+	sDef, _ := g.sDefManager.GetServiceDefinitionByName("test")
+	assert.Equal(t, float64(sDef.Versions[0].ID), entry["version"])
+	assert.Equal(t, "abc123", entry["container_id"])
+	assert.Equal(t, "POST", entry["method"])
+	assert.Equal(t, "/users?id=1", entry["path"])
+	assert.Equal(t, float64(http.StatusCreated), entry["status"])
+	assert.Equal(t, float64(5), entry["bytes"])
+	assert.Equal(t, false, entry["cold_start"])
+	assert.NotEmpty(t, entry["request_id"])
+	assert.Contains(t, entry, "upstream_ms")
+	assert.Contains(t, entry, "total_ms")
+}
+
+// TestAccessLogCLF tests the common log format and that gateway errors are logged too
+func TestAccessLogCLF(t *testing.T) {
+	g := newTestGateway(t, &fakeContainerManager{err: container.ErrContainerStarting})
+	var out bytes.Buffer
+	g.SetAccessLogger(newAccessLogger(&out, AccessLogCLF, 0))
+
+	serve(g, "test.cless.cloud")
+	line := out.String()
+	assert.True(t, strings.HasSuffix(line, "\n"))
+	assert.Contains(t, line, `"GET / HTTP/1.1" 503 `)
+	sDef, _ := g.sDefManager.GetServiceDefinitionByName("test")
+	assert.Contains(t, line, fmt.Sprintf("service=test version=%d container_id=-", sDef.Versions[0].ID))
+}
+
+// TestAccessLogSampling tests that a sample rate of 0 drops everything but server errors
+func TestAccessLogSampling(t *testing.T) {
+	g := newTestGateway(t, &fakeContainerManager{})
+	var out bytes.Buffer
+	g.SetAccessLogger(newAccessLogger(&out, AccessLogJSON, 0))
+	serve(g, "unknown.cless.cloud")
+	assert.Empty(t, out.String())
+}
+
+func TestNewAccessLoggerValidates(t *testing.T) {
+	cfg := DefaultAccessLogConfig()
+	cfg.Format = "xml"
+	_, err := NewAccessLogger(cfg)
+	assert.Error(t, err)
+
+	cfg = DefaultAccessLogConfig()
+	cfg.Output = AccessLogOff
+	l, err := NewAccessLogger(cfg)
+	assert.NoError(t, err)
+	assert.Nil(t, l)
+}
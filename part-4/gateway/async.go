@@ -0,0 +1,318 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"codereliant.io/cless/metrics"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"gorm.io/datatypes"
+)
+
+// requests carrying InvocationTypeHeader: async are queued and answered with 202 right away
+const (
+	InvocationTypeHeader = "X-Cless-Invocation-Type"
+	InvocationIDHeader   = "X-Cless-Invocation-Id"
+)
+
+// AsyncConfig tunes how queued invocations are delivered
+type AsyncConfig struct {
+	Workers          int           `yaml:"workers" toml:"workers"`           // invocations delivered at the same time
+	MaxAttempts      int           `yaml:"max_attempts" toml:"max_attempts"` // attempts before an invocation goes to the dead letter state
+	Backoff          time.Duration `yaml:"backoff" toml:"backoff"`           // wait before the second attempt, doubled for every attempt after
+	MaxBackoff       time.Duration `yaml:"max_backoff" toml:"max_backoff"`
+	AttemptTimeout   time.Duration `yaml:"attempt_timeout" toml:"attempt_timeout"`       // cold start and request of one attempt
+	MaxBodyBytes     int64         `yaml:"max_body_bytes" toml:"max_body_bytes"`         // larger requests are turned away with 413
+	MaxResponseBytes int64         `yaml:"max_response_bytes" toml:"max_response_bytes"` // stored responses are cut off after this many bytes
+	PollInterval     time.Duration `yaml:"poll_interval" toml:"poll_interval"`           // how often the queue is checked for retries that became due
+	// how long completed and dead lettered invocations are kept, 0 keeps them forever
+	Retention time.Duration `yaml:"retention" toml:"retention"`
+}
+
+// how often invocations and events past their retention are deleted
+const retentionCleanupInterval = time.Hour
+
+// headers that carry credentials of the caller, they are not stored with a queued invocation
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", admin.DefaultAPIKeyHeader}
+
+func DefaultAsyncConfig() AsyncConfig {
+	return AsyncConfig{
+		Workers:          8,
+		MaxAttempts:      5,
+		Backoff:          5 * time.Second,
+		MaxBackoff:       5 * time.Minute,
+		AttemptTimeout:   15 * time.Minute,
+		MaxBodyBytes:     1 << 20,
+		MaxResponseBytes: 1 << 20,
+		PollInterval:     time.Second,
+		Retention:        7 * 24 * time.Hour,
+	}
+}
+
+func (cfg AsyncConfig) Validate() error {
+	errs := validateDelivery(cfg.Workers, cfg.MaxAttempts, cfg.Backoff, cfg.MaxBackoff, cfg.AttemptTimeout, cfg.PollInterval)
+	if cfg.MaxBodyBytes <= 0 {
+		errs = append(errs, fmt.Errorf("max body bytes must be positive, got %d", cfg.MaxBodyBytes))
+	}
+	if cfg.MaxResponseBytes <= 0 {
+		errs = append(errs, fmt.Errorf("max response bytes must be positive, got %d", cfg.MaxResponseBytes))
+	}
+	if cfg.Retention < 0 {
+		errs = append(errs, fmt.Errorf("retention can't be negative, got %s", cfg.Retention))
+	}
+	return errors.Join(errs...)
+}
+
+// validateDelivery checks the settings async invocations and events share
+func validateDelivery(workers, maxAttempts int, backoff, maxBackoff, attemptTimeout, pollInterval time.Duration) []error {
+	var errs []error
+	if workers < 1 {
+		errs = append(errs, fmt.Errorf("workers must be at least 1, got %d", workers))
+	}
+	if maxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("max attempts must be at least 1, got %d", maxAttempts))
+	}
+	if backoff <= 0 || maxBackoff < backoff {
+		errs = append(errs, fmt.Errorf("backoff must be positive and at most the max backoff, got %s and %s", backoff, maxBackoff))
+	}
+	if attemptTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("attempt timeout must be positive, got %s", attemptTimeout))
+	}
+	if pollInterval <= 0 {
+		errs = append(errs, fmt.Errorf("poll interval must be positive, got %s", pollInterval))
+	}
+	return errs
+}
+
+// AsyncInvoker stores async requests in a durable queue and delivers them
+// to the service in the background, retrying failed attempts with backoff
+type AsyncInvoker struct {
+	repo    admin.InvocationRepository
+	gateway *Gateway
+	cfg     AsyncConfig
+	wake    chan struct{}
+}
+
+// EnableAsyncInvocations makes the gateway queue async requests in repo.
+// nothing is delivered until Run is called on the returned invoker
+func (g *Gateway) EnableAsyncInvocations(repo admin.InvocationRepository, cfg AsyncConfig) *AsyncInvoker {
+	a := &AsyncInvoker{
+		repo:    repo,
+		gateway: g,
+		cfg:     cfg,
+		wake:    make(chan struct{}, 1),
+	}
+	g.async = a
+	return a
+}
+
+func isAsyncInvocation(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get(InvocationTypeHeader), "async")
+}
+
+func newInvocationID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// enqueue stores r for delivery to version of svc and answers with 202 and the invocation ID
+func (a *AsyncInvoker) enqueue(w http.ResponseWriter, r *http.Request, svc *admin.ServiceDefinition, version uint) {
+	body, ok, err := bufferBody(r, a.cfg.MaxBodyBytes)
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("Failed to read request body")
+		writeError(w, r, &Error{Status: http.StatusBadRequest, Code: CodeBadRequest, Message: "failed to read request body"})
+		return
+	}
+	if !ok {
+		writeError(w, r, &Error{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    CodePayloadTooLarge,
+			Message: fmt.Sprintf("async request bodies are limited to %d bytes", a.cfg.MaxBodyBytes),
+		})
+		return
+	}
+
+	inv := &admin.Invocation{
+		InvocationID:  newInvocationID(),
+		Service:       svc.Name,
+		Host:          svc.Host,
+		Version:       version,
+		Method:        r.Method,
+		Path:          r.URL.RequestURI(),
+		Header:        datatypes.NewJSONType(storedHeader(r.Header, svc)),
+		Body:          body,
+		Status:        admin.InvocationQueued,
+		NextAttemptAt: time.Now(),
+	}
+	if err := a.repo.Create(inv); err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("Failed to queue invocation")
+		writeError(w, r, &Error{Status: http.StatusInternalServerError, Code: CodeInternal, Message: "failed to queue invocation"})
+		return
+	}
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(InvocationIDHeader, inv.InvocationID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"invocation_id": inv.InvocationID,
+		"status":        inv.Status,
+	})
+}
+
+// storedHeader is the header of an async request as it is queued. the gateway already checked
+// the credentials, they must not end up in the database
+func storedHeader(header http.Header, svc *admin.ServiceDefinition) http.Header {
+	header = header.Clone()
+	for _, h := range credentialHeaders {
+		header.Del(h)
+	}
+	if svc.Auth.APIKeyHeader != "" {
+		header.Del(svc.Auth.APIKeyHeader)
+	}
+	return header
+}
+
+// Run delivers queued invocations until ctx is done.
+// invocations a previous process was delivering when it stopped are delivered again
+func (a *AsyncInvoker) Run(ctx context.Context) {
+	if err := a.repo.RequeueRunning(); err != nil {
+		log.Error().Err(err).Msg("Failed to requeue running invocations")
+	}
+	slots := make(chan struct{}, a.cfg.Workers)
+	ticker := time.NewTicker(a.cfg.PollInterval)
+	defer ticker.Stop()
+	a.cleanup(time.Now())
+	cleanupTicker := time.NewTicker(retentionCleanupInterval)
+	defer cleanupTicker.Stop()
+	for {
+		if free := cap(slots) - len(slots); free > 0 {
+			invs, err := a.repo.ClaimDue(time.Now(), free)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to claim invocations")
+			}
+			for i := range invs {
+				slots <- struct{}{}
+				go func(inv *admin.Invocation) {
+					defer func() { <-slots }()
+					a.deliver(ctx, inv)
+				}(&invs[i])
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-a.wake:
+		case now := <-cleanupTicker.C:
+			a.cleanup(now)
+		}
+	}
+}
+
+// cleanup deletes the invocations that finished longer than the retention ago
+func (a *AsyncInvoker) cleanup(now time.Time) {
+	if a.cfg.Retention == 0 {
+		return
+	}
+	deleted, err := a.repo.DeleteFinished(now.Add(-a.cfg.Retention))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to delete finished invocations")
+		return
+	}
+	if deleted > 0 {
+		log.Debug().Int64("invocations", deleted).Msg("Deleted finished invocations")
+	}
+}
+
+// deliver makes one attempt at inv and stores the outcome.
+// a container that can't be reached or answers with a server error counts as a failed attempt
+func (a *AsyncInvoker) deliver(ctx context.Context, inv *admin.Invocation) {
+	inv.Attempts++
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.AttemptTimeout)
+	defer cancel()
+	resp, err := a.send(ctx, inv)
+	if resp != nil {
+		inv.ResponseStatus = resp.status
+		inv.ResponseHeader = datatypes.NewJSONType(resp.header)
+		inv.ResponseBody = resp.body
+		if resp.status >= 500 {
+			err = errRetryableStatus(resp.status)
+		}
+	}
+
+	now := time.Now()
+	switch {
+	case err == nil:
+		inv.Status = admin.InvocationCompleted
+		inv.LastError = ""
+		inv.CompletedAt = &now
+	case errors.Is(ctx.Err(), context.Canceled):
+		// shutting down, the attempt doesn't count
+		inv.Attempts--
+		inv.Status = admin.InvocationQueued
+	case inv.Attempts >= a.cfg.MaxAttempts:
+		inv.Status = admin.InvocationDeadLetter
+		inv.LastError = err.Error()
+		inv.CompletedAt = &now
+	default:
+		inv.Status = admin.InvocationQueued
+		inv.LastError = err.Error()
+		inv.NextAttemptAt = now.Add(backoff(a.cfg.Backoff, a.cfg.MaxBackoff, inv.Attempts))
+	}
+	metrics.GatewayAsyncInvocations.WithLabelValues(inv.Service, inv.Status).Inc()
+	log.Debug().
+		Str("invocation_id", inv.InvocationID).
+		Str("service", inv.Service).
+		Int("attempt", inv.Attempts).
+		Str("status", inv.Status).
+		Msg("delivered invocation")
+	// the outcome is stored even if ctx is done, otherwise the invocation stays running until the next start
+	if err := a.repo.Update(inv); err != nil {
+		log.Error().Err(err).Str("invocation_id", inv.InvocationID).Msg("Failed to store invocation")
+	}
+}
+
+// backoff is the wait after attempt failed, base doubled for every attempt up to max
+func backoff(base, max time.Duration, attempt int) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// send runs inv against a container of its version
+func (a *AsyncInvoker) send(ctx context.Context, inv *admin.Invocation) (*storedResponse, error) {
+	header := inv.Header.Data().Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set(InvocationIDHeader, inv.InvocationID)
+	return a.gateway.invoke(ctx, &backgroundRequest{
+		Host:    inv.Host,
+		Version: inv.Version,
+		Method:  inv.Method,
+		Path:    inv.Path,
+		Header:  header,
+		Body:    inv.Body,
+	}, a.cfg.MaxResponseBytes)
+}
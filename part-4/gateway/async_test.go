@@ -0,0 +1,169 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.sqlite3")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("Failed to open sqlite db: %s", err)
+	}
+	return db
+}
+
+func testAsyncConfig() AsyncConfig {
+	cfg := DefaultAsyncConfig()
+	cfg.MaxAttempts = 3
+	cfg.Backoff = 10 * time.Millisecond
+	cfg.PollInterval = 10 * time.Millisecond
+	return cfg
+}
+
+// invokeAsync sends an async request and returns the invocation ID from the 202
+func invokeAsync(t *testing.T, g *Gateway, body string) string {
+	req := httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(body))
+	req.Host = "test.cless.cloud"
+	req.Header.Set(InvocationTypeHeader, "async")
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	var accepted map[string]string
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &accepted))
+	assert.Equal(t, rec.Header().Get(InvocationIDHeader), accepted["invocation_id"])
+	return accepted["invocation_id"]
+}
+
+// TestAsyncInvocationRetriesAndStoresResponse tests that a failed attempt is retried
+// and the response of the successful one is kept
+func TestAsyncInvocationRetriesAndStoresResponse(t *testing.T) {
+	var calls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte(r.URL.Path + " " + string(body)))
+	}))
+	defer backend.Close()
+	g := newTestGateway(t, &fakeContainerManager{rSvc: backendService(t, backend)})
+	repo := admin.NewSqliteInvocationRepository(newTestDB(t))
+	invoker := g.EnableAsyncInvocations(repo, testAsyncConfig())
+
+	id := invokeAsync(t, g, "payload")
+	inv, err := repo.Get(id)
+	assert.NoError(t, err)
+	assert.Equal(t, admin.InvocationQueued, inv.Status)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go invoker.Run(ctx)
+	assert.Eventually(t, func() bool {
+		inv, err = repo.Get(id)
+		return err == nil && inv.Status == admin.InvocationCompleted
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, inv.Attempts)
+	assert.Equal(t, http.StatusOK, inv.ResponseStatus)
+	assert.Equal(t, "/jobs payload", string(inv.ResponseBody))
+}
+
+// TestAsyncInvocationDeadLetter tests that an invocation stops being retried after its last attempt
+func TestAsyncInvocationDeadLetter(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+	g := newTestGateway(t, &fakeContainerManager{rSvc: backendService(t, backend)})
+	repo := admin.NewSqliteInvocationRepository(newTestDB(t))
+	invoker := g.EnableAsyncInvocations(repo, testAsyncConfig())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go invoker.Run(ctx)
+	id := invokeAsync(t, g, "")
+	var inv *admin.Invocation
+	assert.Eventually(t, func() bool {
+		var err error
+		inv, err = repo.Get(id)
+		return err == nil && inv.Status == admin.InvocationDeadLetter
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 3, inv.Attempts)
+	assert.Equal(t, http.StatusInternalServerError, inv.ResponseStatus)
+	assert.NotEmpty(t, inv.LastError)
+}
+
+// TestAsyncInvocationDropsCredentials tests that the credentials of the caller are not stored with the invocation
+func TestAsyncInvocationDropsCredentials(t *testing.T) {
+	g := newTestGateway(t, &fakeContainerManager{})
+	repo := admin.NewSqliteInvocationRepository(newTestDB(t))
+	g.EnableAsyncInvocations(repo, testAsyncConfig())
+
+	req := httptest.NewRequest(http.MethodPost, "/jobs", nil)
+	req.Host = "test.cless.cloud"
+	req.Header.Set(InvocationTypeHeader, "async")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set(admin.DefaultAPIKeyHeader, "secret")
+	req.Header.Set("X-Request-Source", "batch")
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	inv, err := repo.Get(rec.Header().Get(InvocationIDHeader))
+	assert.NoError(t, err)
+	header := inv.Header.Data()
+	assert.Empty(t, header.Get("Authorization"))
+	assert.Empty(t, header.Get("Cookie"))
+	assert.Empty(t, header.Get(admin.DefaultAPIKeyHeader))
+	assert.Equal(t, "batch", header.Get("X-Request-Source"))
+}
+
+// TestAsyncInvocationRetention tests that finished invocations are deleted after the retention
+// and queued ones are kept however old they are
+func TestAsyncInvocationRetention(t *testing.T) {
+	g := newTestGateway(t, &fakeContainerManager{})
+	repo := admin.NewSqliteInvocationRepository(newTestDB(t))
+	cfg := testAsyncConfig()
+	cfg.Retention = time.Hour
+	invoker := g.EnableAsyncInvocations(repo, cfg)
+
+	old := time.Now().Add(-2 * time.Hour)
+	recent := time.Now()
+	invs := []*admin.Invocation{
+		{InvocationID: "old-completed", Status: admin.InvocationCompleted, CompletedAt: &old},
+		{InvocationID: "old-dead", Status: admin.InvocationDeadLetter, CompletedAt: &old},
+		{InvocationID: "recent-completed", Status: admin.InvocationCompleted, CompletedAt: &recent},
+		{InvocationID: "old-queued", Status: admin.InvocationQueued, NextAttemptAt: old},
+	}
+	for _, inv := range invs {
+		assert.NoError(t, repo.Create(inv))
+	}
+
+	invoker.cleanup(time.Now())
+	for id, kept := range map[string]bool{"old-completed": false, "old-dead": false, "recent-completed": true, "old-queued": true} {
+		_, err := repo.Get(id)
+		if kept {
+			assert.NoError(t, err, id)
+		} else {
+			assert.ErrorIs(t, err, admin.ErrInvocationNotFound, id)
+		}
+	}
+}
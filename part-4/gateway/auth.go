@@ -0,0 +1,390 @@
+package gateway
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// headers carrying the verified identity of the caller to the container.
+// whatever a client sends in them is dropped before the request is proxied
+const (
+	AuthMethodHeader  = "X-Cless-Auth-Method"  // api_key or jwt
+	AuthSubjectHeader = "X-Cless-Auth-Subject" // name of the api key or sub of the token
+	AuthIssuerHeader  = "X-Cless-Auth-Issuer"
+	AuthClaimsHeader  = "X-Cless-Auth-Claims" // claims of the token as JSON
+)
+
+var identityHeaders = []string{AuthMethodHeader, AuthSubjectHeader, AuthIssuerHeader, AuthClaimsHeader}
+
+// how often keys of a JWKS are fetched again
+const jwksRefreshInterval = 5 * time.Minute
+
+// a token signed by a key the set doesn't know makes the set get fetched again,
+// but not more often than this
+const jwksMinRefreshInterval = 30 * time.Second
+
+// clock skew allowed on exp and nbf
+const jwtLeeway = 30 * time.Second
+
+// algorithms tokens may be signed with, tokens with symmetric or no signatures are refused
+var jwtSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// authenticator checks callers against the auth policy of the service they call
+type authenticator struct {
+	client *http.Client // fetches JWKS urls
+	mutex  sync.Mutex
+	sets   map[string]*keySet // by url or file
+}
+
+func newAuthenticator() *authenticator {
+	return &authenticator{
+		client: &http.Client{Timeout: 10 * time.Second},
+		sets:   make(map[string]*keySet),
+	}
+}
+
+// keySet holds the public keys of a JWKS by key id
+type keySet struct {
+	mutex   sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time // last successful load
+	tried   time.Time // last load, successful or not
+}
+
+// authenticate enforces the auth policy of svc. on success the identity of the caller is set
+// on the request, otherwise a 401 or 403 is written and false returned
+func (g *Gateway) authenticate(w http.ResponseWriter, r *http.Request, svc *admin.ServiceDefinition) bool {
+	for _, h := range identityHeaders {
+		r.Header.Del(h)
+	}
+	var gErr *Error
+	switch svc.Auth.Mode {
+	case admin.AuthNone:
+		return true
+	case admin.AuthAPIKey:
+		gErr = authenticateAPIKey(r, svc)
+	case admin.AuthJWT:
+		gErr = g.auth.authenticateJWT(r, svc)
+	default:
+		gErr = &Error{Status: http.StatusForbidden, Code: CodeForbidden, Message: "unknown auth mode"}
+	}
+	if gErr == nil {
+		return true
+	}
+	if gErr.Status == http.StatusUnauthorized && svc.Auth.Mode == admin.AuthJWT {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q, error="invalid_token"`, svc.Name))
+	} else if gErr.Status == http.StatusForbidden && svc.Auth.Mode == admin.AuthJWT {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q, error="insufficient_scope"`, svc.Name))
+	}
+	zerolog.Ctx(r.Context()).Debug().Str("service", svc.Name).Str("reason", gErr.Message).Msg("Refused request")
+	writeError(w, r, gErr)
+	return false
+}
+
+// authenticateAPIKey looks the key of the request up among the keys of the service.
+// the key is removed from the request, the service only learns the name of the key
+func authenticateAPIKey(r *http.Request, svc *admin.ServiceDefinition) *Error {
+	header := svc.Auth.APIKeyHeader
+	if header == "" {
+		header = admin.DefaultAPIKeyHeader
+	}
+	secret := r.Header.Get(header)
+	if secret == "" {
+		return &Error{Status: http.StatusUnauthorized, Code: CodeUnauthorized, Message: "missing api key in " + header}
+	}
+	r.Header.Del(header)
+	hash := []byte(admin.HashAPIKey(secret))
+	for i := range svc.APIKeys {
+		key := &svc.APIKeys[i]
+		if subtle.ConstantTimeCompare(hash, []byte(key.Hash)) == 1 {
+			r.Header.Set(AuthMethodHeader, admin.AuthAPIKey)
+			r.Header.Set(AuthSubjectHeader, key.Name)
+			return nil
+		}
+	}
+	return &Error{Status: http.StatusUnauthorized, Code: CodeUnauthorized, Message: "invalid api key"}
+}
+
+// authenticateJWT verifies the bearer token of the request. a bad, expired or foreign token gets
+// a 401, a valid token without the required claims a 403
+func (a *authenticator) authenticateJWT(r *http.Request, svc *admin.ServiceDefinition) *Error {
+	policy := &svc.Auth
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return &Error{Status: http.StatusUnauthorized, Code: CodeUnauthorized, Message: "missing bearer token"}
+	}
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(jwtSigningMethods),
+		jwt.WithLeeway(jwtLeeway),
+		jwt.WithExpirationRequired(),
+	}
+	if policy.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(policy.Issuer))
+	}
+	if policy.Audience != "" {
+		opts = append(opts, jwt.WithAudience(policy.Audience))
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(strings.TrimSpace(token), claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return a.key(r.Context(), policy, kid)
+	}, opts...)
+	if err != nil {
+		return &Error{Status: http.StatusUnauthorized, Code: CodeUnauthorized, Message: "invalid token: " + tokenErrorReason(err)}
+	}
+	for name, want := range policy.RequiredClaims.Data() {
+		if !hasClaim(claims, name, want) {
+			return &Error{Status: http.StatusForbidden, Code: CodeForbidden, Message: "token lacks claim " + name}
+		}
+	}
+
+	r.Header.Set(AuthMethodHeader, admin.AuthJWT)
+	if sub, err := claims.GetSubject(); err == nil && sub != "" {
+		r.Header.Set(AuthSubjectHeader, sub)
+	}
+	if iss, err := claims.GetIssuer(); err == nil && iss != "" {
+		r.Header.Set(AuthIssuerHeader, iss)
+	}
+	if b, err := json.Marshal(claims); err == nil {
+		r.Header.Set(AuthClaimsHeader, string(b))
+	}
+	return nil
+}
+
+// tokenErrorReason keeps the message to the client short and free of key details
+func tokenErrorReason(err error) string {
+	for _, known := range []error{
+		jwt.ErrTokenExpired,
+		jwt.ErrTokenNotValidYet,
+		jwt.ErrTokenInvalidIssuer,
+		jwt.ErrTokenInvalidAudience,
+		jwt.ErrTokenRequiredClaimMissing,
+		jwt.ErrTokenSignatureInvalid,
+		jwt.ErrTokenMalformed,
+	} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	return "token could not be verified"
+}
+
+// hasClaim reports whether claim name has the value want. space separated strings like scope
+// and arrays match when they contain want
+func hasClaim(claims jwt.MapClaims, name string, want string) bool {
+	switch v := claims[name].(type) {
+	case nil:
+		return false
+	case string:
+		if v == want {
+			return true
+		}
+		for _, field := range strings.Fields(v) {
+			if field == want {
+				return true
+			}
+		}
+		return false
+	case []interface{}:
+		for _, e := range v {
+			if fmt.Sprint(e) == want {
+				return true
+			}
+		}
+		return false
+	default:
+		return fmt.Sprint(v) == want
+	}
+}
+
+// key returns the public key with id kid from the JWKS of policy, loading the set if it is
+// stale or doesn't know kid yet. an empty kid matches the only key of a set with one key
+func (a *authenticator) key(ctx context.Context, policy *admin.AuthPolicy, kid string) (crypto.PublicKey, error) {
+	source := policy.JWKSFile
+	if policy.JWKSURL != "" {
+		source = policy.JWKSURL
+	}
+	a.mutex.Lock()
+	set, ok := a.sets[source]
+	if !ok {
+		set = &keySet{}
+		a.sets[source] = set
+	}
+	a.mutex.Unlock()
+
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	now := time.Now()
+	_, known := set.lookup(kid)
+	if now.Sub(set.fetched) > jwksRefreshInterval || (!known && now.Sub(set.tried) > jwksMinRefreshInterval) {
+		set.tried = now
+		keys, err := a.load(ctx, policy)
+		if err != nil {
+			log.Error().Err(err).Str("jwks", source).Msg("Failed to load JWKS")
+		} else {
+			set.keys = keys
+			set.fetched = now
+		}
+	}
+	key, ok := set.lookup(kid)
+	if !ok {
+		return nil, fmt.Errorf("no key %q in JWKS", kid)
+	}
+	return key, nil
+}
+
+func (set *keySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(set.keys) == 1 {
+		for _, key := range set.keys {
+			return key, true
+		}
+	}
+	key, ok := set.keys[kid]
+	return key, ok
+}
+
+func (a *authenticator) load(ctx context.Context, policy *admin.AuthPolicy) (map[string]crypto.PublicKey, error) {
+	if policy.JWKSFile != "" {
+		data, err := os.ReadFile(policy.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		return parseJWKS(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, policy.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS url answered %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+// jwk is a public key of a JWKS as described in RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the signing keys of a JWKS by key id, keys of unknown types are skipped
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Warn().Err(err).Str("kid", k.Kid).Msg("Skipping JWKS key")
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no usable keys")
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
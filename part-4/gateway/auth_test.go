@@ -0,0 +1,192 @@
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/datatypes"
+)
+
+// identityBackend answers with the identity headers it got
+func identityBackend(t *testing.T) *httptest.Server {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"method":  r.Header.Get(AuthMethodHeader),
+			"subject": r.Header.Get(AuthSubjectHeader),
+			"issuer":  r.Header.Get(AuthIssuerHeader),
+			"api_key": r.Header.Get(admin.DefaultAPIKeyHeader),
+		})
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func authGet(g *Gateway, header http.Header) (*httptest.ResponseRecorder, map[string]string) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "test.cless.cloud"
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+	var body map[string]string
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	return rec, body
+}
+
+// TestAPIKeyAuth tests that only keys created for the service get through and that
+// the service learns the key name instead of the key
+func TestAPIKeyAuth(t *testing.T) {
+	g := newTestGateway(t, &fakeContainerManager{rSvc: backendService(t, identityBackend(t))})
+	sDef, _ := g.sDefManager.GetServiceDefinitionByName("test")
+	assert.NoError(t, g.sDefManager.SetAuthPolicy(sDef, admin.AuthPolicy{Mode: admin.AuthAPIKey}))
+	secret, key, err := g.sDefManager.CreateAPIKey(sDef, "reporting")
+	assert.NoError(t, err)
+	assert.NotEqual(t, secret, key.Hash)
+
+	rec, body := authGet(g, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, CodeUnauthorized, body["code"])
+
+	rec, _ = authGet(g, http.Header{"X-Api-Key": {"cless_guess"}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec, body = authGet(g, http.Header{"X-Api-Key": {secret}, AuthSubjectHeader: {"admin"}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, map[string]string{"method": "api_key", "subject": "reporting", "issuer": "", "api_key": ""}, body)
+
+	assert.NoError(t, g.sDefManager.DeleteAPIKey(sDef, key.ID))
+	rec, _ = authGet(g, http.Header{"X-Api-Key": {secret}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+// TestJWTAuth tests token validation against a JWKS served over http
+func TestJWTAuth(t *testing.T) {
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwksFor(signingKey, "key-1"))
+	}))
+	defer jwks.Close()
+
+	g := newTestGateway(t, &fakeContainerManager{rSvc: backendService(t, identityBackend(t))})
+	sDef, _ := g.sDefManager.GetServiceDefinitionByName("test")
+	assert.NoError(t, g.sDefManager.SetAuthPolicy(sDef, admin.AuthPolicy{
+		Mode:           admin.AuthJWT,
+		JWKSURL:        jwks.URL,
+		Issuer:         "https://auth.example.com",
+		Audience:       "cless",
+		RequiredClaims: datatypes.NewJSONType(map[string]string{"scope": "reports:read"}),
+	}))
+
+	valid := jwt.MapClaims{
+		"iss":   "https://auth.example.com",
+		"aud":   "cless",
+		"sub":   "user-1",
+		"scope": "profile reports:read",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+	with := func(changes jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		for k, v := range changes {
+			claims[k] = v
+		}
+		return claims
+	}
+	sign := func(claims jwt.MapClaims) http.Header {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["kid"] = "key-1"
+		signed, err := token.SignedString(signingKey)
+		assert.NoError(t, err)
+		return http.Header{"Authorization": {"Bearer " + signed}}
+	}
+
+	rec, body := authGet(g, sign(valid))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "jwt", body["method"])
+	assert.Equal(t, "user-1", body["subject"])
+	assert.Equal(t, "https://auth.example.com", body["issuer"])
+
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"no token", nil, http.StatusUnauthorized},
+		{"expired", sign(with(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()})), http.StatusUnauthorized},
+		{"wrong issuer", sign(with(jwt.MapClaims{"iss": "https://evil.example.com"})), http.StatusUnauthorized},
+		{"wrong audience", sign(with(jwt.MapClaims{"aud": "other"})), http.StatusUnauthorized},
+		{"missing claim", sign(with(jwt.MapClaims{"scope": "profile"})), http.StatusForbidden},
+		{"symmetric", func() http.Header {
+			signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, valid).SignedString([]byte("secret"))
+			return http.Header{"Authorization": {"Bearer " + signed}}
+		}(), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, _ := authGet(g, tt.header)
+			assert.Equal(t, tt.status, rec.Code)
+			assert.Contains(t, rec.Header().Get("WWW-Authenticate"), `Bearer realm="test"`)
+		})
+	}
+}
+
+// TestJWTAuthFromFile tests that keys without a kid are found in a JWKS file
+func TestJWTAuthFromFile(t *testing.T) {
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(file, jwksFor(signingKey, ""), 0o600))
+
+	g := newTestGateway(t, &fakeContainerManager{rSvc: backendService(t, identityBackend(t))})
+	sDef, _ := g.sDefManager.GetServiceDefinitionByName("test")
+	assert.NoError(t, g.sDefManager.SetAuthPolicy(sDef, admin.AuthPolicy{Mode: admin.AuthJWT, JWKSFile: file}))
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"sub": "job-runner",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}).SignedString(signingKey)
+	assert.NoError(t, err)
+	rec, body := authGet(g, http.Header{"Authorization": {"Bearer " + signed}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "job-runner", body["subject"])
+}
+
+func TestAuthPolicyValidation(t *testing.T) {
+	g := newTestGateway(t, &fakeContainerManager{})
+	sDef, _ := g.sDefManager.GetServiceDefinitionByName("test")
+	assert.Error(t, g.sDefManager.SetAuthPolicy(sDef, admin.AuthPolicy{Mode: admin.AuthJWT}))
+	assert.Error(t, g.sDefManager.SetAuthPolicy(sDef, admin.AuthPolicy{Mode: admin.AuthJWT, JWKSURL: "ftp://keys"}))
+	assert.Error(t, g.sDefManager.SetAuthPolicy(sDef, admin.AuthPolicy{Mode: "basic"}))
+	assert.NoError(t, g.sDefManager.SetAuthPolicy(sDef, admin.AuthPolicy{Mode: admin.AuthAPIKey}))
+	assert.Equal(t, admin.DefaultAPIKeyHeader, sDef.Auth.APIKeyHeader)
+}
+
+func jwksFor(key *ecdsa.PrivateKey, kid string) []byte {
+	b, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "EC",
+			"kid": kid,
+			"use": "sig",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}},
+	})
+	return b
+}
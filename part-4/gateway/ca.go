@@ -0,0 +1,179 @@
+package gateway
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long certificates minted by the internal CA are valid, they are re-minted
+// in memory once less than a third of that is left
+const mintedCertValidity = 90 * 24 * time.Hour
+
+// most minted certificates kept in memory, one is dropped to make room for the next
+const maxMintedCerts = 1024
+
+// CertificateAuthority is a locally generated CA that mints certificates
+// for hosts under its domain, e.g. app-1.cless.cloud for cless.cloud
+type CertificateAuthority struct {
+	domain string
+	cert   *x509.Certificate
+	key    crypto.Signer
+	mutex  sync.Mutex
+	minted map[string]*tls.Certificate
+}
+
+// LoadOrCreateCA reads the CA from certFile and keyFile, generating and writing
+// a new one if the files don't exist yet
+func LoadOrCreateCA(certFile, keyFile, domain string) (*CertificateAuthority, error) {
+	ca := &CertificateAuthority{
+		domain: strings.ToLower(domain),
+		minted: make(map[string]*tls.Certificate),
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return ca, ca.generate(certFile, keyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ca.cert, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA private key can't sign")
+	}
+	ca.key = signer
+	return ca, nil
+}
+
+func (ca *CertificateAuthority) generate(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "cless internal CA", Organization: []string{"cless"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		PermittedDNSDomains:   []string{ca.domain},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return err
+	}
+	ca.cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	ca.key = key
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// Covers reports whether the CA is allowed to mint a certificate for host
+func (ca *CertificateAuthority) Covers(host string) bool {
+	return strings.HasSuffix(host, "."+ca.domain)
+}
+
+// CertificateFor returns a certificate for host signed by the CA, minting it on first use.
+// callers decide which hosts get one, the CA only checks the domain
+func (ca *CertificateAuthority) CertificateFor(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+	if !ca.Covers(host) {
+		return nil, fmt.Errorf("host %s is not under %s", host, ca.domain)
+	}
+	if cert := ca.cached(host); cert != nil {
+		return cert, nil
+	}
+
+	// minting happens outside of the lock so handshakes for other hosts don't wait on it,
+	// two handshakes racing for the same host both mint and the later one is kept
+	cert, err := ca.mint(host)
+	if err != nil {
+		return nil, err
+	}
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	if _, ok := ca.minted[host]; !ok && len(ca.minted) >= maxMintedCerts {
+		for evicted := range ca.minted {
+			delete(ca.minted, evicted)
+			break
+		}
+	}
+	ca.minted[host] = cert
+	return cert, nil
+}
+
+// cached returns the minted certificate of host unless it is due to be re-minted
+func (ca *CertificateAuthority) cached(host string) *tls.Certificate {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	if cert, ok := ca.minted[host]; ok && time.Until(cert.Leaf.NotAfter) > mintedCertValidity/3 {
+		return cert
+	}
+	return nil
+}
+
+func (ca *CertificateAuthority) mint(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(mintedCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
@@ -0,0 +1,471 @@
+package gateway
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"codereliant.io/cless/metrics"
+	"codereliant.io/cless/tracecontext"
+)
+
+// header that tells the client whether the response came from the cache
+const CacheStatusHeader = "X-Cless-Cache"
+
+// headers the gateway sets on every response for that request alone, a cached entry
+// must not hand them to the requests it answers later
+var perRequestHeaders = []string{
+	tracecontext.RequestIDHeader,
+	CacheStatusHeader,
+	"RateLimit-Limit",
+	"RateLimit-Remaining",
+	"RateLimit-Reset",
+}
+
+// a single response may take at most this share of a service's cache,
+// so one large body can't push out everything else
+const cacheEntryShare = 4
+
+// statuses that may be stored when the response carries an explicit lifetime
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// responseCache holds the cached responses of all services, every service has its own size budget.
+// cache hits never reach the container manager, so they don't keep idle containers alive
+type responseCache struct {
+	mutex    sync.Mutex
+	services map[string]*serviceCache
+}
+
+// serviceCache is an LRU of the responses of one service
+type serviceCache struct {
+	maxBytes int64
+	size     int64
+	vary     map[string]*varyInfo     // by primary key
+	entries  map[string]*list.Element // by primary key and the values of the vary headers
+	lru      *list.List               // of *cacheEntry, most recently used in front
+}
+
+// varyInfo keeps the headers the responses for a url vary on
+type varyInfo struct {
+	headers  []string
+	variants int
+}
+
+type cacheEntry struct {
+	key     string
+	primary string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time // when the response was generated, its Age taken into account
+	expires time.Time
+	size    int64
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{services: make(map[string]*serviceCache)}
+}
+
+// primaryCacheKey separates the entries of versions, hosts and urls.
+// HEAD requests are answered from the entries of GET requests
+func primaryCacheKey(r *http.Request, version uint) string {
+	return fmt.Sprintf("%d %s %s", version, r.Host, r.URL.RequestURI())
+}
+
+func variantCacheKey(primary string, vary []string, header http.Header) string {
+	var b strings.Builder
+	b.WriteString(primary)
+	for _, name := range vary {
+		b.WriteByte(0)
+		b.WriteString(strings.Join(header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// get returns the fresh entry for the request, nil if there is none
+func (c *responseCache) get(service string, primary string, r *http.Request) *cacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	sc, ok := c.services[service]
+	if !ok {
+		return nil
+	}
+	vi, ok := sc.vary[primary]
+	if !ok {
+		return nil
+	}
+	el, ok := sc.entries[variantCacheKey(primary, vi.headers, r.Header)]
+	if !ok {
+		return nil
+	}
+	entry := el.Value.(*cacheEntry)
+	if !time.Now().Before(entry.expires) {
+		sc.remove(el)
+		return nil
+	}
+	sc.lru.MoveToFront(el)
+	return entry
+}
+
+// put stores entry, evicting the least recently used entries of the service to make room
+func (c *responseCache) put(service string, maxBytes int64, entry *cacheEntry, vary []string) {
+	if entry.size > maxBytes/cacheEntryShare {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	sc, ok := c.services[service]
+	if !ok || sc.maxBytes != maxBytes {
+		sc = &serviceCache{
+			maxBytes: maxBytes,
+			vary:     make(map[string]*varyInfo),
+			entries:  make(map[string]*list.Element),
+			lru:      list.New(),
+		}
+		c.services[service] = sc
+	}
+	if vi, ok := sc.vary[entry.primary]; ok && !equalHeaderNames(vi.headers, vary) {
+		// the response changed what it varies on, the old variants can't be found anymore
+		sc.removePrimary(entry.primary)
+	}
+	if el, ok := sc.entries[entry.key]; ok {
+		sc.remove(el)
+	}
+	for sc.size+entry.size > sc.maxBytes && sc.lru.Len() > 0 {
+		sc.remove(sc.lru.Back())
+	}
+	vi, ok := sc.vary[entry.primary]
+	if !ok {
+		vi = &varyInfo{headers: vary}
+		sc.vary[entry.primary] = vi
+	}
+	vi.variants++
+	sc.entries[entry.key] = sc.lru.PushFront(entry)
+	sc.size += entry.size
+}
+
+// purge drops all entries of a service
+func (c *responseCache) purge(service string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.services, service)
+}
+
+func (sc *serviceCache) remove(el *list.Element) {
+	entry := sc.lru.Remove(el).(*cacheEntry)
+	delete(sc.entries, entry.key)
+	sc.size -= entry.size
+	if vi, ok := sc.vary[entry.primary]; ok {
+		vi.variants--
+		if vi.variants <= 0 {
+			delete(sc.vary, entry.primary)
+		}
+	}
+}
+
+func (sc *serviceCache) removePrimary(primary string) {
+	for el := sc.lru.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*cacheEntry).primary == primary {
+			sc.remove(el)
+		}
+		el = next
+	}
+	delete(sc.vary, primary)
+}
+
+func equalHeaderNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCacheControl returns the directives of the Cache-Control headers in lower case with their values
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, line := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name == "" {
+				continue
+			}
+			directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return directives
+}
+
+// cacheUse is what a request allows the cache to do
+type cacheUse int
+
+const (
+	cacheBypass cacheUse = iota // neither answered from nor stored in the cache
+	cacheStore                  // not answered from the cache, the response may be stored
+	cacheLookup                 // answered from the cache if possible
+)
+
+// requestCacheUse decides how the cache may handle a request. requests with credentials are
+// left alone, the cache is shared by all clients of a service
+func requestCacheUse(r *http.Request) cacheUse {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return cacheBypass
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Range") != "" {
+		return cacheBypass
+	}
+	directives := parseCacheControl(r.Header)
+	if _, ok := directives["no-store"]; ok {
+		return cacheBypass
+	}
+	if _, ok := directives["no-cache"]; ok || directives["max-age"] == "0" || r.Header.Get("Pragma") == "no-cache" {
+		return cacheStore
+	}
+	return cacheLookup
+}
+
+// responseTTL returns how long a response may be served from the cache, 0 if it may not be stored
+func responseTTL(status int, header http.Header, maxTTL time.Duration) time.Duration {
+	if !cacheableStatus[status] {
+		return 0
+	}
+	directives := parseCacheControl(header)
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[d]; ok {
+			return 0
+		}
+	}
+	var ttl time.Duration
+	if v, ok := directives["s-maxage"]; ok {
+		ttl = parseSeconds(v)
+	} else if v, ok := directives["max-age"]; ok {
+		ttl = parseSeconds(v)
+	} else if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		ttl = expires.Sub(date)
+	}
+	ttl -= parseSeconds(header.Get("Age"))
+	if maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+func parseSeconds(v string) time.Duration {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// sharedWithAuthentication reports whether a response to an authenticated request may be served
+// to other callers, which takes public or s-maxage
+func sharedWithAuthentication(header http.Header) bool {
+	directives := parseCacheControl(header)
+	_, public := directives["public"]
+	_, sMaxAge := directives["s-maxage"]
+	return public || sMaxAge
+}
+
+// varyHeaders returns the canonical names of the headers a response varies on,
+// ok is false for Vary: * which can't be cached
+func varyHeaders(header http.Header) (names []string, ok bool) {
+	for _, line := range header.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names, true
+}
+
+// etagMatches reports whether the If-None-Match header of a request matches etag, by weak comparison
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheRecorder passes a response through to the client and keeps a copy for the cache
+// as long as the body stays under limit
+type cacheRecorder struct {
+	http.ResponseWriter
+	status  int
+	header  http.Header // taken when the status is written
+	body    bytes.Buffer
+	limit   int64
+	tooBig  bool
+	cookies int // Set-Cookie headers the gateway added itself, e.g. sticky sessions
+	// the caller was authenticated, the response is only shared with other callers
+	// when it says so (RFC 9111 section 3.5)
+	authenticated bool
+}
+
+func (cr *cacheRecorder) WriteHeader(code int) {
+	if cr.status == 0 && code >= 200 {
+		cr.status = code
+		cr.header = cr.ResponseWriter.Header().Clone()
+	}
+	cr.ResponseWriter.WriteHeader(code)
+}
+
+func (cr *cacheRecorder) Write(p []byte) (int, error) {
+	if cr.status == 0 {
+		cr.WriteHeader(http.StatusOK)
+	}
+	if !cr.tooBig {
+		if int64(cr.body.Len()+len(p)) > cr.limit {
+			cr.tooBig = true
+			cr.body = bytes.Buffer{}
+		} else {
+			cr.body.Write(p)
+		}
+	}
+	return cr.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (cr *cacheRecorder) Unwrap() http.ResponseWriter {
+	return cr.ResponseWriter
+}
+
+// entry turns the recorded response into a cache entry, nil if it may not be stored
+func (cr *cacheRecorder) entry(primary string, r *http.Request, maxTTL time.Duration) (*cacheEntry, []string) {
+	if cr.status == 0 || cr.tooBig {
+		return nil, nil
+	}
+	// responses that set cookies of the service are meant for one client only
+	if len(cr.header.Values("Set-Cookie")) > cr.cookies {
+		return nil, nil
+	}
+	if cr.authenticated && !sharedWithAuthentication(cr.header) {
+		return nil, nil
+	}
+	ttl := responseTTL(cr.status, cr.header, maxTTL)
+	if ttl == 0 {
+		return nil, nil
+	}
+	vary, ok := varyHeaders(cr.header)
+	if !ok {
+		return nil, nil
+	}
+	header := cr.header.Clone()
+	header.Del("Set-Cookie")
+	header.Del("Age")
+	for _, h := range perRequestHeaders {
+		header.Del(h)
+	}
+	now := time.Now()
+	stored := now.Add(-parseSeconds(cr.header.Get("Age")))
+	size := int64(cr.body.Len() + len(primary))
+	for name, values := range header {
+		size += int64(len(name))
+		for _, v := range values {
+			size += int64(len(v))
+		}
+	}
+	return &cacheEntry{
+		key:     variantCacheKey(primary, vary, r.Header),
+		primary: primary,
+		status:  cr.status,
+		header:  header,
+		body:    cr.body.Bytes(),
+		stored:  stored,
+		expires: now.Add(ttl),
+		size:    size,
+	}, vary
+}
+
+// serveCacheable answers a request of a service with a response cache, from the cache if it
+// holds a fresh response, otherwise from the container, keeping the response if it allows that
+func (g *Gateway) serveCacheable(w http.ResponseWriter, r *http.Request, svc *admin.ServiceDefinition, version uint) {
+	use := requestCacheUse(r)
+	if use == cacheBypass {
+		g.forward(w, r, svc, version)
+		return
+	}
+	primary := primaryCacheKey(r, version)
+	if use == cacheLookup {
+		if entry := g.cache.get(svc.Name, primary, r); entry != nil {
+			metrics.GatewayCache.WithLabelValues(svc.Name, "hit").Inc()
+			writeCached(w, r, entry)
+			return
+		}
+	}
+	metrics.GatewayCache.WithLabelValues(svc.Name, "miss").Inc()
+	w.Header().Set(CacheStatusHeader, "miss")
+	if r.Method == http.MethodHead {
+		// the body of a HEAD response is empty, there is nothing to keep
+		g.forward(w, r, svc, version)
+		return
+	}
+	rec := &cacheRecorder{
+		ResponseWriter: w,
+		limit:          svc.Cache.MaxBytes / cacheEntryShare,
+		cookies:        len(w.Header().Values("Set-Cookie")),
+		authenticated:  svc.Auth.Mode != admin.AuthNone,
+	}
+	g.forward(rec, r, svc, version)
+	maxTTL := time.Duration(svc.Cache.MaxTTLSeconds) * time.Second
+	if entry, vary := rec.entry(primary, r, maxTTL); entry != nil {
+		g.cache.put(svc.Name, svc.Cache.MaxBytes, entry, vary)
+	}
+}
+
+// writeCached answers a request with a cached response, or 304 when the client already has it
+func writeCached(w http.ResponseWriter, r *http.Request, entry *cacheEntry) {
+	header := w.Header()
+	for name, values := range entry.header {
+		header[name] = append([]string(nil), values...)
+	}
+	header.Set("Age", strconv.FormatInt(int64(time.Since(entry.stored).Seconds()), 10))
+	header.Set(CacheStatusHeader, "hit")
+	if etagMatches(r.Header.Get("If-None-Match"), entry.header.Get("ETag")) {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(entry.status)
+	if r.Method != http.MethodHead {
+		w.Write(entry.body)
+	}
+}
@@ -0,0 +1,216 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"codereliant.io/cless/container"
+	"codereliant.io/cless/tracecontext"
+	"github.com/stretchr/testify/assert"
+)
+
+// cachingBackend answers with a counter in the body and the given cache headers
+func cachingBackend(t *testing.T, header http.Header) (*httptest.Server, *atomic.Int32) {
+	calls := &atomic.Int32{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		fmt.Fprintf(w, "%s %d", r.Header.Get("Accept-Language"), n)
+	}))
+	t.Cleanup(backend.Close)
+	return backend, calls
+}
+
+func cachedGet(g *Gateway, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/data?page=1", nil)
+	req.Host = "test.cless.cloud"
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+	return rec
+}
+
+func enableCache(t *testing.T, g *Gateway, policy admin.CachePolicy) *admin.ServiceDefinition {
+	sDef, _ := g.sDefManager.GetServiceDefinitionByName("test")
+	assert.NoError(t, g.sDefManager.SetCachePolicy(sDef, policy))
+	return sDef
+}
+
+// TestCacheHitSkipsContainer tests that a cached response is served without looking up a container,
+// and that a matching If-None-Match gets a 304
+func TestCacheHitSkipsContainer(t *testing.T) {
+	backend, calls := cachingBackend(t, http.Header{"Cache-Control": {"public, max-age=60"}, "Etag": {`"v1"`}})
+	cm := &countingContainerManager{fakeContainerManager: fakeContainerManager{rSvc: backendService(t, backend)}}
+	g := newTestGateway(t, cm)
+	enableCache(t, g, admin.CachePolicy{Enabled: true, MaxBytes: 1 << 20})
+
+	rec := cachedGet(g, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "miss", rec.Header().Get(CacheStatusHeader))
+	assert.Equal(t, " 1", rec.Body.String())
+
+	rec = cachedGet(g, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "hit", rec.Header().Get(CacheStatusHeader))
+	assert.Equal(t, " 1", rec.Body.String())
+	assert.Equal(t, `"v1"`, rec.Header().Get("ETag"))
+	assert.NotEmpty(t, rec.Header().Get("Age"))
+
+	rec = cachedGet(g, http.Header{"If-None-Match": {`W/"v1"`}})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.String())
+
+	rec = cachedGet(g, http.Header{"Cache-Control": {"no-cache"}})
+	assert.Equal(t, "miss", rec.Header().Get(CacheStatusHeader))
+	assert.Equal(t, int32(2), calls.Load())
+	assert.Equal(t, int32(2), cm.lookups.Load())
+}
+
+// TestCacheHitKeepsRequestID tests that a cache hit answers with its own request id
+// instead of the one of the request that filled the cache
+func TestCacheHitKeepsRequestID(t *testing.T) {
+	backend, _ := cachingBackend(t, http.Header{"Cache-Control": {"public, max-age=60"}})
+	g := newTestGateway(t, &fakeContainerManager{rSvc: backendService(t, backend)})
+	enableCache(t, g, admin.CachePolicy{Enabled: true, MaxBytes: 1 << 20})
+
+	header := http.Header{}
+	header.Set(tracecontext.RequestIDHeader, "req-1")
+	rec := cachedGet(g, header)
+	assert.Equal(t, "miss", rec.Header().Get(CacheStatusHeader))
+	assert.Equal(t, []string{"req-1"}, rec.Header().Values(tracecontext.RequestIDHeader))
+
+	header.Set(tracecontext.RequestIDHeader, "req-2")
+	rec = cachedGet(g, header)
+	assert.Equal(t, "hit", rec.Header().Get(CacheStatusHeader))
+	assert.Equal(t, []string{"req-2"}, rec.Header().Values(tracecontext.RequestIDHeader))
+}
+
+// TestCacheHonoursResponseHeaders tests that responses which don't allow shared caching are not stored
+func TestCacheHonoursResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{"no lifetime", http.Header{}},
+		{"no-store", http.Header{"Cache-Control": {"no-store, max-age=60"}}},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}},
+		{"sets cookie", http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=1"}}},
+		{"vary star", http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, calls := cachingBackend(t, tt.header)
+			g := newTestGateway(t, &fakeContainerManager{rSvc: backendService(t, backend)})
+			enableCache(t, g, admin.CachePolicy{Enabled: true, MaxBytes: 1 << 20})
+			cachedGet(g, nil)
+			rec := cachedGet(g, nil)
+			assert.Equal(t, "miss", rec.Header().Get(CacheStatusHeader))
+			assert.Equal(t, int32(2), calls.Load())
+		})
+	}
+}
+
+// TestCacheVaryAndSizeLimit tests that variants are kept apart and responses over the size limit are not stored
+func TestCacheVaryAndSizeLimit(t *testing.T) {
+	backend, calls := cachingBackend(t, http.Header{"Cache-Control": {"s-maxage=60"}, "Vary": {"accept-language"}})
+	g := newTestGateway(t, &fakeContainerManager{rSvc: backendService(t, backend)})
+	sDef := enableCache(t, g, admin.CachePolicy{Enabled: true, MaxBytes: 1 << 20})
+
+	assert.Equal(t, "en 1", cachedGet(g, http.Header{"Accept-Language": {"en"}}).Body.String())
+	assert.Equal(t, "de 2", cachedGet(g, http.Header{"Accept-Language": {"de"}}).Body.String())
+	assert.Equal(t, "en 1", cachedGet(g, http.Header{"Accept-Language": {"en"}}).Body.String())
+	assert.Equal(t, "de 2", cachedGet(g, http.Header{"Accept-Language": {"de"}}).Body.String())
+
+	g.sDefManager.PurgeCache(sDef)
+	assert.Equal(t, "en 3", cachedGet(g, http.Header{"Accept-Language": {"en"}}).Body.String())
+
+	// a quarter of 64 bytes is too little for any response
+	enableCache(t, g, admin.CachePolicy{Enabled: true, MaxBytes: 64})
+	cachedGet(g, nil)
+	assert.Equal(t, "miss", cachedGet(g, nil).Header().Get(CacheStatusHeader))
+	assert.Equal(t, int32(5), calls.Load())
+}
+
+// TestCacheSeparatesVersions tests that a new version doesn't get the responses of the old one
+func TestCacheSeparatesVersions(t *testing.T) {
+	oldBackend, _ := cachingBackend(t, http.Header{"Cache-Control": {"max-age=60"}})
+	newBackend, _ := cachingBackend(t, http.Header{"Cache-Control": {"max-age=60"}})
+	cm := &versionContainerManager{byVersion: make(map[uint]*container.RunningService)}
+	g := newTestGateway(t, cm)
+	sDef := enableCache(t, g, admin.CachePolicy{Enabled: true, MaxBytes: 1 << 20})
+	assert.NoError(t, g.sDefManager.AddVersion(sDef, &admin.ServiceVersion{ImageName: "test", ImageTag: "next", Port: 8080}))
+	oldVersion, newVersion := sDef.Versions[0].ID, sDef.Versions[1].ID
+	cm.byVersion[oldVersion] = backendService(t, oldBackend)
+	cm.byVersion[newVersion] = backendService(t, newBackend)
+
+	cachedGet(g, nil)
+	assert.Equal(t, "hit", cachedGet(g, nil).Header().Get(CacheStatusHeader))
+	weight := &admin.TrafficWeight{Weights: []admin.Weight{{ServiceVersionID: newVersion, Weight: 100}}}
+	assert.NoError(t, g.sDefManager.AddTrafficWeight(sDef, weight))
+	assert.Equal(t, "miss", cachedGet(g, nil).Header().Get(CacheStatusHeader))
+}
+
+// TestCacheKeepsAPIKeysApart tests that a response fetched with one api key is not served to
+// the holder of another unless the response is marked public
+func TestCacheKeepsAPIKeysApart(t *testing.T) {
+	cacheControl := "max-age=60"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", cacheControl)
+		fmt.Fprint(w, r.Header.Get(AuthSubjectHeader))
+	}))
+	defer backend.Close()
+	g := newTestGateway(t, &fakeContainerManager{rSvc: backendService(t, backend)})
+	sDef := enableCache(t, g, admin.CachePolicy{Enabled: true, MaxBytes: 1 << 20})
+	assert.NoError(t, g.sDefManager.SetAuthPolicy(sDef, admin.AuthPolicy{Mode: admin.AuthAPIKey}))
+	secretA, _, err := g.sDefManager.CreateAPIKey(sDef, "alice")
+	assert.NoError(t, err)
+	secretB, _, err := g.sDefManager.CreateAPIKey(sDef, "bob")
+	assert.NoError(t, err)
+
+	assert.Equal(t, "alice", cachedGet(g, http.Header{admin.DefaultAPIKeyHeader: {secretA}}).Body.String())
+	rec := cachedGet(g, http.Header{admin.DefaultAPIKeyHeader: {secretB}})
+	assert.Equal(t, "bob", rec.Body.String())
+	assert.Equal(t, "miss", rec.Header().Get(CacheStatusHeader))
+
+	cacheControl = "public, max-age=60"
+	cachedGet(g, http.Header{admin.DefaultAPIKeyHeader: {secretA}})
+	rec = cachedGet(g, http.Header{admin.DefaultAPIKeyHeader: {secretB}})
+	assert.Equal(t, "hit", rec.Header().Get(CacheStatusHeader))
+	assert.Equal(t, http.StatusUnauthorized, cachedGet(g, nil).Code, "the cache is behind authentication")
+}
+
+func TestResponseTTL(t *testing.T) {
+	date := time.Now().UTC()
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		maxTTL time.Duration
+		want   time.Duration
+	}{
+		{"max-age", 200, http.Header{"Cache-Control": {"max-age=60"}}, 0, time.Minute},
+		{"s-maxage wins", 200, http.Header{"Cache-Control": {"max-age=60, s-maxage=10"}}, 0, 10 * time.Second},
+		{"capped", 200, http.Header{"Cache-Control": {"max-age=3600"}}, time.Minute, time.Minute},
+		{"age", 200, http.Header{"Cache-Control": {"max-age=60"}, "Age": {"50"}}, 0, 10 * time.Second},
+		{"expires", 200, http.Header{
+			"Date":    {date.Format(http.TimeFormat)},
+			"Expires": {date.Add(time.Hour).Format(http.TimeFormat)},
+		}, 0, time.Hour},
+		{"server error", 500, http.Header{"Cache-Control": {"max-age=60"}}, 0, 0},
+		{"no-cache", 200, http.Header{"Cache-Control": {"no-cache"}}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, responseTTL(tt.status, tt.header, tt.maxTTL))
+		})
+	}
+}
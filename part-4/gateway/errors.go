@@ -0,0 +1,81 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"codereliant.io/cless/container"
+	"github.com/rs/zerolog"
+)
+
+// Error is the JSON body returned to clients when the gateway can't serve a request
+type Error struct {
+	Status     int           `json:"-"`
+	RetryAfter time.Duration `json:"-"`
+	Code       string        `json:"code"`
+	Message    string        `json:"message"`
+	Service    string        `json:"service,omitempty"`
+	Version    uint          `json:"version,omitempty"`
+	RequestID  string        `json:"request_id"`
+	TraceID    string        `json:"trace_id,omitempty"`
+}
+
+// error codes, one per failure class
+const (
+	CodeServiceNotFound    = "service_not_found"
+	CodeNoActiveVersion    = "no_active_version"
+	CodeBackendStarting    = "backend_starting"
+	CodeBackendTimeout     = "backend_timeout"
+	CodeBackendUnreachable = "backend_unreachable"
+	CodeNoCapacity         = "no_capacity"
+	CodeBadRequest         = "bad_request"
+	CodePayloadTooLarge    = "payload_too_large"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeRateLimited        = "rate_limited"
+	CodeTooManyInFlight    = "too_many_in_flight"
+	CodeShuttingDown       = "shutting_down"
+	CodeInternal           = "internal_error"
+)
+
+// errorFor maps an error from the routing or container layer to the response the client gets
+func errorFor(err error, retryAfter time.Duration) *Error {
+	switch {
+	case errors.Is(err, admin.ErrServiceNotFound):
+		return &Error{Status: http.StatusNotFound, Code: CodeServiceNotFound, Message: "no service is registered for this host"}
+	case errors.Is(err, admin.ErrVersionNotFound):
+		return &Error{Status: http.StatusServiceUnavailable, Code: CodeNoActiveVersion, Message: "service has no version to route to"}
+	case errors.Is(err, container.ErrContainerStarting):
+		return &Error{Status: http.StatusServiceUnavailable, Code: CodeBackendStarting, Message: "service is starting, retry later", RetryAfter: retryAfter}
+	case errors.Is(err, container.ErrContainerNotReady):
+		return &Error{Status: http.StatusGatewayTimeout, Code: CodeBackendTimeout, Message: "service did not become ready in time"}
+	case errors.Is(err, container.ErrNoPortAvailable):
+		return &Error{Status: http.StatusServiceUnavailable, Code: CodeNoCapacity, Message: "no capacity to start the service, retry later", RetryAfter: retryAfter}
+	case errors.Is(err, container.ErrShuttingDown):
+		return &Error{Status: http.StatusServiceUnavailable, Code: CodeShuttingDown, Message: "gateway is shutting down", RetryAfter: retryAfter}
+	default:
+		return &Error{Status: http.StatusInternalServerError, Code: CodeInternal, Message: "failed to get running service"}
+	}
+}
+
+// writeError fills in the request details and writes gErr as the response
+func writeError(w http.ResponseWriter, r *http.Request, gErr *Error) {
+	info := requestInfoFrom(r.Context())
+	gErr.RequestID = info.ID
+	gErr.TraceID = info.TraceID
+	gErr.Service = info.Service
+	gErr.Version = info.Version
+
+	w.Header().Set("Content-Type", "application/json")
+	if gErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(gErr.RetryAfter.Seconds())))
+	}
+	w.WriteHeader(gErr.Status)
+	if err := json.NewEncoder(w).Encode(gErr); err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("Failed to write error response")
+	}
+}
@@ -0,0 +1,208 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"codereliant.io/cless/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// EventConfig tunes how events are delivered to subscriptions
+type EventConfig struct {
+	Workers        int           `yaml:"workers" toml:"workers"`           // deliveries made at the same time
+	MaxAttempts    int           `yaml:"max_attempts" toml:"max_attempts"` // attempts before a delivery is dead lettered
+	Backoff        time.Duration `yaml:"backoff" toml:"backoff"`           // wait before the second attempt, doubled for every attempt after
+	MaxBackoff     time.Duration `yaml:"max_backoff" toml:"max_backoff"`
+	AttemptTimeout time.Duration `yaml:"attempt_timeout" toml:"attempt_timeout"` // cold start and request of one attempt
+	PollInterval   time.Duration `yaml:"poll_interval" toml:"poll_interval"`     // how often the store is checked for retries that became due
+	// how long delivered events are kept, 0 keeps them forever. dead letters are kept until redriven
+	Retention time.Duration `yaml:"retention" toml:"retention"`
+}
+
+func DefaultEventConfig() EventConfig {
+	return EventConfig{
+		Workers:        8,
+		MaxAttempts:    8,
+		Backoff:        time.Second,
+		MaxBackoff:     10 * time.Minute,
+		AttemptTimeout: 2 * time.Minute,
+		PollInterval:   time.Second,
+		Retention:      7 * 24 * time.Hour,
+	}
+}
+
+func (cfg EventConfig) Validate() error {
+	errs := validateDelivery(cfg.Workers, cfg.MaxAttempts, cfg.Backoff, cfg.MaxBackoff, cfg.AttemptTimeout, cfg.PollInterval)
+	if cfg.Retention < 0 {
+		errs = append(errs, fmt.Errorf("retention can't be negative, got %s", cfg.Retention))
+	}
+	return errors.Join(errs...)
+}
+
+// how much of a subscriber's answer is read, it is only checked for its status
+const eventMaxResponseBytes = 4 << 10
+
+// EventDispatcher delivers the events of the bus to the subscribed services as CloudEvents
+// in binary content mode. delivery is at least once, a subscriber may see an event again
+// when an attempt failed after the service received it
+type EventDispatcher struct {
+	gateway *Gateway
+	repo    admin.EventRepository
+	cfg     EventConfig
+	wake    chan struct{}
+}
+
+func NewEventDispatcher(g *Gateway, bus *admin.EventBus, cfg EventConfig) *EventDispatcher {
+	d := &EventDispatcher{
+		gateway: g,
+		repo:    bus.Repository(),
+		cfg:     cfg,
+		wake:    make(chan struct{}, 1),
+	}
+	bus.OnPublish(func() {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	})
+	return d
+}
+
+// Run delivers events until ctx is done.
+// deliveries a previous process was making when it stopped are made again
+func (d *EventDispatcher) Run(ctx context.Context) {
+	if err := d.repo.RequeueRunning(); err != nil {
+		log.Error().Err(err).Msg("Failed to requeue running event deliveries")
+	}
+	slots := make(chan struct{}, d.cfg.Workers)
+	ticker := time.NewTicker(d.cfg.PollInterval)
+	defer ticker.Stop()
+	d.cleanup(time.Now())
+	cleanupTicker := time.NewTicker(retentionCleanupInterval)
+	defer cleanupTicker.Stop()
+	for {
+		if free := cap(slots) - len(slots); free > 0 {
+			deliveries, err := d.repo.ClaimDue(time.Now(), free)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to claim event deliveries")
+			}
+			for i := range deliveries {
+				slots <- struct{}{}
+				go func(delivery *admin.EventDelivery) {
+					defer func() { <-slots }()
+					d.deliver(ctx, delivery)
+				}(&deliveries[i])
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		case now := <-cleanupTicker.C:
+			d.cleanup(now)
+		}
+	}
+}
+
+// cleanup deletes the events delivered longer than the retention ago
+func (d *EventDispatcher) cleanup(now time.Time) {
+	if d.cfg.Retention == 0 {
+		return
+	}
+	deleted, err := d.repo.DeleteDelivered(now.Add(-d.cfg.Retention))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to delete delivered events")
+		return
+	}
+	if deleted > 0 {
+		log.Debug().Int64("deliveries", deleted).Msg("Deleted delivered events")
+	}
+}
+
+// deliver makes one attempt at delivery and stores the outcome
+func (d *EventDispatcher) deliver(ctx context.Context, delivery *admin.EventDelivery) {
+	delivery.Attempts++
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.AttemptTimeout)
+	defer cancel()
+	err := d.send(ctx, delivery)
+
+	sub := &delivery.Subscription
+	switch {
+	case err == nil:
+		now := time.Now()
+		delivery.Status = admin.DeliveryDelivered
+		delivery.LastError = ""
+		delivery.DeliveredAt = &now
+	case errors.Is(ctx.Err(), context.Canceled):
+		// shutting down, the attempt doesn't count
+		delivery.Attempts--
+		delivery.Status = admin.DeliveryPending
+	case delivery.Attempts >= d.cfg.MaxAttempts || sub.ID == 0:
+		delivery.Status = admin.DeliveryDeadLetter
+		delivery.LastError = err.Error()
+	default:
+		delivery.Status = admin.DeliveryPending
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = time.Now().Add(backoff(d.cfg.Backoff, d.cfg.MaxBackoff, delivery.Attempts))
+	}
+	metrics.EventDeliveries.WithLabelValues(sub.Service, delivery.Status).Inc()
+	log.Debug().
+		Str("event_id", delivery.Event.EventID).
+		Str("topic", delivery.Event.Topic).
+		Str("service", sub.Service).
+		Int("attempt", delivery.Attempts).
+		Str("status", delivery.Status).
+		Msg("delivered event")
+	if err := d.repo.UpdateDelivery(delivery); err != nil {
+		log.Error().Err(err).Str("event_id", delivery.Event.EventID).Msg("Failed to store event delivery")
+	}
+}
+
+// send posts the event to the subscribed service, any answer but a 2xx is a failure
+func (d *EventDispatcher) send(ctx context.Context, delivery *admin.EventDelivery) error {
+	sub, event := &delivery.Subscription, &delivery.Event
+	if sub.ID == 0 {
+		return admin.ErrSubscriptionNotFound
+	}
+	svc, err := d.gateway.sDefManager.Routes().ServiceByName(sub.Service)
+	if err != nil {
+		return err
+	}
+	version := svc.ChooseVersion("")
+	if version == 0 {
+		return admin.ErrVersionNotFound
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", event.ContentType)
+	header.Set("ce-specversion", "1.0")
+	header.Set("ce-id", event.EventID)
+	header.Set("ce-source", event.Source)
+	header.Set("ce-type", event.Type)
+	header.Set("ce-time", event.Time.UTC().Format(time.RFC3339Nano))
+	header.Set("ce-topic", event.Topic)
+	if event.Subject != "" {
+		header.Set("ce-subject", event.Subject)
+	}
+	resp, err := d.gateway.invoke(ctx, &backgroundRequest{
+		Host:    svc.Host,
+		Version: version,
+		Method:  http.MethodPost,
+		Path:    sub.Path,
+		Header:  header,
+		Body:    event.Data,
+	}, eventMaxResponseBytes)
+	if err != nil {
+		return err
+	}
+	if resp.status < 200 || resp.status > 299 {
+		return fmt.Errorf("subscriber answered %d", resp.status)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package gateway
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func testEventConfig() EventConfig {
+	cfg := DefaultEventConfig()
+	cfg.MaxAttempts = 2
+	cfg.Backoff = 10 * time.Millisecond
+	cfg.PollInterval = 10 * time.Millisecond
+	return cfg
+}
+
+// TestEventDeliveredAsCloudEvent tests that a published event reaches the subscriber
+// as a binary mode CloudEvent, after a failed first attempt
+func TestEventDeliveredAsCloudEvent(t *testing.T) {
+	var calls atomic.Int32
+	received := make(chan *http.Request, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		r.Header.Set("X-Test-Body", string(body))
+		received <- r
+	}))
+	defer backend.Close()
+	g := newTestGateway(t, &fakeContainerManager{rSvc: backendService(t, backend)})
+	bus := admin.NewEventBus(admin.NewSqliteEventRepository(newTestDB(t)), g.sDefManager)
+	d := NewEventDispatcher(g, bus, testEventConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	assert.NoError(t, bus.Subscribe(&admin.Subscription{Topic: "orders", Service: "test", Path: "/hooks/orders"}))
+	event := &admin.Event{Topic: "orders", Type: "com.example.order.created", Data: []byte(`{"id":1}`)}
+	assert.NoError(t, bus.Publish(event))
+
+	select {
+	case r := <-received:
+		assert.Equal(t, "/hooks/orders", r.URL.Path)
+		assert.Equal(t, "1.0", r.Header.Get("ce-specversion"))
+		assert.Equal(t, event.EventID, r.Header.Get("ce-id"))
+		assert.Equal(t, "com.example.order.created", r.Header.Get("ce-type"))
+		assert.Equal(t, "/topics/orders", r.Header.Get("ce-source"))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, `{"id":1}`, r.Header.Get("X-Test-Body"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+}
+
+// TestEventDeadLetterAndRedrive tests that undeliverable events end up in the
+// subscription's dead letter store and can be sent again from there
+func TestEventDeadLetterAndRedrive(t *testing.T) {
+	var calls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer backend.Close()
+	g := newTestGateway(t, &fakeContainerManager{rSvc: backendService(t, backend)})
+	bus := admin.NewEventBus(admin.NewSqliteEventRepository(newTestDB(t)), g.sDefManager)
+	d := NewEventDispatcher(g, bus, testEventConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	sub := &admin.Subscription{Topic: "orders", Service: "test"}
+	assert.NoError(t, bus.Subscribe(sub))
+	assert.NoError(t, bus.Publish(&admin.Event{Topic: "orders"}))
+
+	var deadLetters []admin.EventDelivery
+	assert.Eventually(t, func() bool {
+		deadLetters, _ = bus.DeadLetters(sub.ID)
+		return len(deadLetters) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, deadLetters[0].Attempts)
+	assert.Equal(t, "subscriber answered 400", deadLetters[0].LastError)
+	assert.Equal(t, "orders", deadLetters[0].Event.Topic)
+
+	n, err := bus.Redrive(sub.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.Eventually(t, func() bool { return calls.Load() == 4 }, 5*time.Second, 10*time.Millisecond)
+}
+
+// TestPublishSameEventID tests that publishing an event id again keeps the first event
+// and doesn't deliver it twice
+func TestPublishSameEventID(t *testing.T) {
+	g := newTestGateway(t, &fakeContainerManager{})
+	repo := admin.NewSqliteEventRepository(newTestDB(t))
+	bus := admin.NewEventBus(repo, g.sDefManager)
+	assert.NoError(t, bus.Subscribe(&admin.Subscription{Topic: "orders", Service: "test"}))
+
+	first := &admin.Event{EventID: "order-1", Topic: "orders", Data: []byte(`{"id":1}`)}
+	assert.NoError(t, bus.Publish(first))
+	retried := &admin.Event{EventID: "order-1", Topic: "orders", Data: []byte(`{"id":2}`)}
+	assert.ErrorIs(t, bus.Publish(retried), admin.ErrEventExists)
+	assert.Equal(t, first.ID, retried.ID)
+	assert.Equal(t, `{"id":1}`, string(retried.Data))
+
+	deliveries, err := repo.ClaimDue(time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 1)
+}
+
+// TestEventRetention tests that delivered events are deleted after the retention
+// while dead letters and events still being delivered are kept
+func TestEventRetention(t *testing.T) {
+	g := newTestGateway(t, &fakeContainerManager{})
+	repo := admin.NewSqliteEventRepository(newTestDB(t))
+	bus := admin.NewEventBus(repo, g.sDefManager)
+	cfg := testEventConfig()
+	cfg.Retention = time.Hour
+	d := NewEventDispatcher(g, bus, cfg)
+	assert.NoError(t, bus.Subscribe(&admin.Subscription{Topic: "orders", Service: "test"}))
+
+	old := time.Now().Add(-2 * time.Hour)
+	recent := time.Now()
+	outcomes := map[string]struct {
+		status      string
+		deliveredAt *time.Time
+	}{
+		"delivered-old":    {admin.DeliveryDelivered, &old},
+		"delivered-recent": {admin.DeliveryDelivered, &recent},
+		"dead-letter":      {admin.DeliveryDeadLetter, nil},
+		"pending":          {admin.DeliveryPending, nil},
+	}
+	for id := range outcomes {
+		assert.NoError(t, bus.Publish(&admin.Event{Model: gorm.Model{CreatedAt: old}, EventID: id, Topic: "orders"}))
+	}
+	deliveries, err := repo.ClaimDue(time.Now(), 10)
+	assert.NoError(t, err)
+	for i := range deliveries {
+		outcome := outcomes[deliveries[i].Event.EventID]
+		deliveries[i].Status = outcome.status
+		deliveries[i].DeliveredAt = outcome.deliveredAt
+		assert.NoError(t, repo.UpdateDelivery(&deliveries[i]))
+	}
+
+	d.cleanup(time.Now())
+	for id, kept := range map[string]bool{"delivered-old": false, "delivered-recent": true, "dead-letter": true, "pending": true} {
+		// publishing the id again only works once the event is gone
+		err := bus.Publish(&admin.Event{EventID: id, Topic: "other"})
+		if kept {
+			assert.ErrorIs(t, err, admin.ErrEventExists, id)
+		} else {
+			assert.NoError(t, err, id)
+		}
+	}
+}
+
+// TestSubscribeValidates tests that subscriptions need a known service and a valid topic
+func TestSubscribeValidates(t *testing.T) {
+	g := newTestGateway(t, &fakeContainerManager{})
+	bus := admin.NewEventBus(admin.NewSqliteEventRepository(newTestDB(t)), g.sDefManager)
+	assert.ErrorIs(t, bus.Subscribe(&admin.Subscription{Topic: "orders", Service: "missing"}), admin.ErrServiceNotFound)
+	assert.Error(t, bus.Subscribe(&admin.Subscription{Topic: "orders/new", Service: "test"}))
+	assert.Error(t, bus.Publish(&admin.Event{Topic: ""}))
+}
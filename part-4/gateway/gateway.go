@@ -0,0 +1,327 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"codereliant.io/cless/container"
+	"codereliant.io/cless/metrics"
+	"codereliant.io/cless/tracecontext"
+	"codereliant.io/cless/tracing"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Config holds the gateway settings that don't change while it runs
+type Config struct {
+	// how long a request waits on a cold start before it gets a 503
+	ColdStartTimeout time.Duration `yaml:"cold_start_timeout" toml:"cold_start_timeout"`
+	// what a client that got a 503 during a cold start is told to wait before retrying
+	RetryAfter time.Duration `yaml:"retry_after" toml:"retry_after"`
+	// requests for AdminHost are passed on to the admin server at AdminAddr,
+	// both come from the admin settings
+	AdminHost string `yaml:"-" toml:"-"`
+	AdminAddr string `yaml:"-" toml:"-"`
+}
+
+func DefaultConfig() Config {
+	adminCfg := admin.DefaultConfig()
+	return Config{
+		ColdStartTimeout: 20 * time.Second,
+		RetryAfter:       5 * time.Second,
+		AdminHost:        adminCfg.Host,
+		AdminAddr:        adminCfg.Addr(),
+	}
+}
+
+func (cfg Config) Validate() error {
+	var errs []error
+	if cfg.ColdStartTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("cold start timeout must be positive, got %s", cfg.ColdStartTimeout))
+	}
+	if cfg.RetryAfter < time.Second {
+		errs = append(errs, fmt.Errorf("retry after must be at least 1s, got %s", cfg.RetryAfter))
+	}
+	return errors.Join(errs...)
+}
+
+// Gateway routes requests by host to the containers running the matching service
+type Gateway struct {
+	sDefManager      *admin.ServiceDefinitionManager
+	containerManager container.ContainerManager
+	proxies          *proxyRegistry
+	limits           *rateLimiter
+	mirrors          chan struct{} // one slot per mirrored request in flight
+	cache            *responseCache
+	auth             *authenticator
+	accessLog        *AccessLogger // nil while the access log is off
+	async            *AsyncInvoker // nil while async invocations are off
+	adminHost        string
+	adminProxy       *httputil.ReverseProxy
+	coldStartTimeout time.Duration
+	retryAfter       time.Duration
+	httpsPort        string // https redirects are off while empty
+}
+
+func NewGateway(
+	sDefManager *admin.ServiceDefinitionManager,
+	containerManager container.ContainerManager,
+	transport *http.Transport,
+	cfg Config,
+) *Gateway {
+	g := &Gateway{
+		sDefManager:      sDefManager,
+		containerManager: containerManager,
+		proxies:          newProxyRegistry(transport),
+		limits:           newRateLimiter(),
+		mirrors:          make(chan struct{}, maxMirrorsInFlight),
+		cache:            newResponseCache(),
+		auth:             newAuthenticator(),
+		adminHost:        cfg.AdminHost,
+		adminProxy:       httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: cfg.AdminAddr}),
+		coldStartTimeout: cfg.ColdStartTimeout,
+		retryAfter:       cfg.RetryAfter,
+	}
+	containerManager.OnContainerRemoved(g.proxies.evict)
+	sDefManager.OnCachePurge(g.cache.purge)
+	return g
+}
+
+// EnableHTTPSRedirects lets services that ask for it redirect plain http requests
+// to the https listener on httpsAddr
+func (g *Gateway) EnableHTTPSRedirects(httpsAddr string) error {
+	_, port, err := net.SplitHostPort(httpsAddr)
+	if err != nil {
+		return err
+	}
+	g.httpsPort = port
+	return nil
+}
+
+// SetAccessLogger makes the gateway write an access log entry per request, nil turns it off
+func (g *Gateway) SetAccessLogger(l *AccessLogger) {
+	g.accessLog = l
+}
+
+// redirectToHTTPS sends the client to the same url over https
+func (g *Gateway) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	if g.httpsPort != "443" {
+		host = net.JoinHostPort(host, g.httpsPort)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
+
+// requestInfo is what the gateway knows about a request so far, it travels in the request context
+type requestInfo struct {
+	ID          string
+	TraceID     string
+	Service     string
+	Version     uint
+	ContainerID string
+	ColdStart   bool          // the request waited for a container to start
+	Upstream    time.Duration // time spent waiting on containers, all attempts
+}
+
+type requestInfoKey struct{}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the request id and trace context go to the container with the request,
+	// and into every log line about it through the logger in the context
+	tc := tracecontext.FromHeader(r.Header)
+	ctx, span := tracing.StartRequest(r.Context(), &tc, "gateway.request", trace.WithAttributes(
+		semconv.HTTPMethod(r.Method),
+		semconv.HTTPTarget(r.URL.RequestURI()),
+		tracing.AttrHost.String(r.Host),
+		tracing.AttrRequestID.String(tc.RequestID),
+	))
+	defer span.End()
+	tc.Inject(r.Header)
+	logger := tc.Logger(log.Logger)
+	ctx = logger.WithContext(ctx)
+
+	// handle admin requests, the admin server answers with the request id itself
+	if r.Host == g.adminHost {
+		g.adminProxy.ServeHTTP(w, r.WithContext(ctx))
+		return
+	}
+
+	w.Header().Set(tracecontext.RequestIDHeader, tc.RequestID)
+	info := &requestInfo{ID: tc.RequestID, TraceID: tc.Trace.TraceIDString()}
+	r = r.WithContext(context.WithValue(ctx, requestInfoKey{}, info))
+
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	// the path is taken before routing rules strip their prefix
+	entry := &accessLogEntry{
+		Time:       start,
+		RemoteAddr: clientIP(r),
+		Host:       r.Host,
+		Method:     r.Method,
+		Path:       r.URL.RequestURI(),
+		Proto:      r.Proto,
+		Info:       info,
+	}
+	g.serve(rec, r)
+	total := time.Since(start)
+	endRequestSpan(span, info, rec.Status())
+	observeRequest(info, rec.Status(), total)
+	if g.accessLog == nil {
+		return
+	}
+	entry.Status = rec.Status()
+	entry.Bytes = rec.bytes
+	entry.Total = total
+	g.accessLog.log(entry)
+}
+
+// observeRequest records a finished request in the gateway metrics. requests no service
+// was found for are counted under an empty service, the host is never used as a label
+func observeRequest(info *requestInfo, status int, total time.Duration) {
+	version := ""
+	if info.Version != 0 {
+		version = strconv.FormatUint(uint64(info.Version), 10)
+	}
+	metrics.GatewayRequests.WithLabelValues(info.Service, version, fmt.Sprintf("%dxx", status/100)).Inc()
+	metrics.GatewayRequestDuration.WithLabelValues(info.Service, version).Observe(total.Seconds())
+}
+
+// endRequestSpan records what became of the request on its root span
+func endRequestSpan(span trace.Span, info *requestInfo, status int) {
+	span.SetAttributes(
+		semconv.HTTPStatusCode(status),
+		tracing.AttrService.String(info.Service),
+		tracing.AttrVersion.Int64(int64(info.Version)),
+		tracing.AttrContainerID.String(info.ContainerID),
+		tracing.AttrColdStart.Bool(info.ColdStart),
+	)
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// serve routes a request to the service it belongs to
+func (g *Gateway) serve(w http.ResponseWriter, r *http.Request) {
+	info := requestInfoFrom(r.Context())
+	_, routeSpan := tracing.Tracer().Start(r.Context(), "gateway.route")
+	svc, rule, err := g.sDefManager.Routes().Route(r.Host, r.URL.Path)
+	if err == nil {
+		routeSpan.SetAttributes(tracing.AttrService.String(svc.Name))
+	}
+	tracing.End(routeSpan, err)
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Str("host", r.Host).Msg("Failed to get service definition")
+		writeError(w, r, errorFor(err, g.retryAfter))
+		return
+	}
+	info.Service = svc.Name
+	if svc.RedirectHTTPS && r.TLS == nil && g.httpsPort != "" {
+		g.redirectToHTTPS(w, r)
+		return
+	}
+	if rule != nil && rule.StripPrefix {
+		stripPathPrefix(r.URL, rule.PathPrefix)
+	}
+
+	if !g.authenticate(w, r, svc) {
+		return
+	}
+
+	// over the limit requests are turned away before they can wake up a container
+	release := g.limits.admit(w, r, svc)
+	if release == nil {
+		return
+	}
+	defer release()
+
+	_, versionSpan := tracing.Tracer().Start(r.Context(), "gateway.choose_version")
+	svcVersion := chooseVersion(w, r, svc)
+	versionSpan.SetAttributes(tracing.AttrService.String(svc.Name), tracing.AttrVersion.Int64(int64(svcVersion)))
+	versionSpan.End()
+	zerolog.Ctx(r.Context()).Debug().Str("host", r.Host).Uint("service version", svcVersion).Msg("choosing service version")
+	if svcVersion == 0 {
+		writeError(w, r, errorFor(admin.ErrVersionNotFound, g.retryAfter))
+		return
+	}
+	info.Version = svcVersion
+
+	if g.async != nil && isAsyncInvocation(r) {
+		g.async.enqueue(w, r, svc, svcVersion)
+		return
+	}
+
+	if svc.Cache.Enabled {
+		g.serveCacheable(w, r, svc, svcVersion)
+		return
+	}
+	g.forward(w, r, svc, svcVersion)
+}
+
+// forward sends the request to a container of version, and a copy to the mirror version
+func (g *Gateway) forward(w http.ResponseWriter, r *http.Request, svc *admin.ServiceDefinition, svcVersion uint) {
+	if shouldMirror(r, svc, svcVersion) {
+		if err := g.mirror(r, svc); err != nil {
+			zerolog.Ctx(r.Context()).Error().Err(err).Msg("Failed to read request body")
+			writeError(w, r, &Error{Status: http.StatusBadRequest, Code: CodeBadRequest, Message: "failed to read request body"})
+			return
+		}
+	}
+
+	g.proxy(w, r, svc, svcVersion)
+}
+
+// stripPathPrefix removes prefix from the request path, "/users/1" becomes "/1"
+// and "/users" becomes "/"
+func stripPathPrefix(u *url.URL, prefix string) {
+	if prefix == "/" {
+		return
+	}
+	u.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(u.Path, prefix), "/")
+	if u.RawPath != "" {
+		u.RawPath = "/" + strings.TrimPrefix(strings.TrimPrefix(u.RawPath, prefix), "/")
+	}
+}
+
+// proxyErrorHandler answers with a 502 when the container can't be reached,
+// unless the request is going to be retried
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.Canceled) {
+		// client went away, nobody to answer to
+		return
+	}
+	if a := attemptFrom(r.Context()); a != nil && a.retryable {
+		a.err = err
+		return
+	}
+	zerolog.Ctx(r.Context()).Error().Err(err).Str("host", r.Host).Msg("Failed to proxy request")
+	span := trace.SpanFromContext(r.Context())
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	writeError(w, r, &Error{
+		Status:  http.StatusBadGateway,
+		Code:    CodeBackendUnreachable,
+		Message: "service could not be reached",
+	})
+}
@@ -0,0 +1,183 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"codereliant.io/cless/admin"
+	"codereliant.io/cless/container"
+	"codereliant.io/cless/metrics"
+	"codereliant.io/cless/tracecontext"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeContainerManager answers every lookup with the same container or error
+type fakeContainerManager struct {
+	rSvc *container.RunningService
+	err  error
+}
+
+func (f *fakeContainerManager) GetRunningServiceForHost(ctx context.Context, host string, version uint) (*container.RunningService, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.rSvc.BeginRequest()
+	return f.rSvc, nil
+}
+
+func (f *fakeContainerManager) StopAndRemoveAllContainers(ctx context.Context) []error {
+	return nil
+}
+
+func (f *fakeContainerManager) OnContainerRemoved(fn func(rSvc *container.RunningService)) {}
+
+func newTestGateway(t *testing.T, cm container.ContainerManager) *Gateway {
+	sDefManager := admin.NewServiceDefinitionManager(admin.NewInMemoryServiceDefinitionRepository(), admin.DefaultConfig())
+	if err := sDefManager.RegisterServiceDefinition("test", "test.cless.cloud"); err != nil {
+		t.Fatalf("Failed to register service definition: %s", err)
+	}
+	sDef, _ := sDefManager.GetServiceDefinitionByName("test")
+	if err := sDefManager.AddVersion(sDef, &admin.ServiceVersion{ImageName: "test", ImageTag: "latest", Port: 8080}); err != nil {
+		t.Fatalf("Failed to add version: %s", err)
+	}
+	weight := &admin.TrafficWeight{Weights: []admin.Weight{{ServiceVersionID: sDef.Versions[0].ID, Weight: 100}}}
+	if err := sDefManager.AddTrafficWeight(sDef, weight); err != nil {
+		t.Fatalf("Failed to add traffic weight: %s", err)
+	}
+	return NewGateway(sDefManager, cm, NewTransport(DefaultTransportConfig()), DefaultConfig())
+}
+
+func serve(g *Gateway, host string) (*httptest.ResponseRecorder, Error) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = host
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+	var body Error
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	return rec, body
+}
+
+// TestGatewayErrors tests that each failure class gets its own status and a JSON body
+func TestGatewayErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		host   string
+		err    error
+		status int
+		code   string
+	}{
+		{"unknown host", "unknown.cless.cloud", nil, http.StatusNotFound, CodeServiceNotFound},
+		{"cold start", "test.cless.cloud", container.ErrContainerStarting, http.StatusServiceUnavailable, CodeBackendStarting},
+		{"readiness timeout", "test.cless.cloud", container.ErrContainerNotReady, http.StatusGatewayTimeout, CodeBackendTimeout},
+		// nothing listens on port 1
+		{"unreachable backend", "test.cless.cloud", nil, http.StatusBadGateway, CodeBackendUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGateway(t, &fakeContainerManager{rSvc: &container.RunningService{AssignedPort: 1}, err: tt.err})
+			rec, body := serve(g, tt.host)
+			assert.Equal(t, tt.status, rec.Code)
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+			assert.Equal(t, tt.code, body.Code)
+			assert.NotEmpty(t, body.RequestID)
+			assert.Equal(t, body.RequestID, rec.Header().Get(tracecontext.RequestIDHeader))
+			assert.Len(t, body.TraceID, 32)
+			if tt.host == "test.cless.cloud" {
+				assert.Equal(t, "test", body.Service)
+				assert.NotZero(t, body.Version)
+			}
+		})
+	}
+}
+
+// TestRequestIDAndTraceContextReachContainer tests that the container gets the client's request id
+// and a traceparent continuing the client's trace, and that the client gets the request id back
+func TestRequestIDAndTraceContextReachContainer(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		// a container echoing its own id must not make the client see two
+		w.Header().Set(tracecontext.RequestIDHeader, "container-id")
+	}))
+	defer backend.Close()
+	g := newTestGateway(t, &fakeContainerManager{rSvc: backendService(t, backend)})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "test.cless.cloud"
+	req.Header.Set(tracecontext.RequestIDHeader, "req-42")
+	req.Header.Set(tracecontext.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("tracestate", "vendor=value")
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"req-42"}, rec.Header().Values(tracecontext.RequestIDHeader))
+	assert.Equal(t, "req-42", got.Get(tracecontext.RequestIDHeader))
+	tp, ok := tracecontext.ParseTraceParent(got.Get(tracecontext.TraceparentHeader))
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", tp.TraceIDString())
+	assert.NotEqual(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", tp.String())
+	assert.Equal(t, "vendor=value", got.Get("tracestate"))
+}
+
+// TestGatewayColdStartRetryAfter tests that a 503 during a cold start tells the client when to retry
+func TestGatewayColdStartRetryAfter(t *testing.T) {
+	g := newTestGateway(t, &fakeContainerManager{err: container.ErrContainerStarting})
+	rec, _ := serve(g, "test.cless.cloud")
+	assert.Equal(t, "5", rec.Header().Get("Retry-After"))
+}
+
+// TestRequestMetrics tests that requests are counted by service, version and status class
+// and that requests for unknown hosts are counted without a service
+func TestRequestMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	g := newTestGateway(t, &fakeContainerManager{rSvc: backendService(t, backend)})
+	sDef, _ := g.sDefManager.GetServiceDefinitionByName("test")
+	version := strconv.FormatUint(uint64(sDef.Versions[0].ID), 10)
+	ok := metrics.GatewayRequests.WithLabelValues("test", version, "2xx")
+	unrouted := metrics.GatewayRequests.WithLabelValues("", "", "4xx")
+	okBefore, unroutedBefore := testutil.ToFloat64(ok), testutil.ToFloat64(unrouted)
+
+	serve(g, "test.cless.cloud")
+	serve(g, "unknown.cless.cloud")
+	assert.Equal(t, okBefore+1, testutil.ToFloat64(ok))
+	assert.Equal(t, unroutedBefore+1, testutil.ToFloat64(unrouted))
+}
+
+// TestProxyRegistryReusesProxies tests that a container keeps its proxy until it is evicted
+func TestProxyRegistryReusesProxies(t *testing.T) {
+	registry := newProxyRegistry(NewTransport(DefaultTransportConfig()))
+	rSvc := &container.RunningService{AssignedPort: 8001}
+	proxy := registry.get(rSvc)
+	assert.Same(t, proxy, registry.get(rSvc))
+	assert.NotSame(t, proxy, registry.get(&container.RunningService{AssignedPort: 8002}))
+
+	registry.evict(rSvc)
+	assert.NotSame(t, proxy, registry.get(rSvc))
+}
+
+// TestStripPathPrefix tests the path a container sees for a rule with StripPrefix set
+func TestStripPathPrefix(t *testing.T) {
+	tests := []struct {
+		path   string
+		prefix string
+		want   string
+	}{
+		{"/users/42", "/users", "/42"},
+		{"/users", "/users", "/"},
+		{"/users/", "/users", "/"},
+		{"/users/42", "/", "/users/42"},
+	}
+	for _, tt := range tests {
+		u := &url.URL{Path: tt.path}
+		stripPathPrefix(u, tt.prefix)
+		assert.Equal(t, tt.want, u.Path)
+	}
+}
@@ -0,0 +1,79 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+
+	"codereliant.io/cless/tracecontext"
+	"codereliant.io/cless/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// backgroundRequest is a request the gateway makes on its own behalf,
+// for async invocations and schedules
+type backgroundRequest struct {
+	Host    string // host of the service, used to find the container
+	Version uint
+	Method  string
+	Path    string // path and query
+	Header  http.Header
+	Body    []byte
+}
+
+// storedResponse is a container answer read into memory
+type storedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// invoke sends req to a container running its version, starting one if needed,
+// and reads up to maxBody bytes of the answer
+func (g *Gateway) invoke(ctx context.Context, req *backgroundRequest, maxBody int64) (_ *storedResponse, err error) {
+	// async invocations keep the request id and trace of the request that queued them,
+	// schedules and events start new ones
+	tc := tracecontext.FromHeader(req.Header)
+	ctx, span := tracing.StartRequest(ctx, &tc, "gateway.invoke", trace.WithSpanKind(trace.SpanKindInternal), trace.WithAttributes(
+		semconv.HTTPMethod(req.Method),
+		semconv.HTTPTarget(req.Path),
+		tracing.AttrHost.String(req.Host),
+		tracing.AttrVersion.Int64(int64(req.Version)),
+		tracing.AttrRequestID.String(tc.RequestID),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	rSvc, err := g.containerManager.GetRunningServiceForHost(ctx, req.Host, req.Version)
+	if err != nil {
+		return nil, err
+	}
+	defer rSvc.EndRequest()
+	var body io.Reader = http.NoBody
+	if len(req.Body) > 0 {
+		body = bytes.NewReader(req.Body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, "http://"+rSvc.GetHost()+req.Path, body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Host = req.Host
+	if req.Header != nil {
+		httpReq.Header = req.Header.Clone()
+	}
+	tc.Inject(httpReq.Header)
+	span.SetAttributes(tracing.AttrContainerID.String(rSvc.ContainerID))
+
+	resp, err := g.proxies.transport.RoundTrip(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxBody))
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode))
+	return &storedResponse{status: resp.StatusCode, header: resp.Header, body: respBody}, nil
+}
@@ -0,0 +1,109 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"codereliant.io/cless/metrics"
+	"github.com/rs/zerolog"
+)
+
+// how many mirrored requests may be outstanding at once, copies over that are dropped
+const maxMirrorsInFlight = 64
+
+// how long a mirrored request may take, cold start included
+const mirrorTimeout = time.Minute
+
+// results a mirrored request is counted under
+const (
+	mirrorOK        = "ok"
+	mirrorBadStatus = "bad_status"
+	mirrorFailed    = "failed"
+	mirrorDropped   = "dropped"
+)
+
+// shouldMirror decides whether r gets copied to the mirror version of svc
+func shouldMirror(r *http.Request, svc *admin.ServiceDefinition, version uint) bool {
+	mirror := svc.Mirror
+	if mirror.Percent == 0 || mirror.ServiceVersionID == version {
+		return false
+	}
+	// upgraded connections can't be replayed
+	if r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	return uint(rand.Intn(100)) < mirror.Percent
+}
+
+// mirror sends a copy of r to the mirror version of svc in the background.
+// the body of r is buffered so both the copy and the original can read it,
+// requests whose body is too large to buffer are not mirrored.
+// an error means the body of r could not be read
+func (g *Gateway) mirror(r *http.Request, svc *admin.ServiceDefinition) error {
+	body, ok, err := bufferBody(r, svc.Mirror.MaxBodyBytes)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		metrics.GatewayMirrored.WithLabelValues(svc.Name, mirrorDropped).Inc()
+		return nil
+	}
+	if body != nil {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	select {
+	case g.mirrors <- struct{}{}:
+	default:
+		metrics.GatewayMirrored.WithLabelValues(svc.Name, mirrorDropped).Inc()
+		return nil
+	}
+
+	// the copy must outlive the original request, so it gets a context of its own
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	req := r.Clone(ctx)
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	} else {
+		req.Body = http.NoBody
+	}
+	req.RequestURI = ""
+	req.Header.Set("X-Cless-Mirror", "true")
+	host, version := svc.Host, svc.Mirror.ServiceVersionID
+	logger := zerolog.Ctx(r.Context())
+
+	go func() {
+		defer func() { <-g.mirrors }()
+		defer cancel()
+		result := g.sendMirror(ctx, req, host, version)
+		metrics.GatewayMirrored.WithLabelValues(svc.Name, result).Inc()
+		logger.Debug().Str("service", svc.Name).Str("result", result).Msg("mirrored request")
+	}()
+	return nil
+}
+
+// sendMirror delivers a mirrored request and throws the answer away
+func (g *Gateway) sendMirror(ctx context.Context, req *http.Request, host string, version uint) string {
+	rSvc, err := g.containerManager.GetRunningServiceForHost(ctx, host, version)
+	if err != nil {
+		return mirrorFailed
+	}
+	defer rSvc.EndRequest()
+	req.URL.Scheme = "http"
+	req.URL.Host = rSvc.GetHost()
+	resp, err := g.proxies.transport.RoundTrip(req)
+	if err != nil {
+		return mirrorFailed
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return mirrorBadStatus
+	}
+	return mirrorOK
+}
@@ -0,0 +1,66 @@
+package gateway
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"codereliant.io/cless/container"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMirrorDoesNotAffectPrimary tests that a slow, failing mirror gets a copy of the body
+// while the client gets the primary's answer without waiting on the mirror
+func TestMirrorDoesNotAffectPrimary(t *testing.T) {
+	mirrored := make(chan string, 1)
+	unblock := make(chan struct{})
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- string(body)
+		<-unblock
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer mirror.Close()
+	defer close(unblock)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer primary.Close()
+
+	cm := &versionContainerManager{byVersion: make(map[uint]*container.RunningService)}
+	g := newTestGateway(t, cm)
+	sDef, _ := g.sDefManager.GetServiceDefinitionByName("test")
+	assert.NoError(t, g.sDefManager.AddVersion(sDef, &admin.ServiceVersion{ImageName: "test", ImageTag: "next", Port: 8080}))
+	primaryVersion, mirrorVersion := sDef.Versions[0].ID, sDef.Versions[1].ID
+	cm.byVersion[primaryVersion] = backendService(t, primary)
+	cm.byVersion[mirrorVersion] = backendService(t, mirror)
+	assert.NoError(t, g.sDefManager.SetMirror(sDef, admin.MirrorPolicy{Percent: 100, ServiceVersionID: mirrorVersion, MaxBodyBytes: 1024}))
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload"))
+	req.Host = "test.cless.cloud"
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "payload", rec.Body.String())
+
+	select {
+	case body := <-mirrored:
+		assert.Equal(t, "payload", body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("mirror did not get a copy")
+	}
+}
+
+// TestSetMirrorValidates tests that the mirror has to point at a version of the service
+func TestSetMirrorValidates(t *testing.T) {
+	g := newTestGateway(t, &fakeContainerManager{})
+	sDef, _ := g.sDefManager.GetServiceDefinitionByName("test")
+	assert.Error(t, g.sDefManager.SetMirror(sDef, admin.MirrorPolicy{Percent: 101, ServiceVersionID: sDef.Versions[0].ID}))
+	assert.ErrorIs(t, g.sDefManager.SetMirror(sDef, admin.MirrorPolicy{Percent: 10, ServiceVersionID: 999}), admin.ErrVersionNotFound)
+	assert.NoError(t, g.sDefManager.SetMirror(sDef, admin.MirrorPolicy{}))
+}
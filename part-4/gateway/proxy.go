@@ -0,0 +1,162 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"codereliant.io/cless/container"
+	"codereliant.io/cless/tracecontext"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+)
+
+// TransportConfig tunes the connection pool shared by all backend proxies
+type TransportConfig struct {
+	MaxIdleConns          int           `yaml:"max_idle_conns" toml:"max_idle_conns"`
+	MaxIdleConnsPerHost   int           `yaml:"max_idle_conns_per_host" toml:"max_idle_conns_per_host"`
+	IdleConnTimeout       time.Duration `yaml:"idle_conn_timeout" toml:"idle_conn_timeout"`
+	DialTimeout           time.Duration `yaml:"dial_timeout" toml:"dial_timeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout" toml:"response_header_timeout"`
+}
+
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		MaxIdleConns:          512,
+		MaxIdleConnsPerHost:   64,
+		IdleConnTimeout:       90 * time.Second,
+		DialTimeout:           5 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+	}
+}
+
+func (cfg TransportConfig) Validate() error {
+	var errs []error
+	if cfg.MaxIdleConns < 0 || cfg.MaxIdleConnsPerHost < 0 {
+		errs = append(errs, fmt.Errorf("idle connection limits can't be negative, got %d and %d per host", cfg.MaxIdleConns, cfg.MaxIdleConnsPerHost))
+	}
+	if cfg.IdleConnTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("idle connection timeout must be positive, got %s", cfg.IdleConnTimeout))
+	}
+	if cfg.DialTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("dial timeout must be positive, got %s", cfg.DialTimeout))
+	}
+	if cfg.ResponseHeaderTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("response header timeout must be positive, got %s", cfg.ResponseHeaderTimeout))
+	}
+	return errors.Join(errs...)
+}
+
+// NewTransport builds the http.Transport the gateway uses to talk to containers
+func NewTransport(cfg TransportConfig) *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+	}
+}
+
+// protocolTransport sends gRPC calls to containers as cleartext HTTP/2 (h2c)
+// and everything else, websocket upgrades included, over the pooled HTTP/1.1 transport
+type protocolTransport struct {
+	http1 *http.Transport
+	h2c   *http2.Transport
+}
+
+func newProtocolTransport(t *http.Transport) *protocolTransport {
+	return &protocolTransport{
+		http1: t,
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return t.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+func (pt *protocolTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if isGRPC(r) {
+		return pt.h2c.RoundTrip(r)
+	}
+	return pt.http1.RoundTrip(r)
+}
+
+func isGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// proxyRegistry keeps one reverse proxy per running container so keep-alive
+// connections are reused across requests
+type proxyRegistry struct {
+	mutex     sync.Mutex
+	proxies   map[*container.RunningService]*httputil.ReverseProxy
+	transport http.RoundTripper
+}
+
+func newProxyRegistry(transport *http.Transport) *proxyRegistry {
+	return &proxyRegistry{
+		proxies:   make(map[*container.RunningService]*httputil.ReverseProxy),
+		transport: newProtocolTransport(transport),
+	}
+}
+
+// get returns the proxy for rSvc, creating it on first use
+func (pr *proxyRegistry) get(rSvc *container.RunningService) *httputil.ReverseProxy {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	proxy, ok := pr.proxies[rSvc]
+	if !ok {
+		proxy = pr.newProxy(rSvc.GetHost())
+		pr.proxies[rSvc] = proxy
+	}
+	return proxy
+}
+
+// evict drops the proxy of a container that no longer exists
+func (pr *proxyRegistry) evict(rSvc *container.RunningService) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	delete(pr.proxies, rSvc)
+}
+
+func (pr *proxyRegistry) newProxy(host string) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{
+		Scheme: "http",
+		Host:   host,
+	})
+	proxy.Transport = pr.transport
+	proxy.ErrorHandler = proxyErrorHandler
+	proxy.ModifyResponse = modifyResponse
+	// server-sent events and responses without a length are flushed as they come,
+	// see httputil.ReverseProxy, the interval only applies to everything else
+	proxy.FlushInterval = 100 * time.Millisecond
+	return proxy
+}
+
+// modifyResponse runs on every response of a container before it is copied to the client
+func modifyResponse(resp *http.Response) error {
+	// the client gets the request id of the gateway, which is the one the container was sent
+	resp.Header.Del(tracecontext.RequestIDHeader)
+	span := trace.SpanFromContext(resp.Request.Context())
+	span.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return retryModifyResponse(resp)
+}
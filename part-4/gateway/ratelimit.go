@@ -0,0 +1,131 @@
+package gateway
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"golang.org/x/time/rate"
+)
+
+// how often full buckets are dropped, a full bucket is the same as a new one
+const rateLimitSweepInterval = time.Minute
+
+// serviceLimits holds the token buckets and the in-flight count of one service
+type serviceLimits struct {
+	config    admin.RateLimit
+	mutex     sync.Mutex
+	buckets   map[string]*rate.Limiter
+	lastSweep time.Time
+	inFlight  atomic.Int64
+}
+
+// rateLimiter enforces the rate limits and concurrency quotas of all services
+type rateLimiter struct {
+	mutex    sync.Mutex
+	services map[uint]*serviceLimits
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{services: make(map[uint]*serviceLimits)}
+}
+
+// limitsFor returns the limits of svc, starting over when its config changed
+func (rl *rateLimiter) limitsFor(svc *admin.ServiceDefinition) *serviceLimits {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	limits, ok := rl.services[svc.ID]
+	if !ok || limits.config != svc.RateLimit {
+		limits = &serviceLimits{
+			config:    svc.RateLimit,
+			buckets:   make(map[string]*rate.Limiter),
+			lastSweep: time.Now(),
+		}
+		rl.services[svc.ID] = limits
+	}
+	return limits
+}
+
+// rateLimitKey is the bucket a request is counted against
+func rateLimitKey(r *http.Request, config admin.RateLimit) string {
+	switch config.KeyBy {
+	case admin.RateLimitClientIP:
+		return clientIP(r)
+	case admin.RateLimitHeader:
+		// requests without the header share one bucket
+		return r.Header.Get(config.Header)
+	}
+	return ""
+}
+
+// take takes a token out of the bucket for key, wait is how long until the next one
+// is available when none is left
+func (l *serviceLimits) take(key string, now time.Time) (ok bool, remaining int, wait time.Duration, reset time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		for k, b := range l.buckets {
+			if b.TokensAt(now) >= float64(l.config.Burst) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, found := l.buckets[key]
+	if !found {
+		b = rate.NewLimiter(rate.Limit(l.config.RequestsPerSecond), l.config.Burst)
+		l.buckets[key] = b
+	}
+	ok = b.AllowN(now, 1)
+	tokens := b.TokensAt(now)
+	perSecond := l.config.RequestsPerSecond
+	if !ok {
+		wait = time.Duration((1 - tokens) / perSecond * float64(time.Second))
+	}
+	reset = time.Duration((float64(l.config.Burst) - tokens) / perSecond * float64(time.Second))
+	return ok, int(math.Max(0, math.Floor(tokens))), wait, reset
+}
+
+// ceilSeconds rounds d up to whole seconds as the rate limit headers expect them
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// admit applies the rate limit and concurrency quota of svc to r.
+// if the request may go on the returned release func must be called once it is done,
+// otherwise a 429 has been written and release is nil
+func (rl *rateLimiter) admit(w http.ResponseWriter, r *http.Request, svc *admin.ServiceDefinition) (release func()) {
+	config := svc.RateLimit
+	if config.RequestsPerSecond == 0 && config.MaxInFlight == 0 {
+		return func() {}
+	}
+	limits := rl.limitsFor(svc)
+
+	if config.RequestsPerSecond > 0 {
+		ok, remaining, wait, reset := limits.take(rateLimitKey(r, config), time.Now())
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(config.Burst))
+		h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		h.Set("RateLimit-Reset", ceilSeconds(reset))
+		if !ok {
+			h.Set("Retry-After", ceilSeconds(wait))
+			writeError(w, r, &Error{Status: http.StatusTooManyRequests, Code: CodeRateLimited, Message: "rate limit exceeded"})
+			return nil
+		}
+	}
+
+	if config.MaxInFlight > 0 {
+		if limits.inFlight.Add(1) > int64(config.MaxInFlight) {
+			limits.inFlight.Add(-1)
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, &Error{Status: http.StatusTooManyRequests, Code: CodeTooManyInFlight, Message: "too many requests in flight"})
+			return nil
+		}
+		return func() { limits.inFlight.Add(-1) }
+	}
+	return func() {}
+}
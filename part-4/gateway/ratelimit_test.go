@@ -0,0 +1,112 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"codereliant.io/cless/container"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingContainerManager counts lookups so tests can tell whether a container would have been woken up
+type countingContainerManager struct {
+	fakeContainerManager
+	lookups atomic.Int32
+}
+
+func (f *countingContainerManager) GetRunningServiceForHost(ctx context.Context, host string, version uint) (*container.RunningService, error) {
+	f.lookups.Add(1)
+	return f.fakeContainerManager.GetRunningServiceForHost(ctx, host, version)
+}
+
+// TestRateLimitRejectsBeforeColdStart tests that requests over the limit get a 429
+// with rate limit headers and never reach the container manager
+func TestRateLimitRejectsBeforeColdStart(t *testing.T) {
+	cm := &countingContainerManager{fakeContainerManager: fakeContainerManager{err: container.ErrContainerStarting}}
+	g := newTestGateway(t, cm)
+	sDef, _ := g.sDefManager.GetServiceDefinitionByName("test")
+	assert.NoError(t, g.sDefManager.SetRateLimit(sDef, admin.RateLimit{RequestsPerSecond: 0.1, Burst: 2}))
+
+	for i := 0; i < 2; i++ {
+		rec, _ := serve(g, "test.cless.cloud")
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	}
+	rec, body := serve(g, "test.cless.cloud")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, CodeRateLimited, body.Code)
+	assert.Equal(t, "2", rec.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "10", rec.Header().Get("Retry-After"))
+	assert.Equal(t, int32(2), cm.lookups.Load())
+}
+
+// TestRateLimitByHeader tests that each key gets a bucket of its own
+func TestRateLimitByHeader(t *testing.T) {
+	g := newTestGateway(t, &fakeContainerManager{err: container.ErrContainerStarting})
+	sDef, _ := g.sDefManager.GetServiceDefinitionByName("test")
+	assert.NoError(t, g.sDefManager.SetRateLimit(sDef, admin.RateLimit{
+		RequestsPerSecond: 0.1, Burst: 1, KeyBy: admin.RateLimitHeader, Header: "X-Api-Key",
+	}))
+
+	codes := make(map[string][]int)
+	for _, key := range []string{"a", "b", "a", "b"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "test.cless.cloud"
+		req.Header.Set("X-Api-Key", key)
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		codes[key] = append(codes[key], rec.Code)
+	}
+	assert.Equal(t, []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, codes["a"])
+	assert.Equal(t, []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, codes["b"])
+}
+
+// TestMaxInFlight tests that the concurrency quota turns away requests while the service is busy
+func TestMaxInFlight(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+	}))
+	defer backend.Close()
+	g := newTestGateway(t, &fakeContainerManager{rSvc: backendService(t, backend)})
+	sDef, _ := g.sDefManager.GetServiceDefinitionByName("test")
+	assert.NoError(t, g.sDefManager.SetRateLimit(sDef, admin.RateLimit{MaxInFlight: 1}))
+
+	done := make(chan int)
+	go func() {
+		rec, _ := serve(g, "test.cless.cloud")
+		done <- rec.Code
+	}()
+	<-started
+	rec, body := serve(g, "test.cless.cloud")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, CodeTooManyInFlight, body.Code)
+	close(unblock)
+	select {
+	case code := <-done:
+		assert.Equal(t, http.StatusOK, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("first request did not finish")
+	}
+
+	// the slot is free again
+	go func() { <-started }()
+	rec, _ = serve(g, "test.cless.cloud")
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+// TestInvalidRateLimit tests that the manager rejects configs the limiter can't enforce
+func TestInvalidRateLimit(t *testing.T) {
+	g := newTestGateway(t, &fakeContainerManager{})
+	sDef, _ := g.sDefManager.GetServiceDefinitionByName("test")
+	assert.Error(t, g.sDefManager.SetRateLimit(sDef, admin.RateLimit{RequestsPerSecond: 5}))
+	assert.Error(t, g.sDefManager.SetRateLimit(sDef, admin.RateLimit{RequestsPerSecond: 5, Burst: 5, KeyBy: admin.RateLimitHeader}))
+	assert.Error(t, g.sDefManager.SetRateLimit(sDef, admin.RateLimit{MaxInFlight: -1}))
+}
@@ -0,0 +1,172 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"codereliant.io/cless/container"
+	"codereliant.io/cless/metrics"
+	"codereliant.io/cless/tracing"
+	"github.com/rs/zerolog"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// attempt is shared between the retry loop and the proxy hooks through the request context
+type attempt struct {
+	retryable bool  // another attempt will follow, so failures are recorded instead of written
+	err       error // why the attempt failed, nil if the response went to the client
+}
+
+type attemptKey struct{}
+
+func attemptFrom(ctx context.Context) *attempt {
+	a, _ := ctx.Value(attemptKey{}).(*attempt)
+	return a
+}
+
+// errRetryableStatus turns a 502/503 from the container into an error the retry loop can act on
+type errRetryableStatus int
+
+func (e errRetryableStatus) Error() string {
+	return fmt.Sprintf("container answered %d", int(e))
+}
+
+// retryModifyResponse is the ReverseProxy.ModifyResponse hook that rejects 502 and 503
+// while there are attempts left
+func retryModifyResponse(resp *http.Response) error {
+	a := attemptFrom(resp.Request.Context())
+	if a == nil || !a.retryable {
+		return nil
+	}
+	if resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable {
+		return errRetryableStatus(resp.StatusCode)
+	}
+	return nil
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// bufferBody reads the request body into memory so it can be replayed.
+// if the body is larger than limit it is left for a single attempt and ok is false
+func bufferBody(r *http.Request, limit int64) (body []byte, ok bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if r.ContentLength > limit {
+		return nil, false, nil
+	}
+	body, err = io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > limit {
+		// put back what was read in front of the rest
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false, nil
+	}
+	r.Body.Close()
+	return body, true, nil
+}
+
+// proxy sends the request to a container running version of svc. with a retry policy
+// idempotent requests are sent again when the container can't be reached or answers 502/503,
+// optionally on another version of the active traffic weight
+func (g *Gateway) proxy(w http.ResponseWriter, r *http.Request, svc *admin.ServiceDefinition, version uint) {
+	info := requestInfoFrom(r.Context())
+	policy := svc.Retry
+	attempts := 1
+	var body []byte
+	if policy.MaxAttempts > 1 && isIdempotent(r.Method) {
+		var ok bool
+		var err error
+		body, ok, err = bufferBody(r, policy.MaxBodyBytes)
+		if err != nil {
+			zerolog.Ctx(r.Context()).Error().Err(err).Msg("Failed to read request body")
+			writeError(w, r, &Error{Status: http.StatusBadRequest, Code: CodeBadRequest, Message: "failed to read request body"})
+			return
+		}
+		if ok {
+			attempts = policy.MaxAttempts
+		}
+	}
+
+	tried := make(map[uint]bool)
+	for i := 1; ; i++ {
+		coldStart := false
+		ctx, cancel := context.WithTimeout(container.WithColdStartReport(r.Context(), &coldStart), g.coldStartTimeout)
+		rSvc, err := g.containerManager.GetRunningServiceForHost(ctx, svc.Host, version)
+		cancel()
+		info.ColdStart = info.ColdStart || coldStart
+		if err != nil {
+			zerolog.Ctx(r.Context()).Error().Err(err).Str("host", r.Host).Msg("Failed to get running service")
+			writeError(w, r, errorFor(err, g.retryAfter))
+			return
+		}
+
+		a := &attempt{retryable: i < attempts}
+		spanCtx, span := tracing.Tracer().Start(r.Context(), "gateway.proxy", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+			tracing.AttrService.String(svc.Name),
+			tracing.AttrVersion.Int64(int64(version)),
+			tracing.AttrContainerID.String(rSvc.ContainerID),
+			tracing.AttrAttempt.Int(i),
+			semconv.ServerAddress(rSvc.GetHost()),
+		))
+		req := r.WithContext(context.WithValue(spanCtx, attemptKey{}, a))
+		// the container sees the proxy span as its parent
+		tracing.Inject(spanCtx, req.Header)
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+		}
+		zerolog.Ctx(r.Context()).Debug().Str("host", r.Host).Str("service localhost", rSvc.GetHost()).Int("attempt", i).Msg("proxying request")
+		info.ContainerID = rSvc.ContainerID
+		g.proxyAttempt(w, req, rSvc, info, span, a)
+		if a.err == nil {
+			return
+		}
+
+		reason := "unreachable"
+		if _, ok := a.err.(errRetryableStatus); ok {
+			reason = "bad_status"
+		}
+		metrics.GatewayRetries.WithLabelValues(svc.Name, reason).Inc()
+		tried[version] = true
+		if policy.Failover {
+			if fallback := svc.ChooseFallbackVersion(tried); fallback != 0 {
+				version = fallback
+				info.Version = fallback
+			}
+		}
+		zerolog.Ctx(r.Context()).Warn().Err(a.err).
+			Str("service", svc.Name).
+			Int("attempt", i).
+			Uint("next version", version).
+			Msg("Retrying request")
+	}
+}
+
+// proxyAttempt sends one attempt to rSvc, which the container manager handed out with the request
+// in flight. the proxy panics with http.ErrAbortHandler when the
+// client goes away mid-response, so the request must leave the container and the span must end in defers
+func (g *Gateway) proxyAttempt(w http.ResponseWriter, req *http.Request, rSvc *container.RunningService, info *requestInfo, span trace.Span, a *attempt) {
+	defer rSvc.EndRequest()
+	defer func() { tracing.End(span, a.err) }()
+	start := time.Now()
+	defer func() { info.Upstream += time.Since(start) }()
+	g.proxies.get(rSvc).ServeHTTP(w, req)
+}
@@ -0,0 +1,75 @@
+package gateway
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"codereliant.io/cless/admin"
+	"codereliant.io/cless/container"
+	"github.com/stretchr/testify/assert"
+)
+
+// versionContainerManager runs each version in its own container
+type versionContainerManager struct {
+	fakeContainerManager
+	byVersion map[uint]*container.RunningService
+}
+
+func (f *versionContainerManager) GetRunningServiceForHost(ctx context.Context, host string, version uint) (*container.RunningService, error) {
+	rSvc := f.byVersion[version]
+	rSvc.BeginRequest()
+	return rSvc, nil
+}
+
+// TestRetryFailsOverToHealthyVersion tests that a broken canary degrades to the stable version
+// and that request bodies are replayed on the retry
+func TestRetryFailsOverToHealthyVersion(t *testing.T) {
+	var brokenCalls atomic.Int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		brokenCalls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer stable.Close()
+
+	cm := &versionContainerManager{byVersion: make(map[uint]*container.RunningService)}
+	g := newTestGateway(t, cm)
+	sDef, _ := g.sDefManager.GetServiceDefinitionByName("test")
+	assert.NoError(t, g.sDefManager.AddVersion(sDef, &admin.ServiceVersion{ImageName: "test", ImageTag: "canary", Port: 8080}))
+	stableVersion, canaryVersion := sDef.Versions[0].ID, sDef.Versions[1].ID
+	cm.byVersion[stableVersion] = backendService(t, stable)
+	cm.byVersion[canaryVersion] = backendService(t, broken)
+	assert.NoError(t, g.sDefManager.AddTrafficWeight(sDef, &admin.TrafficWeight{Weights: []admin.Weight{
+		{ServiceVersionID: stableVersion, Weight: 50},
+		{ServiceVersionID: canaryVersion, Weight: 50},
+	}}))
+	assert.NoError(t, g.sDefManager.SetRetryPolicy(sDef, admin.RetryPolicy{MaxAttempts: 2, MaxBodyBytes: 1024, Failover: true}))
+
+	for i := 0; i < 50; i++ {
+		req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader("payload"))
+		req.Host = "test.cless.cloud"
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "payload", rec.Body.String())
+	}
+	assert.NotZero(t, brokenCalls.Load())
+
+	// POST is not idempotent so the canary's answer goes straight to the client
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Host = "test.cless.cloud"
+	req.Header.Set("X-Force", "canary")
+	assert.NoError(t, g.sDefManager.AddVersionRule(sDef, &admin.VersionRule{Header: "X-Force", Value: "canary", ServiceVersionID: canaryVersion}))
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
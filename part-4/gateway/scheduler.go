@@ -0,0 +1,208 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"github.com/rs/zerolog/log"
+)
+
+// SchedulerConfig tunes the scheduled runs
+type SchedulerConfig struct {
+	RunTimeout time.Duration `yaml:"run_timeout" toml:"run_timeout"` // how long a scheduled run may take, cold start included
+	KeepRuns   int           `yaml:"keep_runs" toml:"keep_runs"`     // runs kept per schedule, older ones are deleted, 0 keeps them all
+}
+
+func DefaultSchedulerConfig() SchedulerConfig {
+	return SchedulerConfig{RunTimeout: time.Hour, KeepRuns: 100}
+}
+
+func (cfg SchedulerConfig) Validate() error {
+	var errs []error
+	if cfg.RunTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("run timeout must be positive, got %s", cfg.RunTimeout))
+	}
+	if cfg.KeepRuns < 0 {
+		errs = append(errs, fmt.Errorf("keep runs can't be negative, got %d", cfg.KeepRuns))
+	}
+	return errors.Join(errs...)
+}
+
+// how much of a scheduled run's answer is read, the body itself is not kept
+const scheduleMaxResponseBytes = 64 << 10
+
+// header that tells the service which schedule invoked it
+const ScheduleIDHeader = "X-Cless-Schedule-Id"
+
+// Scheduler invokes services on the schedules stored with their definitions.
+// a schedule whose previous run is still going skips its turn instead of piling up runs
+type Scheduler struct {
+	gateway    *Gateway
+	runs       admin.ScheduleRunRepository
+	runTimeout time.Duration
+	keepRuns   int
+
+	mutex   sync.Mutex
+	entries map[uint]*scheduleEntry
+	wg      sync.WaitGroup
+}
+
+// scheduleEntry is the scheduler state of one schedule
+type scheduleEntry struct {
+	cron     string
+	timeZone string
+	next     time.Time
+	running  bool
+}
+
+func NewScheduler(g *Gateway, runs admin.ScheduleRunRepository, cfg SchedulerConfig) *Scheduler {
+	return &Scheduler{
+		gateway:    g,
+		runs:       runs,
+		runTimeout: cfg.RunTimeout,
+		keepRuns:   cfg.KeepRuns,
+		entries:    make(map[uint]*scheduleEntry),
+	}
+}
+
+// Run checks the schedules every second until ctx is done, then waits for the runs in progress
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		s.tick(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			s.wg.Wait()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tick starts the runs that became due at now. schedules are read from the routing table,
+// so added, changed and deleted schedules are picked up on the next tick
+func (s *Scheduler) tick(ctx context.Context, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	seen := make(map[uint]bool)
+	for _, svc := range s.gateway.sDefManager.Routes().Services() {
+		for i := range svc.Schedules {
+			schedule := &svc.Schedules[i]
+			seen[schedule.ID] = true
+			entry, ok := s.entries[schedule.ID]
+			if !ok || entry.cron != schedule.Cron || entry.timeZone != schedule.TimeZone {
+				next, err := schedule.NextRun(now)
+				if err != nil {
+					log.Error().Err(err).Str("service", svc.Name).Uint("schedule", schedule.ID).Msg("Invalid schedule")
+					continue
+				}
+				running := ok && entry.running
+				s.entries[schedule.ID] = &scheduleEntry{cron: schedule.Cron, timeZone: schedule.TimeZone, next: next, running: running}
+				continue
+			}
+			if now.Before(entry.next) {
+				continue
+			}
+			scheduledAt := entry.next
+			entry.next, _ = schedule.NextRun(now)
+			if entry.running {
+				s.record(&admin.ScheduleRun{ScheduleID: schedule.ID, Service: svc.Name, ScheduledAt: scheduledAt, Status: admin.RunSkipped})
+				log.Warn().Str("service", svc.Name).Uint("schedule", schedule.ID).Msg("Skipping scheduled run, the previous one is still running")
+				continue
+			}
+			entry.running = true
+			s.wg.Add(1)
+			go s.fire(ctx, svc, *schedule, scheduledAt)
+		}
+	}
+	for id, entry := range s.entries {
+		if !seen[id] && !entry.running {
+			delete(s.entries, id)
+		}
+	}
+}
+
+// fire makes one run of schedule and records its outcome
+func (s *Scheduler) fire(ctx context.Context, svc *admin.ServiceDefinition, schedule admin.Schedule, scheduledAt time.Time) {
+	defer s.wg.Done()
+	defer func() {
+		s.mutex.Lock()
+		if entry, ok := s.entries[schedule.ID]; ok {
+			entry.running = false
+		}
+		s.mutex.Unlock()
+	}()
+
+	version := schedule.ServiceVersionID
+	if version == 0 {
+		version = svc.ChooseVersion("")
+	}
+	run := &admin.ScheduleRun{
+		ScheduleID:  schedule.ID,
+		Service:     svc.Name,
+		Version:     version,
+		ScheduledAt: scheduledAt,
+		Status:      admin.RunRunning,
+	}
+	s.record(run)
+
+	ctx, cancel := context.WithTimeout(ctx, s.runTimeout)
+	defer cancel()
+	var resp *storedResponse
+	err := admin.ErrVersionNotFound
+	if version != 0 {
+		header := http.Header{}
+		header.Set(ScheduleIDHeader, strconv.FormatUint(uint64(schedule.ID), 10))
+		resp, err = s.gateway.invoke(ctx, &backgroundRequest{
+			Host:    svc.Host,
+			Version: version,
+			Method:  schedule.Method,
+			Path:    schedule.Path,
+			Header:  header,
+			Body:    []byte(schedule.Body),
+		}, scheduleMaxResponseBytes)
+	}
+	status := 0
+	if resp != nil {
+		status = resp.status
+	}
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		err = errors.New("cless shut down during the run")
+	}
+	run.Outcome(status, err)
+	log.Info().
+		Str("service", svc.Name).
+		Uint("schedule", schedule.ID).
+		Uint("version", version).
+		Str("status", run.Status).
+		Int("response status", status).
+		Msg("Scheduled run finished")
+	s.record(run)
+}
+
+func (s *Scheduler) record(run *admin.ScheduleRun) {
+	var err error
+	created := run.ID == 0
+	if created {
+		err = s.runs.Create(run)
+	} else {
+		err = s.runs.Update(run)
+	}
+	if err != nil {
+		log.Error().Err(err).Uint("schedule", run.ScheduleID).Msg("Failed to record scheduled run")
+		return
+	}
+	// a new run pushes the oldest out, a schedule firing every minute would grow the table forever
+	if created && s.keepRuns > 0 {
+		if err := s.runs.Prune(run.ScheduleID, s.keepRuns); err != nil {
+			log.Error().Err(err).Uint("schedule", run.ScheduleID).Msg("Failed to prune scheduled runs")
+		}
+	}
+}
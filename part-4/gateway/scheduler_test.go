@@ -0,0 +1,97 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"codereliant.io/cless/admin"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSchedulerSkipsOverlappingRuns tests that a schedule fires on its cron expression,
+// skips its turn while the previous run is still going and records every run
+func TestSchedulerSkipsOverlappingRuns(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	unblock := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		<-unblock
+	}))
+	defer backend.Close()
+	g := newTestGateway(t, &fakeContainerManager{rSvc: backendService(t, backend)})
+	sDef, _ := g.sDefManager.GetServiceDefinitionByName("test")
+	schedule := &admin.Schedule{Cron: "*/5 * * * *", TimeZone: "Europe/Berlin", Path: "/report"}
+	assert.NoError(t, g.sDefManager.AddSchedule(sDef, schedule))
+	assert.Equal(t, http.MethodPost, schedule.Method)
+	runs := admin.NewSqliteScheduleRunRepository(newTestDB(t))
+	s := NewScheduler(g, runs, DefaultSchedulerConfig())
+	ctx := context.Background()
+
+	start := time.Date(2024, 1, 1, 10, 1, 0, 0, time.UTC)
+	s.tick(ctx, start)
+	s.tick(ctx, start.Add(time.Minute))
+	select {
+	case <-requests:
+		t.Fatal("schedule fired early")
+	default:
+	}
+
+	s.tick(ctx, start.Add(4*time.Minute))
+	select {
+	case r := <-requests:
+		assert.Equal(t, "/report", r.URL.Path)
+		assert.Equal(t, http.MethodPost, r.Method)
+	case <-time.After(5 * time.Second):
+		t.Fatal("schedule did not fire")
+	}
+
+	// the first run is still going when the next one is due
+	s.tick(ctx, start.Add(9*time.Minute))
+	close(unblock)
+	s.wg.Wait()
+
+	recorded, err := runs.ListBySchedule(schedule.ID, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, recorded, 2) {
+		assert.Equal(t, admin.RunSkipped, recorded[0].Status)
+		assert.Equal(t, admin.RunSucceeded, recorded[1].Status)
+		assert.Equal(t, http.StatusOK, recorded[1].ResponseStatus)
+		assert.Equal(t, start.Add(4*time.Minute), recorded[1].ScheduledAt.UTC())
+	}
+}
+
+// TestSchedulerKeepsLatestRuns tests that only the latest runs of a schedule are kept
+func TestSchedulerKeepsLatestRuns(t *testing.T) {
+	g := newTestGateway(t, &fakeContainerManager{})
+	runs := admin.NewSqliteScheduleRunRepository(newTestDB(t))
+	cfg := DefaultSchedulerConfig()
+	cfg.KeepRuns = 3
+	s := NewScheduler(g, runs, cfg)
+	for i := 0; i < 5; i++ {
+		s.record(&admin.ScheduleRun{ScheduleID: 1, Status: admin.RunSkipped, ScheduledAt: time.Unix(int64(i), 0)})
+	}
+	s.record(&admin.ScheduleRun{ScheduleID: 2, Status: admin.RunSkipped})
+
+	recorded, err := runs.ListBySchedule(1, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, recorded, 3) {
+		assert.Equal(t, int64(4), recorded[0].ScheduledAt.Unix())
+		assert.Equal(t, int64(2), recorded[2].ScheduledAt.Unix())
+	}
+	recorded, _ = runs.ListBySchedule(2, 10)
+	assert.Len(t, recorded, 1, "other schedules keep their runs")
+}
+
+// TestAddScheduleValidates tests that broken cron expressions and time zones are rejected
+func TestAddScheduleValidates(t *testing.T) {
+	g := newTestGateway(t, &fakeContainerManager{})
+	sDef, _ := g.sDefManager.GetServiceDefinitionByName("test")
+	assert.Error(t, g.sDefManager.AddSchedule(sDef, &admin.Schedule{Cron: "61 * * * *", Path: "/"}))
+	assert.Error(t, g.sDefManager.AddSchedule(sDef, &admin.Schedule{Cron: "@daily", TimeZone: "Mars/Olympus", Path: "/"}))
+	assert.Error(t, g.sDefManager.AddSchedule(sDef, &admin.Schedule{Cron: "@daily", Path: "report"}))
+	assert.ErrorIs(t, g.sDefManager.AddSchedule(sDef, &admin.Schedule{Cron: "@daily", Path: "/", ServiceVersionID: 999}), admin.ErrVersionNotFound)
+	assert.NoError(t, g.sDefManager.AddSchedule(sDef, &admin.Schedule{Cron: "@daily", Path: "/"}))
+}
@@ -0,0 +1,49 @@
+package gateway
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"codereliant.io/cless/admin"
+)
+
+// how long the version cookie lives in the client
+const stickyCookieMaxAge = 30 * 24 * time.Hour
+
+// chooseVersionByCookie keeps the version from the cookie while it is still active,
+// otherwise it picks a new one and hands it to the client
+func chooseVersionByCookie(w http.ResponseWriter, r *http.Request, svc *admin.ServiceDefinition) uint {
+	name := stickyCookieName(svc)
+	if c, err := r.Cookie(name); err == nil {
+		if v, err := strconv.ParseUint(c.Value, 10, 64); err == nil && svc.IsActiveVersion(uint(v)) {
+			return uint(v)
+		}
+	}
+	version := svc.ChooseVersion(clientIP(r))
+	if version != 0 {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    strconv.FormatUint(uint64(version), 10),
+			Path:     "/",
+			MaxAge:   int(stickyCookieMaxAge.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return version
+}
+
+// services behind the same host through routing rules each get their own cookie
+func stickyCookieName(svc *admin.ServiceDefinition) string {
+	return "cless-version-" + strconv.FormatUint(uint64(svc.ID), 10)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
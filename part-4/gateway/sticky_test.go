@@ -0,0 +1,69 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"codereliant.io/cless/admin"
+	"github.com/stretchr/testify/assert"
+)
+
+func newStickyService(sticky admin.StickySession, weights ...uint) *admin.ServiceDefinition {
+	svc := &admin.ServiceDefinition{Name: "test", Sticky: sticky}
+	svc.ID = 1
+	tw := admin.TrafficWeight{}
+	for i, w := range weights {
+		tw.Weights = append(tw.Weights, admin.Weight{ServiceVersionID: uint(i + 1), Weight: w})
+	}
+	svc.TrafficWeights = []admin.TrafficWeight{tw}
+	return svc
+}
+
+// TestStickyCookie tests that a client keeps its version and is moved once the version is retired
+func TestStickyCookie(t *testing.T) {
+	svc := newStickyService(admin.StickySession{Mode: admin.StickyCookie}, 50, 50)
+
+	rec := httptest.NewRecorder()
+	first := chooseVersion(rec, httptest.NewRequest(http.MethodGet, "/", nil), svc)
+	cookies := rec.Result().Cookies()
+	assert.Len(t, cookies, 1)
+
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookies[0])
+		rec := httptest.NewRecorder()
+		assert.Equal(t, first, chooseVersion(rec, req, svc))
+		assert.Empty(t, rec.Result().Cookies(), "a valid cookie is not reissued")
+	}
+
+	// retire the version the client is on
+	other := uint(3) - first
+	retired := newStickyService(admin.StickySession{Mode: admin.StickyCookie})
+	retired.TrafficWeights[0].Weights = []admin.Weight{{ServiceVersionID: other, Weight: 100}}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	assert.Equal(t, other, chooseVersion(rec, req, retired))
+	assert.Len(t, rec.Result().Cookies(), 1)
+}
+
+// TestStickyHeaderKeepsWeights tests that hashing keeps each client on one version
+// while the population still follows the weights
+func TestStickyHeaderKeepsWeights(t *testing.T) {
+	svc := newStickyService(admin.StickySession{Mode: admin.StickyHeader, Header: "X-User-ID"}, 10, 30, 60)
+
+	counts := make(map[uint]int)
+	const clients = 20000
+	for i := 0; i < clients; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-User-ID", fmt.Sprintf("user-%d", i))
+		version := chooseVersion(httptest.NewRecorder(), req, svc)
+		assert.Equal(t, version, chooseVersion(httptest.NewRecorder(), req, svc))
+		counts[version]++
+	}
+	assert.InDelta(t, 0.10, float64(counts[1])/clients, 0.02)
+	assert.InDelta(t, 0.30, float64(counts[2])/clients, 0.02)
+	assert.InDelta(t, 0.60, float64(counts[3])/clients, 0.02)
+}
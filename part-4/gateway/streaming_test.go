@@ -0,0 +1,122 @@
+package gateway
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"codereliant.io/cless/container"
+	"github.com/stretchr/testify/assert"
+)
+
+func backendService(t *testing.T, backend *httptest.Server) *container.RunningService {
+	u, _ := url.Parse(backend.URL)
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatalf("Failed to parse backend port: %s", err)
+	}
+	return &container.RunningService{AssignedPort: port}
+}
+
+// TestServerSentEventsAreFlushed tests that events reach the client while the stream is open
+// and that the container counts as busy until the stream ends
+func TestServerSentEventsAreFlushed(t *testing.T) {
+	done := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: hello\n\n")
+		w.(http.Flusher).Flush()
+		<-done
+	}))
+	defer backend.Close()
+	rSvc := backendService(t, backend)
+	front := httptest.NewServer(newTestGateway(t, &fakeContainerManager{rSvc: rSvc}))
+	defer front.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, front.URL, nil)
+	req.Host = "test.cless.cloud"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %s", err)
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "data: hello\n", line)
+	assert.Equal(t, int64(1), rSvc.ActiveRequests())
+
+	close(done)
+	assert.Eventually(t, func() bool { return rSvc.ActiveRequests() == 0 }, 2*time.Second, 10*time.Millisecond)
+}
+
+// TestAbortedResponseEndsRequest tests that a response cut off mid-copy, which makes the proxy
+// abort the handler with a panic, still takes the request off the container
+func TestAbortedResponseEndsRequest(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		fmt.Fprint(w, "partial")
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer backend.Close()
+	rSvc := backendService(t, backend)
+	front := httptest.NewServer(newTestGateway(t, &fakeContainerManager{rSvc: rSvc}))
+	defer front.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, front.URL, nil)
+	req.Host = "test.cless.cloud"
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	assert.Eventually(t, func() bool { return rSvc.ActiveRequests() == 0 }, 2*time.Second, 10*time.Millisecond)
+}
+
+// TestWebSocketUpgradePassthrough tests that an upgraded connection is tunneled to the container
+func TestWebSocketUpgradePassthrough(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+		// echo one line back
+		line, _ := buf.ReadString('\n')
+		buf.WriteString(line)
+		buf.Flush()
+	}))
+	defer backend.Close()
+	rSvc := backendService(t, backend)
+	front := httptest.NewServer(newTestGateway(t, &fakeContainerManager{rSvc: rSvc}))
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: test.cless.cloud\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, int64(1), rSvc.ActiveRequests())
+
+	fmt.Fprint(conn, "ping\n")
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+}
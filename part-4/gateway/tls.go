@@ -0,0 +1,85 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"codereliant.io/cless/admin"
+	"github.com/rs/zerolog/log"
+)
+
+// CertStore picks the certificate for a TLS handshake by SNI. certificates uploaded
+// through the admin API win, the internal CA (if any) covers the remaining hosts cless serves.
+// the store reloads itself whenever a certificate is added, replaced or deleted
+type CertStore struct {
+	certManager *admin.CertificateManager
+	ca          *CertificateAuthority
+	serves      func(host string) bool // whether the CA may mint for host
+	certs       atomic.Pointer[map[string]*tls.Certificate]
+}
+
+// NewCertStore loads all stored certificates, ca may be nil. the CA only mints for hosts
+// serves accepts, so a handshake with any name under its domain doesn't cost a key
+func NewCertStore(certManager *admin.CertificateManager, ca *CertificateAuthority, serves func(host string) bool) (*CertStore, error) {
+	cs := &CertStore{
+		certManager: certManager,
+		ca:          ca,
+		serves:      serves,
+	}
+	if err := cs.reload(); err != nil {
+		return nil, err
+	}
+	certManager.OnChange(func() {
+		if err := cs.reload(); err != nil {
+			log.Error().Err(err).Msg("Failed to reload certificates")
+		}
+	})
+	return cs, nil
+}
+
+func (cs *CertStore) reload() error {
+	stored, err := cs.certManager.ListCertificates()
+	if err != nil {
+		return err
+	}
+	certs := make(map[string]*tls.Certificate, len(stored))
+	for _, c := range stored {
+		pair, err := tls.X509KeyPair([]byte(c.CertPEM), []byte(c.KeyPEM))
+		if err != nil {
+			log.Error().Err(err).Str("host", c.Host).Msg("Skipping invalid certificate")
+			continue
+		}
+		certs[c.Host] = &pair
+	}
+	cs.certs.Store(&certs)
+	log.Info().Int("certificates", len(certs)).Msg("Loaded certificates")
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(hello.ServerName)
+	certs := *cs.certs.Load()
+	if cert, ok := certs[host]; ok {
+		return cert, nil
+	}
+	// a.b.cless.cloud is covered by *.b.cless.cloud
+	if i := strings.IndexByte(host, '.'); i > 0 {
+		if cert, ok := certs["*"+host[i:]]; ok {
+			return cert, nil
+		}
+	}
+	if cs.ca != nil && cs.ca.Covers(host) && cs.serves(host) {
+		return cs.ca.CertificateFor(host)
+	}
+	return nil, fmt.Errorf("no certificate for host %q", host)
+}
+
+func (cs *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cs.GetCertificate,
+	}
+}
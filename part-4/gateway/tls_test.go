@@ -0,0 +1,104 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"codereliant.io/cless/admin"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func newTestCA(t *testing.T) *CertificateAuthority {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"), "cless.cloud")
+	if err != nil {
+		t.Fatalf("Failed to create CA: %s", err)
+	}
+	return ca
+}
+
+// TestInternalCAMintsVerifiableCertificates tests that minted certificates chain up to the CA
+// and that the CA is loaded again from disk instead of regenerated
+func TestInternalCAMintsVerifiableCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"), "cless.cloud")
+	assert.NoError(t, err)
+
+	cert, err := ca.CertificateFor("app-1.cless.cloud")
+	assert.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "app-1.cless.cloud", Roots: roots})
+	assert.NoError(t, err)
+
+	_, err = ca.CertificateFor("example.com")
+	assert.Error(t, err)
+
+	reloaded, err := LoadOrCreateCA(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"), "cless.cloud")
+	assert.NoError(t, err)
+	assert.Equal(t, ca.cert.Raw, reloaded.cert.Raw)
+}
+
+// TestCertStoreReloadsUploadedCertificates tests that an uploaded certificate is served by SNI
+// as soon as it is stored, ahead of the internal CA, and that the CA only mints for served hosts
+func TestCertStoreReloadsUploadedCertificates(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.sqlite3")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("Failed to open sqlite db: %s", err)
+	}
+	certManager := admin.NewCertificateManager(admin.NewSqliteCertificateRepository(db))
+	ca := newTestCA(t)
+	store, err := NewCertStore(certManager, ca, func(host string) bool { return host == "app-1.cless.cloud" })
+	assert.NoError(t, err)
+
+	hello := &tls.ClientHelloInfo{ServerName: "app-1.cless.cloud"}
+	minted, err := store.GetCertificate(hello)
+	assert.NoError(t, err)
+
+	// upload a certificate from another CA for the same host
+	other := newTestCA(t)
+	uploaded, _ := other.CertificateFor("app-1.cless.cloud")
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(uploaded.PrivateKey)
+	err = certManager.PutCertificate(
+		"app-1.cless.cloud",
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: uploaded.Leaf.Raw})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+	)
+	assert.NoError(t, err)
+
+	served, err := store.GetCertificate(hello)
+	assert.NoError(t, err)
+	assert.Equal(t, uploaded.Leaf.Raw, served.Certificate[0])
+	assert.NotEqual(t, minted.Certificate[0], served.Certificate[0])
+
+	_, err = store.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	assert.Error(t, err)
+	_, err = store.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.cless.cloud"})
+	assert.Error(t, err)
+	assert.Len(t, ca.minted, 1, "no certificate is minted for a host no service has")
+}
+
+// TestRedirectToHTTPS tests that services asking for it get plain http requests redirected
+func TestRedirectToHTTPS(t *testing.T) {
+	g := newTestGateway(t, &fakeContainerManager{})
+	sDef, _ := g.sDefManager.GetServiceDefinitionByName("test")
+	assert.NoError(t, g.sDefManager.SetRedirectHTTPS(sDef, true))
+	assert.NoError(t, g.EnableHTTPSRedirects(":8443"))
+
+	req := httptest.NewRequest(http.MethodGet, "/path?q=1", nil)
+	req.Host = "test.cless.cloud"
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusPermanentRedirect, rec.Code)
+	assert.Equal(t, "https://test.cless.cloud:8443/path?q=1", rec.Header().Get("Location"))
+}
@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"codereliant.io/cless/tracecontext"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans sends the spans of the test to the returned recorder
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(trace.NewNoopTracerProvider()) })
+	return recorder
+}
+
+func spansByName(spans []sdktrace.ReadOnlySpan) map[string]sdktrace.ReadOnlySpan {
+	byName := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range spans {
+		byName[span.Name()] = span
+	}
+	return byName
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+// TestRequestSpans tests that a request is traced as a child of the client's span
+// and that the container sees the proxy span as its parent
+func TestRequestSpans(t *testing.T) {
+	recorder := recordSpans(t)
+	var traceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get(tracecontext.TraceparentHeader)
+	}))
+	defer backend.Close()
+	g := newTestGateway(t, &fakeContainerManager{rSvc: backendService(t, backend)})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "test.cless.cloud"
+	req.Header.Set(tracecontext.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	g.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := spansByName(recorder.Ended())
+	root := spans["gateway.request"]
+	assert.NotNil(t, root)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", root.Parent().SpanID().String())
+	assert.True(t, root.Parent().IsRemote())
+	assert.Equal(t, "test", spanAttribute(root, "cless.service").AsString())
+	assert.Equal(t, int64(http.StatusOK), spanAttribute(root, "http.status_code").AsInt64())
+
+	for _, name := range []string{"gateway.route", "gateway.choose_version", "gateway.proxy"} {
+		assert.Equal(t, root.SpanContext().SpanID(), spans[name].Parent().SpanID(), name)
+	}
+	proxy := spans["gateway.proxy"]
+	assert.Equal(t, trace.SpanKindClient, proxy.SpanKind())
+	assert.Equal(t, int64(http.StatusOK), spanAttribute(proxy, "http.status_code").AsInt64())
+	tp, ok := tracecontext.ParseTraceParent(traceparent)
+	assert.True(t, ok)
+	assert.Equal(t, proxy.SpanContext().SpanID(), trace.SpanID(tp.SpanID))
+}
+
+// TestFailedProxySpan tests that an unreachable container marks the proxy and request spans as failed
+func TestFailedProxySpan(t *testing.T) {
+	recorder := recordSpans(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rSvc := backendService(t, backend)
+	backend.Close()
+	g := newTestGateway(t, &fakeContainerManager{rSvc: rSvc})
+
+	rec, _ := serve(g, "test.cless.cloud")
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	spans := spansByName(recorder.Ended())
+	assert.Equal(t, codes.Error, spans["gateway.proxy"].Status().Code)
+	assert.Equal(t, codes.Error, spans["gateway.request"].Status().Code)
+}
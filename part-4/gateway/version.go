@@ -0,0 +1,27 @@
+package gateway
+
+import (
+	"net/http"
+
+	"codereliant.io/cless/admin"
+)
+
+// chooseVersion picks the version for a request. version rules come first,
+// then the traffic weights, keeping the client on its previous version
+// when the service asks for sticky sessions
+func chooseVersion(w http.ResponseWriter, r *http.Request, svc *admin.ServiceDefinition) uint {
+	if version, ok := svc.MatchVersionRule(r.Header, r.URL.Query()); ok {
+		return version
+	}
+	switch svc.Sticky.Mode {
+	case admin.StickyCookie:
+		return chooseVersionByCookie(w, r, svc)
+	case admin.StickyHeader:
+		if key := r.Header.Get(svc.Sticky.Header); key != "" {
+			return svc.ChooseVersionForKey(key)
+		}
+	case admin.StickyClientIP:
+		return svc.ChooseVersionForKey(clientIP(r))
+	}
+	return svc.ChooseVersion(clientIP(r))
+}
@@ -6,17 +6,20 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"os/signal"
-	"time"
+	"syscall"
 
 	"codereliant.io/cless/admin"
+	"codereliant.io/cless/config"
 	"codereliant.io/cless/container"
 	"codereliant.io/cless/db"
+	"codereliant.io/cless/gateway"
+	"codereliant.io/cless/tracing"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"gorm.io/gorm"
 )
 
@@ -24,21 +27,40 @@ var containerManager container.ContainerManager
 var svcDefinitionManager *admin.ServiceDefinitionManager
 var gormDbInstance *gorm.DB
 var err error
-var srv = &http.Server{
-	Addr: ":80",
-}
+var srv = &http.Server{}
+var tlsSrv = &http.Server{}
 
 func main() {
+	cfg, opts, err := config.Load(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if opts.PrintConfig {
+		b, err := cfg.YAML()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to print config")
+		}
+		os.Stdout.Write(b)
+		return
+	}
+
 	// logging
-	debug := flag.Bool("debug", false, "sets log level to debug")
-	flag.Parse()
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	if *debug {
+	if cfg.Debug {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	}
 
+	shutdownTracing, err := tracing.Setup(cfg.Tracing)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid tracing settings")
+	}
+
 	// sqlite db instance
-	gormDbInstance, err = db.NewSqliteDB()
+	gormDbInstance, err = db.NewSqliteDB(cfg.Database)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to create sqlite db")
 		panic(err)
@@ -46,75 +68,101 @@ func main() {
 
 	// admin service/server
 	repo := admin.NewSqliteServiceDefinitionRepository(gormDbInstance)
-	svcDefinitionManager = admin.NewServiceDefinitionManager(repo)
-	go admin.StartAdminServer(svcDefinitionManager)
+	svcDefinitionManager = admin.NewServiceDefinitionManager(repo, cfg.Admin)
+	certManager := admin.NewCertificateManager(admin.NewSqliteCertificateRepository(gormDbInstance))
+	invocations := admin.NewSqliteInvocationRepository(gormDbInstance)
+	scheduleRuns := admin.NewSqliteScheduleRunRepository(gormDbInstance)
+	eventBus := admin.NewEventBus(admin.NewSqliteEventRepository(gormDbInstance), svcDefinitionManager)
 
 	// container manager
-	containerManager, err = container.NewDockerContainerManager(svcDefinitionManager)
+	dockerManager, err := container.NewDockerContainerManager(svcDefinitionManager, cfg.Containers)
 	if err != nil {
 		fmt.Printf("Failed to create container manager: %s\n", err)
 		return
 	}
+	containerManager = dockerManager
+	go admin.StartAdminServer(cfg.Admin, svcDefinitionManager, certManager, invocations, scheduleRuns, eventBus, dockerManager)
 
 	// setup http server
-	http.HandleFunc("/", handler)
+	gw := gateway.NewGateway(
+		svcDefinitionManager,
+		containerManager,
+		gateway.NewTransport(cfg.Transport),
+		cfg.Gateway,
+	)
+	accessLog, err := gateway.NewAccessLogger(cfg.AccessLog)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid access log settings")
+	}
+	gw.SetAccessLogger(accessLog)
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	asyncInvoker := gw.EnableAsyncInvocations(invocations, cfg.Async)
+	go asyncInvoker.Run(backgroundCtx)
+	go gateway.NewScheduler(gw, scheduleRuns, cfg.Scheduler).Run(backgroundCtx)
+	go gateway.NewEventDispatcher(gw, eventBus, cfg.Events).Run(backgroundCtx)
+	http.Handle("/", gw)
+	// accept gRPC over cleartext HTTP/2 next to HTTP/1.1
+	srv.Addr = cfg.Server.HTTPAddr
+	srv.Handler = h2c.NewHandler(http.DefaultServeMux, &http2.Server{})
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatal().Err(err).Msg("Failed to start http server")
 		}
 	}()
 
+	// setup https server
+	if cfg.Server.HTTPSAddr != "" {
+		var ca *gateway.CertificateAuthority
+		if cfg.Server.InternalCA {
+			ca, err = gateway.LoadOrCreateCA(cfg.Server.CACertFile, cfg.Server.CAKeyFile, cfg.Server.CADomain)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to load internal CA")
+			}
+		}
+		// only hosts routed to a service, or the admin server, get a minted certificate
+		certStore, err := gateway.NewCertStore(certManager, ca, func(host string) bool {
+			return host == cfg.Admin.Host || svcDefinitionManager.Routes().Serves(host)
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load certificates")
+		}
+		if err := gw.EnableHTTPSRedirects(cfg.Server.HTTPSAddr); err != nil {
+			log.Fatal().Err(err).Msg("Invalid https address")
+		}
+		tlsSrv.Addr = cfg.Server.HTTPSAddr
+		tlsSrv.TLSConfig = certStore.TLSConfig()
+		go func() {
+			if err := tlsSrv.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal().Err(err).Msg("Failed to start https server")
+			}
+		}()
+	}
+
 	// gracefull shutdown
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
+	// docker and kubernetes stop processes with SIGTERM
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	<-quit
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
 	defer cancel()
+	// open streams and websockets can keep the servers past the deadline,
+	// the containers still have to be stopped
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal().Err(err).Msg("Failed to start http server")
+		log.Error().Err(err).Msg("Failed to shutdown http server")
 	}
-	errList := containerManager.StopAndRemoveAllContainers()
+	if err := tlsSrv.Shutdown(ctx); err != nil {
+		log.Error().Err(err).Msg("Failed to shutdown https server")
+	}
+	// invocations and events in delivery go back to the queue for the next start,
+	// scheduled runs in progress are recorded as failed
+	stopBackground()
+	errList := containerManager.StopAndRemoveAllContainers(ctx)
 	if len(errList) > 0 {
 		log.Error().Errs("errors", errList).Msg("Failed to stop and remove containers")
 	} else {
 		log.Info().Msg("Stopped and removed all containers")
 	}
-}
-
-func handler(w http.ResponseWriter, r *http.Request) {
-	// handle admin requests
-	if r.Host == admin.AdminHost {
-		proxyToURL(w, r, fmt.Sprintf("%s:%d", "localhost", admin.AdminPort))
-		return
-	}
-	svc, err := svcDefinitionManager.GetServiceDefinitionByHost(r.Host)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to get service definition")
-		w.Write([]byte("Failed to get service definition"))
-		return
-	}
-
-	svcVersion := svc.ChooseVersion()
-	log.Debug().Str("host", r.Host).Uint("service version", svcVersion).Msg("choosing service version")
-
-	svcLocalHost, err := containerManager.GetRunningServiceForHost(r.Host, svcVersion)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to get running service")
-		w.Write([]byte("Failed to get running service"))
-		return
+	if err := shutdownTracing(ctx); err != nil {
+		log.Error().Err(err).Msg("Failed to flush spans")
 	}
-	log.Debug().Str("host", r.Host).Str("service localhost", *svcLocalHost).Msg("proxying request")
-	proxy := httputil.NewSingleHostReverseProxy(&url.URL{
-		Scheme: "http",
-		Host:   *svcLocalHost,
-	})
-	proxy.ServeHTTP(w, r)
-}
-
-func proxyToURL(w http.ResponseWriter, r *http.Request, pURL string) {
-	proxy := httputil.NewSingleHostReverseProxy(&url.URL{
-		Scheme: "http",
-		Host:   pURL,
-	})
-	proxy.ServeHTTP(w, r)
 }
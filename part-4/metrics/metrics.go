@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds all cless metrics. labels are limited to names of services, version ids
+// and short fixed lists, never hosts, paths or container ids, so the number of series stays bounded
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+func init() {
+	Registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// Handler serves the metrics in Registry in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// GatewayRequests counts requests handled by the gateway
+var GatewayRequests = factory.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cless",
+	Subsystem: "gateway",
+	Name:      "requests_total",
+	Help:      "Requests handled by the gateway, by service, version and status class (2xx, 4xx, ...).",
+}, []string{"service", "version", "code"})
+
+// GatewayRequestDuration measures requests from arrival until the response was written, cold starts included
+var GatewayRequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "cless",
+	Subsystem: "gateway",
+	Name:      "request_duration_seconds",
+	Help:      "Time the gateway took to answer requests, by service and version.",
+	Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 20, 30, 60},
+}, []string{"service", "version"})
+
+// GatewayRetries counts requests the gateway sent again after a failed attempt
+var GatewayRetries = factory.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cless",
+	Subsystem: "gateway",
+	Name:      "retries_total",
+	Help:      "Requests retried by the gateway after a failed attempt, by service and reason.",
+}, []string{"service", "reason"})
+
+// GatewayMirrored counts copies of requests sent to a mirror version
+var GatewayMirrored = factory.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cless",
+	Subsystem: "gateway",
+	Name:      "mirrored_requests_total",
+	Help:      "Copies of requests sent to a mirror version, by service and result.",
+}, []string{"service", "result"})
+
+// GatewayCache counts lookups in the response cache of services
+var GatewayCache = factory.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cless",
+	Subsystem: "gateway",
+	Name:      "cache_lookups_total",
+	Help:      "Requests of services with a response cache, by service and result (hit or miss).",
+}, []string{"service", "result"})
+
+// GatewayAsyncInvocations counts delivery attempts of async invocations by the state they left the invocation in
+var GatewayAsyncInvocations = factory.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cless",
+	Subsystem: "gateway",
+	Name:      "async_invocation_attempts_total",
+	Help:      "Delivery attempts of async invocations, by service and resulting status.",
+}, []string{"service", "status"})
+
+// EventDeliveries counts attempts to deliver events to subscribed services
+var EventDeliveries = factory.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cless",
+	Subsystem: "events",
+	Name:      "delivery_attempts_total",
+	Help:      "Attempts to deliver events to subscribed services, by service and resulting status.",
+}, []string{"service", "status"})
+
+// ContainerColdStarts counts containers started for a request
+var ContainerColdStarts = factory.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cless",
+	Subsystem: "container",
+	Name:      "cold_starts_total",
+	Help:      "Containers started because a request found none running, by service and result (ready or failed).",
+}, []string{"service", "result"})
+
+// ContainerStartupDuration measures how long started containers took to answer their readiness check
+var ContainerStartupDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "cless",
+	Subsystem: "container",
+	Name:      "startup_duration_seconds",
+	Help:      "Time from starting a container until it passed its readiness check, by service.",
+	Buckets:   []float64{.1, .25, .5, 1, 2, 3, 5, 8, 13, 20, 30},
+}, []string{"service"})
+
+// ContainersRunning is the number of containers the manager knows about, ready or starting
+var ContainersRunning = factory.NewGauge(prometheus.GaugeOpts{
+	Namespace: "cless",
+	Subsystem: "container",
+	Name:      "running",
+	Help:      "Containers managed by cless, including those still starting.",
+})
+
+// ContainerReplicas is the number of ready replicas of a version
+var ContainerReplicas = factory.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "cless",
+	Subsystem: "container",
+	Name:      "replicas",
+	Help:      "Ready replicas, by service and version.",
+}, []string{"service", "version"})
+
+// ContainerPortsUsed is the number of host ports assigned to containers
+var ContainerPortsUsed = factory.NewGauge(prometheus.GaugeOpts{
+	Namespace: "cless",
+	Subsystem: "container",
+	Name:      "ports_used",
+	Help:      "Host ports of the container port pool that are assigned.",
+})
+
+// ContainerPortPoolSize is the size of the container port pool
+var ContainerPortPoolSize = factory.NewGauge(prometheus.GaugeOpts{
+	Namespace: "cless",
+	Subsystem: "container",
+	Name:      "port_pool_size",
+	Help:      "Host ports in the container port pool.",
+})
+
+// ContainerIdleRemovals counts containers removed by the idle garbage collector
+var ContainerIdleRemovals = factory.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cless",
+	Subsystem: "container",
+	Name:      "idle_removals_total",
+	Help:      "Containers removed after being idle, by service.",
+}, []string{"service"})
+
+// DockerErrors counts failed calls to the docker API
+var DockerErrors = factory.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cless",
+	Subsystem: "container",
+	Name:      "docker_errors_total",
+	Help:      "Failed docker API calls, by operation (create, start, kill, remove).",
+}, []string{"operation"})
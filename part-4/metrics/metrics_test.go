@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestHandlerServesMetrics tests that the handler exposes cless metrics next to the go runtime ones
+func TestHandlerServesMetrics(t *testing.T) {
+	GatewayRequests.WithLabelValues("test", "1", "2xx").Inc()
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `cless_gateway_requests_total{code="2xx",service="test",version="1"} 1`)
+	assert.Contains(t, rec.Body.String(), "go_goroutines")
+}
+
+// TestMetricsFollowConventions runs the Prometheus linter over all registered metrics
+func TestMetricsFollowConventions(t *testing.T) {
+	problems, err := testutil.GatherAndLint(Registry)
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+}
@@ -0,0 +1,150 @@
+// Package tracecontext carries the request id and the W3C trace context of a request
+// through cless and on to the containers, so their logs can be matched with ours
+package tracecontext
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	RequestIDHeader   = "X-Request-ID"
+	TraceparentHeader = "traceparent"
+)
+
+// longest request id accepted from a client, longer ones are replaced
+const maxRequestIDLength = 128
+
+// trace flag telling the next hop that the trace is recorded
+const flagSampled = 0x01
+
+// TraceParent is the content of a traceparent header as defined by https://www.w3.org/TR/trace-context/
+type TraceParent struct {
+	TraceID [16]byte
+	SpanID  [8]byte // id of the span that sends the request
+	Flags   byte
+}
+
+// ParseTraceParent reads a version 00 traceparent header. ids of all zeros are invalid
+func ParseTraceParent(s string) (TraceParent, bool) {
+	var tp TraceParent
+	// 00-<32 hex trace id>-<16 hex span id>-<2 hex flags>
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return tp, false
+	}
+	// later versions may append fields, version 00 may not
+	if s[:2] == "ff" || (s[:2] == "00" && len(s) != 55) || (len(s) > 55 && s[55] != '-') {
+		return tp, false
+	}
+	if !isLowerHex(s[:2]) || !isLowerHex(s[3:35]) || !isLowerHex(s[36:52]) || !isLowerHex(s[53:55]) {
+		return tp, false
+	}
+	hex.Decode(tp.TraceID[:], []byte(s[3:35]))
+	hex.Decode(tp.SpanID[:], []byte(s[36:52]))
+	var flags [1]byte
+	hex.Decode(flags[:], []byte(s[53:55]))
+	tp.Flags = flags[0]
+	if tp.TraceID == [16]byte{} || tp.SpanID == [8]byte{} {
+		return TraceParent{}, false
+	}
+	return tp, true
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// NewTraceParent starts a new sampled trace
+func NewTraceParent() TraceParent {
+	tp := TraceParent{Flags: flagSampled}
+	randomFill(tp.TraceID[:])
+	randomFill(tp.SpanID[:])
+	return tp
+}
+
+// Child returns the trace parent for a span started under tp: same trace and flags, new span id
+func (tp TraceParent) Child() TraceParent {
+	child := tp
+	randomFill(child.SpanID[:])
+	return child
+}
+
+func (tp TraceParent) String() string {
+	return fmt.Sprintf("00-%s-%s-%02x", hex.EncodeToString(tp.TraceID[:]), hex.EncodeToString(tp.SpanID[:]), tp.Flags)
+}
+
+func (tp TraceParent) TraceIDString() string {
+	return hex.EncodeToString(tp.TraceID[:])
+}
+
+func randomFill(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		// never all zeros, that would make the id invalid
+		copy(b, fmt.Sprintf("%016x", time.Now().UnixNano()))
+	}
+}
+
+func NewRequestID() string {
+	b := make([]byte, 8)
+	randomFill(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts ids of printable ascii without spaces, so they are safe to log and echo back
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Context is the request id and trace context of one request
+type Context struct {
+	RequestID string
+	Trace     TraceParent  // span of cless handling the request
+	Parent    *TraceParent // span of the client, nil if the trace starts here
+}
+
+// FromHeader takes the request id and trace of an incoming request, or makes them up when the
+// client didn't send valid ones. the trace continues in a new span
+func FromHeader(header http.Header) Context {
+	c := Context{RequestID: header.Get(RequestIDHeader)}
+	if !validRequestID(c.RequestID) {
+		c.RequestID = NewRequestID()
+	}
+	if parent, ok := ParseTraceParent(header.Get(TraceparentHeader)); ok {
+		c.Trace = parent.Child()
+		c.Parent = &parent
+	} else {
+		c.Trace = NewTraceParent()
+	}
+	return c
+}
+
+// Inject sets the request id and traceparent on the header of a request sent on,
+// tracestate is passed on untouched
+func (c Context) Inject(header http.Header) {
+	header.Set(RequestIDHeader, c.RequestID)
+	header.Set(TraceparentHeader, c.Trace.String())
+}
+
+// Logger adds the request id and trace id to every line of l
+func (c Context) Logger(l zerolog.Logger) zerolog.Logger {
+	return l.With().Str("request_id", c.RequestID).Str("trace_id", c.Trace.TraceIDString()).Logger()
+}
@@ -0,0 +1,60 @@
+package tracecontext
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"valid", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"future version with extra field", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"version 00 with extra field", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"upper case", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"zero span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"short", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp, ok := ParseTraceParent(tt.value)
+			assert.Equal(t, tt.ok, ok)
+			if ok && strings.HasPrefix(tt.value, "00") {
+				assert.Equal(t, tt.value, tp.String())
+			}
+		})
+	}
+}
+
+// TestFromHeader tests that valid ids from the client are kept and the trace continues in a new span
+func TestFromHeader(t *testing.T) {
+	header := http.Header{}
+	header.Set(RequestIDHeader, "client-id-1")
+	header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	c := FromHeader(header)
+	assert.Equal(t, "client-id-1", c.RequestID)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", c.Trace.TraceIDString())
+	assert.NotEqual(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", c.Trace.String())
+
+	c.Inject(header)
+	assert.Equal(t, c.Trace.String(), header.Get(TraceparentHeader))
+
+	for _, id := range []string{"", "has space", "line\nbreak", strings.Repeat("a", 129)} {
+		header := http.Header{}
+		header.Set(RequestIDHeader, id)
+		c := FromHeader(header)
+		assert.NotEqual(t, id, c.RequestID)
+		assert.Len(t, c.RequestID, 16)
+		_, ok := ParseTraceParent(c.Trace.String())
+		assert.True(t, ok)
+	}
+}
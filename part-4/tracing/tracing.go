@@ -0,0 +1,185 @@
+// Package tracing exports OpenTelemetry spans of the gateway and the container manager
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"codereliant.io/cless/tracecontext"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// span attributes of cless, on top of the semantic conventions
+const (
+	AttrService     = attribute.Key("cless.service")
+	AttrVersion     = attribute.Key("cless.version")
+	AttrHost        = attribute.Key("cless.host")
+	AttrContainerID = attribute.Key("cless.container_id")
+	AttrColdStart   = attribute.Key("cless.cold_start")
+	AttrRequestID   = attribute.Key("cless.request_id")
+	AttrAttempt     = attribute.Key("cless.attempt")
+	AttrKilled      = attribute.Key("cless.killed") // a stopped container had to be killed
+)
+
+// where spans go
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"   // OTLP over http, to Endpoint or OTEL_EXPORTER_OTLP_ENDPOINT
+	ExporterStdout = "stdout" // one JSON document per span, for trying things out without a collector
+	ExporterFile   = "file"   // like stdout, appended to File
+)
+
+type Config struct {
+	Exporter    string  `yaml:"exporter" toml:"exporter"`
+	Endpoint    string  `yaml:"endpoint" toml:"endpoint"`         // host:port of the collector, the OTLP environment variables apply if empty
+	Insecure    bool    `yaml:"insecure" toml:"insecure"`         // plain http to the collector
+	File        string  `yaml:"file" toml:"file"`                 // file the file exporter appends to
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"` // share of new traces that are recorded, traces started upstream follow their parent
+}
+
+func DefaultConfig() Config {
+	return Config{Exporter: ExporterNone, SampleRatio: 1}
+}
+
+func (cfg Config) Validate() error {
+	switch cfg.Exporter {
+	case "", ExporterNone, ExporterOTLP, ExporterStdout:
+	case ExporterFile:
+		if cfg.File == "" {
+			return errors.New("file exporter needs a file")
+		}
+	default:
+		return fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return fmt.Errorf("trace sample ratio must be between 0 and 1, got %v", cfg.SampleRatio)
+	}
+	return nil
+}
+
+// Tracer is used for all spans of cless. until Setup installs an exporter it hands out spans that
+// record nothing and cost next to nothing
+func Tracer() trace.Tracer {
+	return otel.Tracer("codereliant.io/cless")
+}
+
+// Setup installs the tracer provider described by cfg. the returned function flushes
+// the spans still buffered and must be called on shutdown
+func Setup(cfg Config) (func(context.Context) error, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	var exporter sdktrace.SpanExporter
+	var closer io.Closer
+	switch cfg.Exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		var err error
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			return nil, err
+		}
+	case ExporterStdout:
+		var err error
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, err
+		}
+	case ExporterFile:
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		closer = f
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("cless")))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}, nil
+}
+
+// StartRequest starts the root span of a request handled by cless, as a child of the span the
+// client sent in tc. tc is moved onto the new span, so the trace id in logs and the traceparent
+// sent on belong to spans that are exported
+func StartRequest(ctx context.Context, tc *tracecontext.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if tc.Parent != nil {
+		ctx = trace.ContextWithRemoteSpanContext(ctx, spanContext(*tc.Parent))
+	}
+	opts = append([]trace.SpanStartOption{trace.WithSpanKind(trace.SpanKindServer)}, opts...)
+	ctx, span := Tracer().Start(ctx, name, opts...)
+	if span.IsRecording() {
+		tc.Trace = traceParent(span.SpanContext())
+	}
+	return ctx, span
+}
+
+// Inject sets the traceparent header for a request sent from within the span in ctx.
+// while the span records nothing the header is left as it is
+func Inject(ctx context.Context, header interface{ Set(string, string) }) {
+	span := trace.SpanFromContext(ctx)
+	if span.IsRecording() {
+		header.Set(tracecontext.TraceparentHeader, traceParent(span.SpanContext()).String())
+	}
+}
+
+// End records err on span if there is one and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func spanContext(tp tracecontext.TraceParent) trace.SpanContext {
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    tp.TraceID,
+		SpanID:     tp.SpanID,
+		TraceFlags: trace.TraceFlags(tp.Flags),
+		Remote:     true,
+	})
+}
+
+func traceParent(sc trace.SpanContext) tracecontext.TraceParent {
+	return tracecontext.TraceParent{TraceID: sc.TraceID(), SpanID: sc.SpanID(), Flags: byte(sc.TraceFlags())}
+}
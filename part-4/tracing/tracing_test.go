@@ -0,0 +1,44 @@
+package tracing
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"codereliant.io/cless/tracecontext"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TestFileExporter tests that spans end up in the file once tracing is shut down,
+// and that the request context moves onto the exported span
+func TestFileExporter(t *testing.T) {
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	file := filepath.Join(t.TempDir(), "spans.json")
+	shutdown, err := Setup(Config{Exporter: ExporterFile, File: file, SampleRatio: 1})
+	assert.NoError(t, err)
+
+	parent, _ := tracecontext.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	tc := tracecontext.Context{RequestID: "req-1", Trace: parent.Child(), Parent: &parent}
+	_, span := StartRequest(context.Background(), &tc, "gateway.request")
+	span.End()
+	assert.Equal(t, span.SpanContext().SpanID(), trace.SpanID(tc.Trace.SpanID))
+	assert.NoError(t, shutdown(context.Background()))
+
+	b, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `"Name":"gateway.request"`)
+	assert.Contains(t, string(b), "4bf92f3577b34da6a3ce929d0e0e4736")
+}
+
+func TestSetupValidates(t *testing.T) {
+	_, err := Setup(Config{Exporter: "zipkin"})
+	assert.Error(t, err)
+	_, err = Setup(Config{Exporter: ExporterFile})
+	assert.Error(t, err)
+	shutdown, err := Setup(DefaultConfig())
+	assert.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+}